@@ -0,0 +1,248 @@
+/**
+batch.go
+
+Contains 'business' logic for processing many receipts in one request
+*/
+
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Define the paths for the HTTP server
+const (
+	ProcessReceiptBatchPath = "/receipts/process:batch"
+)
+
+// Content type of a batch sent as one receipt per line rather than a JSON array
+const ndjsonContentType = "application/x-ndjson"
+
+// Most bytes read per receipt of a batch, so a batch's body can be at most `batchMaxSize` times this
+const maxBatchReceiptBytes = 64 << 10
+
+// Returned when a batch has more than `batchMaxSize` receipts
+var errBatchTooLarge = errors.New("batch has too many receipts")
+
+// Limits on batches used unless `SetBatchLimits` is called
+const (
+	DefaultBatchMaxSize = 1000
+	DefaultBatchWorkers = 4
+)
+
+var (
+	// Most receipts accepted in one batch
+	batchMaxSize = DefaultBatchMaxSize
+
+	// Most receipts of one batch processed at the same time
+	batchWorkers = DefaultBatchWorkers
+)
+
+// Replaces the most receipts accepted in one batch, and how many of them are processed at the same time
+// Should be called before the server starts handling requests
+func SetBatchLimits(maxSize int, workers int) error {
+	if maxSize <= 0 {
+		return fmt.Errorf("max batch size must be positive")
+	}
+	if workers <= 0 {
+		return fmt.Errorf("batch workers must be positive")
+	}
+
+	batchMaxSize = maxSize
+	batchWorkers = workers
+	return nil
+}
+
+// Validate a request to process a batch of receipts, then calculate and store the points of each one independently
+// Responds with a result per receipt, in the order they were sent, whether or not it could be processed
+// Retries carrying the same `Idempotency-Key` header are answered with the original response
+func ProcessReceiptBatch(w http.ResponseWriter, r *http.Request) {
+
+	// The body is hashed as it is read, to tell retries apart from different batches sent with the same key
+	hash := sha256.New()
+	body := io.TeeReader(http.MaxBytesReader(w, r.Body, int64(batchMaxSize)*maxBatchReceiptBytes), hash)
+
+	receipts, err := readBatch(r.Header.Get("Content-Type"), body)
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		log.Printf("Batch was larger than the max of %v bytes", maxBytesErr.Limit)
+		writeProblem(w, http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Type:   ErrorTypeBatchTooLarge,
+			Detail: fmt.Sprintf("The batch is larger than %v bytes, the most accepted for %v receipts.", maxBytesErr.Limit, batchMaxSize),
+		})
+		return
+	case errors.Is(err, bufio.ErrTooLong):
+		log.Printf("Batch had a line longer than the max of %v bytes", maxBatchReceiptBytes)
+		writeProblem(w, http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Type:   ErrorTypeBatchTooLarge,
+			Detail: fmt.Sprintf("A receipt of the batch is larger than %v bytes, the most accepted.", maxBatchReceiptBytes),
+		})
+		return
+	case errors.Is(err, errBatchTooLarge):
+		log.Printf("Batch had more receipts than the max of %v", batchMaxSize)
+		writeProblem(w, http.StatusRequestEntityTooLarge, &models.ErrorResponse{
+			Type:   ErrorTypeBatchTooLarge,
+			Detail: fmt.Sprintf("The batch has more than %v receipts, the most accepted.", batchMaxSize),
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to read batch: %v", err)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The batch must be a JSON array of receipts, or one receipt per line sent as " + ndjsonContentType + ".",
+		})
+		return
+	}
+
+	if len(receipts) == 0 {
+		log.Printf("Batch was empty")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The batch has no receipts.",
+		})
+		return
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		processReceiptBatch(w, receipts)
+		return
+	}
+
+	batchIdempotency.serve(w, r, key, [sha256.Size]byte(hash.Sum(nil)), func(w http.ResponseWriter) {
+		processReceiptBatch(w, receipts)
+	})
+}
+
+// Processes each receipt of a batch
+func processReceiptBatch(w http.ResponseWriter, receipts []json.RawMessage) {
+
+	// Hand the receipts out to a bounded number of workers, each filling in the results for the receipts it takes
+	resp := &models.ProcessReceiptBatchResponse{
+		Results: make([]models.BatchReceiptResult, len(receipts)),
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchWorkers, len(receipts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				resp.Results[i] = processBatchReceipt(i, receipts[i])
+			}
+		}()
+	}
+
+	for i := range receipts {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, result := range resp.Results {
+		if result.Error != nil {
+			resp.Failed++
+		} else {
+			resp.Processed++
+		}
+	}
+
+	log.Printf("Processed batch of %v receipts: %v failed", len(receipts), resp.Failed)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Processes one receipt of a batch, describing why it wasn't processed if it couldn't be
+func processBatchReceipt(index int, receipt []byte) models.BatchReceiptResult {
+	result := models.BatchReceiptResult{Index: index}
+
+	var receiptData models.Receipt
+	err := json.Unmarshal(receipt, &receiptData)
+	if err != nil {
+		log.Printf("Failed to unmarshal receipt %v of batch: %v", index, err)
+		result.Error = invalidReceiptProblem(decodeErrors(err))
+		return result
+	}
+
+	result.ID, result.Error = scoreReceipt(&receiptData)
+	return result
+}
+
+// Reads a batch one receipt at a time, stopping with `errBatchTooLarge` as soon as it has more than `batchMaxSize`
+// NDJSON batches have a receipt per line, ignoring blank lines, and any other batch must be a JSON array
+func readBatch(contentType string, body io.Reader) ([]json.RawMessage, error) {
+	var receipts []json.RawMessage
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == ndjsonContentType {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(nil, maxBatchReceiptBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(receipts) == batchMaxSize {
+				return nil, errBatchTooLarge
+			}
+			receipts = append(receipts, bytes.Clone(line))
+		}
+
+		return receipts, scanner.Err()
+	}
+
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('[') {
+		return nil, fmt.Errorf("batch is not a JSON array")
+	}
+
+	for decoder.More() {
+		var receipt json.RawMessage
+		err = decoder.Decode(&receipt)
+		if err != nil {
+			return nil, err
+		}
+		if len(receipts) == batchMaxSize {
+			return nil, errBatchTooLarge
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	_, err = decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing but whitespace may follow the array
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return nil, fmt.Errorf("batch has data after the JSON array")
+	}
+
+	return receipts, nil
+}
@@ -0,0 +1,141 @@
+/**
+errors.go
+
+Helpers for writing structured error responses
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Machine-readable error types used in structured error responses
+const (
+	ErrorTypeInvalidRequest       = "invalid-request"
+	ErrorTypeInsufficientBalance  = "insufficient-balance"
+	ErrorTypeIdempotencyKeyReused = "idempotency-key-reused"
+	ErrorTypeDuplicateReceipt     = "duplicate-receipt"
+	ErrorTypeInvalidReceipt       = "invalid-receipt"
+	ErrorTypeBatchTooLarge        = "batch-too-large"
+	ErrorTypeInternal             = "internal-error"
+	ErrorTypeQueueFull            = "queue-full"
+	ErrorTypeReceiptVoided        = "receipt-voided"
+	ErrorTypeInvalidRules         = "invalid-rules"
+	ErrorTypeUserNotFound         = "user-not-found"
+	ErrorTypeApplyDisabled        = "apply-disabled"
+)
+
+// When set, invalid receipts get the original plain text response instead of a structured one
+var legacyErrors bool
+
+// Switches invalid receipts back to the original plain text response, for clients that depend on it
+// Should be called before the server starts handling requests
+func SetLegacyErrors(legacy bool) {
+	legacyErrors = legacy
+}
+
+// Content type of structured error responses
+const problemContentType = "application/problem+json"
+
+// Writes a structured error response, filling in the status and a default title if they're missing
+func writeProblem(w http.ResponseWriter, status int, problem *models.ErrorResponse) {
+	problem.Status = status
+	if problem.Title == "" {
+		problem.Title = http.StatusText(status)
+	}
+
+	buf, err := json.Marshal(problem)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+// Responds to a receipt that couldn't be decoded or validated, listing what's wrong with it
+func writeInvalidReceipt(w http.ResponseWriter, errs models.ValidationErrors) {
+	if legacyErrors {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("The receipt is invalid."))
+		return
+	}
+
+	writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+		Type:   ErrorTypeInvalidReceipt,
+		Detail: "The receipt is invalid.",
+		Errors: errs,
+	})
+}
+
+// Returns the `invalid-receipt` error for a receipt that failed validation
+func invalidReceiptProblem(err error) *models.ErrorResponse {
+	var errs models.ValidationErrors
+	errors.As(err, &errs)
+
+	return &models.ErrorResponse{
+		Type:   ErrorTypeInvalidReceipt,
+		Title:  http.StatusText(http.StatusBadRequest),
+		Status: http.StatusBadRequest,
+		Detail: "The receipt is invalid.",
+		Errors: errs,
+	}
+}
+
+// Returns the error for a request that failed because of the server rather than the request, e.g. the store being unavailable
+func internalProblem() *models.ErrorResponse {
+	return &models.ErrorResponse{
+		Type:   ErrorTypeInternal,
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+	}
+}
+
+// Describes why a request body couldn't be decoded, naming the field if the JSON was well formed
+func decodeErrors(err error) models.ValidationErrors {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := fieldPath(typeErr.Field)
+		return models.ValidationErrors{{
+			Field:   field,
+			Code:    models.ValidationInvalidType,
+			Message: fmt.Sprintf("%v can't be a JSON %v", field, typeErr.Value),
+		}}
+	}
+
+	return models.ValidationErrors{{
+		Code:    models.ValidationMalformed,
+		Message: "the request body is not valid JSON",
+	}}
+}
+
+// Converts a path like `items.4.price` from the json package into the `items[4].price` used by `FieldError`
+func fieldPath(path string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(path, ".") {
+		_, err := strconv.Atoi(part)
+		if err == nil {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+
+		if i > 0 {
+			b.WriteString(".")
+		}
+		b.WriteString(part)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,83 @@
+/**
+expiry.go
+
+Manages the points expiry policy, including the background job that debits expired points
+*/
+
+package controller
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Policy applied to newly processed receipts, points never expire by default
+var expiryPolicy atomic.Pointer[models.ExpiryPolicy]
+
+// Returns the policy applied to newly processed receipts
+func ExpiryPolicy() models.ExpiryPolicy {
+	policy := expiryPolicy.Load()
+	if policy == nil {
+		return models.ExpiryPolicy{}
+	}
+
+	return *policy
+}
+
+// Replaces the policy applied to newly processed receipts
+// Points that were already awarded keep the expiry they were given
+func SetExpiryPolicy(policy models.ExpiryPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	expiryPolicy.Store(&policy)
+	return nil
+}
+
+// Debits every user's points that expired by the given time, returning how many users had points expire
+func ExpirePoints(at time.Time) (int, error) {
+	userIDs, err := receiptStore.ExpiringUsers(at)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, userID := range userIDs {
+		entry, err := receiptStore.ExpirePoints(userID, at)
+		if err != nil {
+			return n, err
+		}
+
+		if entry != nil {
+			log.Printf("Expired %v points for user '%v', balance is now %v", -entry.Amount, userID, entry.Balance)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Runs `ExpirePoints` straight away, then every `interval` until the context is cancelled
+func RunExpiryJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_, err := ExpirePoints(time.Now().UTC())
+		if err != nil {
+			log.Printf("Failed to expire points: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,553 @@
+/**
+filestore.go
+
+Durable store that keeps everything in memory, backed by an append-only log plus periodic snapshots on disk
+*/
+
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Names of the files kept in the data directory
+const (
+	snapshotFileName = "snapshot.json"
+	logFileName      = "receipts.log"
+)
+
+// Operations recorded in the log
+const (
+	opSaveReceipt           = "saveReceipt"
+	opIncrementReceiptCount = "incrementReceiptCount"
+	opRedeem                = "redeem"
+	opExpirePoints          = "expirePoints"
+	opVoidReceipt           = "voidReceipt"
+	opRescoreReceipt        = "rescoreReceipt"
+
+	// No longer written, but still replayed from older logs
+	opSetReceiptCount = "setReceiptCount"
+)
+
+// Describes a single line of the log
+type logEntry struct {
+	Seq     uint64                `json:"seq"`
+	Op      string                `json:"op"`
+	Receipt *models.ReceiptRecord `json:"receipt,omitempty"`
+	UserID  string                `json:"userId,omitempty"`
+	Count   int64                 `json:"count,omitempty"`
+	Entry   *models.LedgerEntry   `json:"entry,omitempty"`
+
+	// Set for `voidReceipt` entries, and `At` for `rescoreReceipt` entries too
+	ReceiptID string     `json:"receiptId,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	At        *time.Time `json:"at,omitempty"`
+}
+
+// Describes the contents of the snapshot file
+type fileSnapshot struct {
+	// Sequence number of the last log entry included in the snapshot
+	LastSeq uint64      `json:"lastSeq"`
+	State   memoryState `json:"state"`
+}
+
+// Keeps everything in memory, but records every change in a log before acknowledging it
+// The log is compacted into a snapshot every `snapshotEvery` changes, and replayed on top of the snapshot when opened
+type FileStore struct {
+	mem *MemoryStore
+
+	// Guards everything below, and serializes changes so they're logged in the order they're applied
+	mu            sync.Mutex
+	dir           string
+	log           *os.File
+	seq           uint64
+	snapshotEvery int
+	sinceSnapshot int
+
+	// Set once a change fails to be logged, after which the store refuses further changes
+	// since memory and disk may no longer agree
+	err error
+}
+
+// Opens the store kept in the given directory, creating it if needed
+// Any change that was cut off by a crash is discarded. A snapshot is taken every `snapshotEvery` changes,
+// or never if it's 0
+func OpenFileStore(dir string, snapshotEvery int) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory; %v", err)
+	}
+
+	s := &FileStore{
+		mem:           NewMemoryStore(),
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+	}
+
+	err = s.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Restores the state from the snapshot file, if there is one
+func (s *FileStore) loadSnapshot() error {
+	buf, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot; %v", err)
+	}
+
+	var snapshot fileSnapshot
+	err = json.Unmarshal(buf, &snapshot)
+	if err != nil {
+		return fmt.Errorf("snapshot is corrupt; %v", err)
+	}
+
+	if snapshot.State.Receipts != nil {
+		s.mem.state.Receipts = snapshot.State.Receipts
+	}
+	if snapshot.State.ReceiptCounts != nil {
+		s.mem.state.ReceiptCounts = snapshot.State.ReceiptCounts
+	}
+	if snapshot.State.Ledgers != nil {
+		s.mem.state.Ledgers = snapshot.State.Ledgers
+	}
+	if snapshot.State.IdempotencyKeys != nil {
+		s.mem.state.IdempotencyKeys = snapshot.State.IdempotencyKeys
+	}
+	if snapshot.State.Fingerprints != nil {
+		s.mem.state.Fingerprints = snapshot.State.Fingerprints
+	}
+	s.seq = snapshot.LastSeq
+
+	return nil
+}
+
+// Applies every log entry newer than the snapshot, then opens the log for appending
+// A trailing entry that was only partially written is truncated away
+func (s *FileStore) replayLog() error {
+	path := filepath.Join(s.dir, logFileName)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log; %v", err)
+	}
+
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			f.Close()
+			return fmt.Errorf("failed to read log; %v", err)
+		}
+
+		// A line without a newline, or one that doesn't parse, was cut off mid-write
+		var entry logEntry
+		if err == io.EOF || json.Unmarshal(bytes.TrimSpace(line), &entry) != nil {
+			log.Printf("Discarding incomplete log entry at offset %v", offset)
+			break
+		}
+
+		offset += int64(len(line))
+		if entry.Seq <= s.seq {
+			continue
+		}
+
+		if entry.Seq != s.seq+1 {
+			f.Close()
+			return fmt.Errorf("log is missing entries between %v and %v", s.seq, entry.Seq)
+		}
+
+		err = s.apply(&entry)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to replay log entry %v; %v", entry.Seq, err)
+		}
+		s.seq = entry.Seq
+		s.sinceSnapshot++
+	}
+
+	err = f.Truncate(offset)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate log; %v", err)
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to seek log; %v", err)
+	}
+
+	s.log = f
+	return nil
+}
+
+// Applies a log entry to the in-memory state
+// Used both for new changes and when replaying the log, so the two can't diverge
+func (s *FileStore) apply(entry *logEntry) error {
+	switch entry.Op {
+	case opSaveReceipt:
+		if entry.Receipt == nil {
+			return fmt.Errorf("%v entry has no receipt", entry.Op)
+		}
+		return s.mem.SaveReceipt(entry.Receipt)
+	case opIncrementReceiptCount:
+		_, err := s.mem.IncrementReceiptCount(entry.UserID)
+		return err
+	case opRedeem:
+		if entry.Entry == nil {
+			return fmt.Errorf("%v entry has no ledger entry", entry.Op)
+		}
+		_, _, err := s.mem.Redeem(*entry.Entry)
+		return err
+	case opExpirePoints:
+		if entry.Entry == nil {
+			return fmt.Errorf("%v entry has no ledger entry", entry.Op)
+		}
+		s.mem.appendEntry(*entry.Entry)
+		return nil
+	case opVoidReceipt:
+		if entry.At == nil {
+			return fmt.Errorf("%v entry has no time", entry.Op)
+		}
+		_, _, err := s.mem.VoidReceipt(entry.ReceiptID, entry.Reason, *entry.At)
+		return err
+	case opRescoreReceipt:
+		if entry.Receipt == nil || entry.At == nil {
+			return fmt.Errorf("%v entry has no receipt or time", entry.Op)
+		}
+		_, err := s.mem.RescoreReceipt(entry.Receipt, *entry.At)
+		return err
+	case opSetReceiptCount:
+		s.mem.setReceiptCount(entry.UserID, entry.Count)
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", entry.Op)
+	}
+}
+
+// Durably logs a change, then applies it
+// Must be called with `mu` held
+func (s *FileStore) commit(entry *logEntry) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	entry.Seq = s.seq + 1
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log entry; %v", err)
+	}
+
+	// The entry is written with a single call so a crash can only ever cut off the last line
+	_, err = s.log.Write(append(buf, '\n'))
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		s.err = fmt.Errorf("store is read-only after failing to write the log; %v", err)
+		return s.err
+	}
+
+	s.seq = entry.Seq
+	err = s.apply(entry)
+	if err != nil {
+		return err
+	}
+
+	s.sinceSnapshot++
+	if s.snapshotEvery > 0 && s.sinceSnapshot >= s.snapshotEvery {
+		err = s.snapshot()
+		if err != nil {
+			// The log still has everything, so this isn't fatal
+			log.Printf("Failed to snapshot store: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Writes the current state to the snapshot file and empties the log
+func (s *FileStore) Snapshot() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.snapshot()
+}
+
+// Must be called with `mu` held
+func (s *FileStore) snapshot() error {
+	s.mem.mu.RLock()
+	buf, err := json.Marshal(&fileSnapshot{
+		LastSeq: s.seq,
+		State:   s.mem.state,
+	})
+	s.mem.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot; %v", err)
+	}
+
+	// Write to a temporary file and rename it, so there's always a complete snapshot on disk
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot; %v", err)
+	}
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot; %v", err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("failed to replace snapshot; %v", err)
+	}
+
+	err = syncDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	// Entries up to `LastSeq` are skipped on replay, so crashing before this point is harmless
+	err = s.log.Truncate(0)
+	if err == nil {
+		_, err = s.log.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.err = fmt.Errorf("store is read-only after failing to truncate the log; %v", err)
+		return s.err
+	}
+
+	s.sinceSnapshot = 0
+	return nil
+}
+
+// Flushes a directory so a rename within it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory; %v", err)
+	}
+	defer d.Close()
+
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync data directory; %v", err)
+	}
+
+	return nil
+}
+
+func (s *FileStore) SaveReceipt(record *models.ReceiptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check before logging, so a rejected change never makes it into the log
+	_, err := s.mem.GetReceipt(record.ID)
+	if err == nil {
+		return ErrReceiptExists
+	}
+
+	return s.commit(&logEntry{Op: opSaveReceipt, Receipt: record})
+}
+
+func (s *FileStore) GetReceipt(id string) (*models.ReceiptRecord, error) {
+	return s.mem.GetReceipt(id)
+}
+
+func (s *FileStore) VoidReceipt(id string, reason string, at time.Time) (*models.ReceiptRecord, models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Changes are serialized by `mu`, so the receipt can't be voided between checking and committing
+	record, err := s.mem.GetReceipt(id)
+	if err != nil {
+		return nil, models.LedgerEntry{}, err
+	}
+	if record.VoidedAt != nil {
+		return nil, models.LedgerEntry{}, ErrReceiptVoided
+	}
+
+	err = s.commit(&logEntry{Op: opVoidReceipt, ReceiptID: id, Reason: reason, At: &at})
+	if err != nil {
+		return nil, models.LedgerEntry{}, err
+	}
+
+	record, err = s.mem.GetReceipt(id)
+	if err != nil {
+		return nil, models.LedgerEntry{}, err
+	}
+
+	return record, s.mem.lastLedgerEntry(record.Receipt.UserID), nil
+}
+
+func (s *FileStore) RescoreReceipt(rescored *models.ReceiptRecord, at time.Time) (*models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, err := s.mem.GetReceipt(rescored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if record.VoidedAt != nil {
+		return nil, ErrReceiptVoided
+	}
+
+	// The receipt's credits are in the ledger, so it has a last entry to tell whether an adjustment was added after it
+	last := s.mem.lastLedgerEntry(record.Receipt.UserID)
+	err = s.commit(&logEntry{Op: opRescoreReceipt, Receipt: rescored, At: &at})
+	if err != nil {
+		return nil, err
+	}
+
+	entry := s.mem.lastLedgerEntry(record.Receipt.UserID)
+	if entry.Seq == last.Seq {
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+func (s *FileStore) ListReceipts(filter models.ReceiptFilter, after models.ReceiptPosition, limit int) ([]*models.ReceiptRecord, error) {
+	return s.mem.ListReceipts(filter, after, limit)
+}
+
+func (s *FileStore) FindReceiptByFingerprint(fingerprint string) (string, error) {
+	return s.mem.FindReceiptByFingerprint(fingerprint)
+}
+
+func (s *FileStore) ReceiptCount(userID string) (int64, error) {
+	return s.mem.ReceiptCount(userID)
+}
+
+func (s *FileStore) IncrementReceiptCount(userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Changes are serialized by `mu`, so the count can't change between reading and committing
+	n, err := s.mem.ReceiptCount(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.commit(&logEntry{Op: opIncrementReceiptCount, UserID: userID})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (s *FileStore) Balance(userID string) (int64, error) {
+	return s.mem.Balance(userID)
+}
+
+func (s *FileStore) ListLedger(userID string, afterSeq int64, limit int) ([]models.LedgerEntry, error) {
+	return s.mem.ListLedger(userID, afterSeq, limit)
+}
+
+func (s *FileStore) Redeem(entry models.LedgerEntry) (models.LedgerEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Changes are serialized by `mu`, so the outcome can't change between checking and committing
+	s.mem.mu.RLock()
+	existing, err := s.mem.findRedemption(entry)
+	s.mem.mu.RUnlock()
+	if err != nil {
+		return models.LedgerEntry{}, false, err
+	}
+	if existing != nil {
+		return *existing, true, nil
+	}
+
+	err = s.commit(&logEntry{Op: opRedeem, Entry: &entry})
+	if err != nil {
+		return models.LedgerEntry{}, false, err
+	}
+
+	return s.mem.lastLedgerEntry(entry.UserID), false, nil
+}
+
+func (s *FileStore) ExpiringUsers(at time.Time) ([]string, error) {
+	return s.mem.ExpiringUsers(at)
+}
+
+func (s *FileStore) ExpirePoints(userID string, at time.Time) (*models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The debit is logged as computed, so replaying it doesn't depend on when the log is replayed
+	s.mem.mu.RLock()
+	n := models.PointsToExpire(s.mem.state.Ledgers[userID], at)
+	s.mem.mu.RUnlock()
+	if n == 0 {
+		return nil, nil
+	}
+
+	debit := models.NewExpiryDebit(userID, n, at)
+	err := s.commit(&logEntry{Op: opExpirePoints, Entry: &debit})
+	if err != nil {
+		return nil, err
+	}
+
+	entry := s.mem.lastLedgerEntry(userID)
+	return &entry, nil
+}
+
+// Takes a final snapshot and closes the log
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	var err error
+	if s.err == nil && s.sinceSnapshot > 0 {
+		err = s.snapshot()
+	}
+
+	closeErr := s.log.Close()
+	s.log = nil
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,210 @@
+/**
+idempotency.go
+
+Replays the original response to requests that are retried with the same `Idempotency-Key` header
+*/
+
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// How long responses are kept for replay by default
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// Describes the response to the first request made with an idempotency key
+type idempotentResponse struct {
+	// Hash of the request body, so a retry can be told apart from a different request reusing the key
+	bodyHash [sha256.Size]byte
+
+	// Closed once the first request has finished
+	done chan struct{}
+
+	// Set once `done` is closed
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// Keeps the responses to requests made with an idempotency key, in memory, for a window of time
+type idempotencyCache struct {
+	mu        sync.Mutex
+	window    time.Duration
+	responses map[string]*idempotentResponse
+	lastPrune time.Time
+}
+
+// Responses to `ProcessReceipt`
+var processIdempotency = &idempotencyCache{
+	window:    defaultIdempotencyWindow,
+	responses: map[string]*idempotentResponse{},
+}
+
+// Responses to `ProcessReceiptBatch`, kept apart so a key used for one receipt can't replay a batch
+var batchIdempotency = &idempotencyCache{
+	window:    defaultIdempotencyWindow,
+	responses: map[string]*idempotentResponse{},
+}
+
+// Replaces how long responses to `ProcessReceipt` and `ProcessReceiptBatch` are kept for replay
+// Should be called before the server starts handling requests
+func SetIdempotencyWindow(window time.Duration) {
+	for _, c := range []*idempotencyCache{processIdempotency, batchIdempotency} {
+		c.mu.Lock()
+		c.window = window
+		c.mu.Unlock()
+	}
+}
+
+// Handles the first request made with the key, recording its response, and replays that response to any retries
+// Retries that arrive while the first request is still being handled wait for it to finish
+// Responses with a 5xx status aren't kept, so a retry gets handled again
+// `bodyHash` is the SHA-256 hash of the request body
+func (c *idempotencyCache) serve(w http.ResponseWriter, r *http.Request, key string, bodyHash [sha256.Size]byte, handle func(w http.ResponseWriter)) {
+	if len(key) > maxIdempotencyKeyLength {
+		log.Printf("Idempotency key was too long")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The idempotency key is too long.",
+		})
+		return
+	}
+
+	for {
+		resp, claimed := c.claim(key, bodyHash)
+		if claimed {
+			c.record(key, resp, handle)
+			replay(w, resp, false)
+			return
+		}
+
+		if resp.bodyHash != bodyHash {
+			log.Printf("Idempotency key was reused for a different request")
+			writeProblem(w, http.StatusUnprocessableEntity, &models.ErrorResponse{
+				Type:   ErrorTypeIdempotencyKeyReused,
+				Detail: "The idempotency key was already used for a different request.",
+			})
+			return
+		}
+
+		select {
+		case <-resp.done:
+		case <-r.Context().Done():
+			return
+		}
+
+		// The first request failed and was forgotten, so try handling this one instead
+		if resp.status >= http.StatusInternalServerError {
+			continue
+		}
+
+		log.Printf("Replaying response for idempotency key")
+		replay(w, resp, true)
+		return
+	}
+}
+
+// Returns the response recorded for the key, or claims the key and returns an empty response along with true
+func (c *idempotencyCache) claim(key string, hash [sha256.Size]byte) (*idempotentResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+
+	resp, ok := c.responses[key]
+	if ok && (resp.expiresAt.IsZero() || now.Before(resp.expiresAt)) {
+		return resp, false
+	}
+
+	resp = &idempotentResponse{bodyHash: hash, done: make(chan struct{})}
+	c.responses[key] = resp
+	return resp, true
+}
+
+// Handles a request whose key was claimed, recording the response
+func (c *idempotencyCache) record(key string, resp *idempotentResponse, handle func(w http.ResponseWriter)) {
+	recorder := &responseRecorder{header: http.Header{}}
+	handle(recorder)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resp.status = recorder.statusCode()
+	resp.header = recorder.header
+	resp.body = recorder.body.Bytes()
+	resp.expiresAt = time.Now().Add(c.window)
+	if resp.status >= http.StatusInternalServerError {
+		delete(c.responses, key)
+	}
+	close(resp.done)
+}
+
+// Forgets expired responses, at most once a minute since it looks at every response
+// Must be called with `mu` held
+func (c *idempotencyCache) prune(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+
+	for key, resp := range c.responses {
+		if !resp.expiresAt.IsZero() && !now.Before(resp.expiresAt) {
+			delete(c.responses, key)
+		}
+	}
+}
+
+// Writes a recorded response
+func replay(w http.ResponseWriter, resp *idempotentResponse, replayed bool) {
+	for name, values := range resp.header {
+		w.Header()[name] = values
+	}
+	if replayed {
+		w.Header().Set(idempotentReplayedHeader, "true")
+	}
+
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// Captures a response in memory instead of sending it
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(buf)
+}
+
+// Returns the status that was written, which defaults to 200 like a real response
+func (r *responseRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
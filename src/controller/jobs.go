@@ -0,0 +1,269 @@
+/**
+jobs.go
+
+Processes receipts in the background on a bounded queue, and reports the status of each job
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Define the paths for the HTTP server
+const (
+	GetJobPath = "/jobs/{id}"
+)
+
+// Request header a client sends to ask for a receipt to be processed in the background, see RFC 7240
+const preferHeader = "Prefer"
+
+// Preference asking for a 202 response with a job instead of waiting for the receipt to be processed
+const respondAsyncPreference = "respond-async"
+
+// Limits on the job queue used by default
+const (
+	DefaultJobQueueSize = 100
+	DefaultJobWorkers   = 4
+	DefaultJobRetention = time.Hour
+)
+
+// Seconds a client is told to wait before retrying when the queue is full
+const jobQueueRetryAfter = 5
+
+// Describes a receipt waiting on the queue to be processed
+type queuedJob struct {
+	id      string
+	receipt models.Receipt
+}
+
+var (
+	// Guards everything below
+	jobsMu sync.Mutex
+
+	// Every job, keyed by ID, until it has been completed for longer than `jobRetention`
+	jobs = map[string]*models.Job{}
+
+	// Receipts waiting to be processed, nil unless the workers are running
+	jobQueue chan *queuedJob
+
+	jobRetention = DefaultJobRetention
+	lastJobPrune time.Time
+)
+
+// Tracks the workers taking jobs off the queue
+var jobWorkers sync.WaitGroup
+
+// Starts the workers that process receipts in the background, with room for `queueSize` receipts on the queue
+// Until this is called, requests to process a receipt in the background are processed straight away
+func StartJobWorkers(queueSize int, workers int, retention time.Duration) error {
+	if queueSize <= 0 {
+		return fmt.Errorf("job queue size must be positive")
+	}
+	if workers <= 0 {
+		return fmt.Errorf("job workers must be positive")
+	}
+	if retention <= 0 {
+		return fmt.Errorf("job retention must be positive")
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if jobQueue != nil {
+		return fmt.Errorf("job workers are already running")
+	}
+
+	jobQueue = make(chan *queuedJob, queueSize)
+	jobRetention = retention
+	for range workers {
+		jobWorkers.Add(1)
+		go runJobWorker(jobQueue)
+	}
+
+	return nil
+}
+
+// Stops taking new jobs, then waits for the workers to finish every job already on the queue
+// Returns the context's error if it's done first, leaving the remaining jobs to finish in the background,
+// in which case calling it again waits for them
+func DrainJobs(ctx context.Context) error {
+	jobsMu.Lock()
+	queue := jobQueue
+	jobQueue = nil
+	jobsMu.Unlock()
+
+	if queue != nil {
+		log.Printf("Draining %v queued jobs", len(queue))
+		close(queue)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		jobWorkers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Processes receipts off the queue until it's closed
+func runJobWorker(queue <-chan *queuedJob) {
+	defer jobWorkers.Done()
+
+	for job := range queue {
+		receiptID, problem := scoreReceipt(&job.receipt)
+		completedAt := time.Now().UTC()
+
+		jobsMu.Lock()
+		record := jobs[job.id]
+		record.CompletedAt = &completedAt
+		if problem != nil {
+			record.Status = models.JobStatusFailed
+			record.Error = problem
+		} else {
+			record.Status = models.JobStatusDone
+			record.ReceiptID = receiptID
+		}
+		jobsMu.Unlock()
+
+		log.Printf("Job '%v' is %v", job.id, record.Status)
+	}
+}
+
+// Returns true if the request asks for the receipt to be processed in the background
+func prefersAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values(preferHeader) {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), respondAsyncPreference) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Puts the receipt on the queue, returning the pending job
+// Returns false if the workers aren't running, and nil along with true if the queue is full
+func enqueueReceipt(receiptData *models.Receipt) (*models.Job, bool) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if jobQueue == nil {
+		return nil, false
+	}
+
+	now := time.Now().UTC()
+	pruneJobs(now)
+
+	job := &queuedJob{id: uuid.New().String(), receipt: *receiptData}
+	select {
+	case jobQueue <- job:
+	default:
+		return nil, true
+	}
+
+	record := &models.Job{ID: job.id, Status: models.JobStatusPending, CreatedAt: now}
+	jobs[job.id] = record
+
+	copied := *record
+	return &copied, true
+}
+
+// Forgets jobs completed longer ago than the retention, at most once a minute since it looks at every job
+// Must be called with `jobsMu` held
+func pruneJobs(now time.Time) {
+	if now.Sub(lastJobPrune) < time.Minute {
+		return
+	}
+	lastJobPrune = now
+
+	for id, job := range jobs {
+		if job.CompletedAt != nil && now.Sub(*job.CompletedAt) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
+
+// Responds to a request to process the receipt in the background with the queued job
+// Returns false if the workers aren't running, in which case nothing is written and the receipt should be processed now
+func writeQueuedReceipt(w http.ResponseWriter, receiptData *models.Receipt) bool {
+	job, ok := enqueueReceipt(receiptData)
+	if !ok {
+		return false
+	}
+
+	if job == nil {
+		log.Printf("Job queue is full")
+		w.Header().Set("Retry-After", strconv.Itoa(jobQueueRetryAfter))
+		writeProblem(w, http.StatusServiceUnavailable, &models.ErrorResponse{
+			Type:   ErrorTypeQueueFull,
+			Detail: "Too many receipts are waiting to be processed, try again later.",
+		})
+		return true
+	}
+
+	log.Printf("Queued job '%v'", job.ID)
+
+	buf, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Location", strings.Replace(GetJobPath, "{id}", job.ID, 1))
+	w.Header().Set("Preference-Applied", respondAsyncPreference)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(buf)
+	return true
+}
+
+// Validate a request to query a job by ID, then return its status along with the receipt ID or errors
+func GetJob(w http.ResponseWriter, r *http.Request) {
+
+	jobID := r.PathValue("id")
+
+	jobsMu.Lock()
+	record, ok := jobs[jobID]
+	var job models.Job
+	if ok {
+		job = *record
+	}
+	jobsMu.Unlock()
+
+	if !ok {
+		log.Printf("Job does not exist")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No job found for that ID."))
+		return
+	}
+
+	log.Printf("Retrieved job '%v': %v", job.ID, job.Status)
+
+	buf, err := json.Marshal(&job)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
@@ -0,0 +1,50 @@
+/**
+keylock.go
+
+Describes a set of mutexes keyed by string, so work on one key doesn't block work on others
+*/
+
+package controller
+
+import "sync"
+
+// Holds one mutex per key that is locked, discarding it once nobody holds or waits on it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu sync.Mutex
+
+	// Number of callers holding or waiting on `mu`, guarded by `keyedMutex.mu`
+	refs int
+}
+
+// Locks the given key, returning a function that unlocks it
+func (m *keyedMutex) Lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*keyLock{}
+	}
+	lock, ok := m.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		m.locks[key] = lock
+	}
+	lock.refs++
+	m.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		m.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -7,12 +7,18 @@ Contains 'business' logic for processing/querying receipts
 package controller
 
 import (
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"regexp"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/igor-barinov/fetch-receipt-processor/src/models"
@@ -20,22 +26,61 @@ import (
 
 // Define the paths for the HTTP server
 const (
-	ProcessReceiptPath = "/receipts/process"
-	GetPointsPath      = "/receipts/{id}/points"
+	ListReceiptsPath       = "/receipts"
+	ProcessReceiptPath     = "/receipts/process"
+	GetReceiptPath         = "/receipts/{id}"
+	GetPointsPath          = "/receipts/{id}/points"
+	GetPointsBreakdownPath = "/receipts/{id}/points/breakdown"
+	VoidReceiptPath        = "/receipts/{id}/void"
 )
 
+// Longest reason accepted for voiding a receipt
+const maxVoidReasonLength = 500
+
 var idRgx = regexp.MustCompile(`^\S+$`)
 
-// We use a sync.Map just in case mutliple clients start making requests
-// this could probably be just a map[string]int64
-var pointsStore sync.Map
+// Page sizes for receipt listings
+const (
+	defaultReceiptsLimit = 50
+	maxReceiptsLimit     = 500
+)
+
+// How `ProcessReceipt` handles a receipt with the same fingerprint as one already processed
+const (
+	// Responds with a 409 naming the receipt processed first
+	DuplicatePolicyReject = "reject"
+
+	// Responds as if processing succeeded, but with the ID of the receipt processed first and no new points
+	DuplicatePolicyReturnExisting = "return-existing"
+
+	// Processes the receipt again, awarding points again
+	DuplicatePolicyAllow = "allow"
+)
 
-var bonusMap sync.Map
+// Policy applied to duplicate receipts
+var duplicatePolicy = DuplicatePolicyReject
+
+// Serializes processing of receipts with the same fingerprint, so concurrent duplicates can't both be processed
+var fingerprintLocks keyedMutex
+
+// Replaces the policy applied to duplicate receipts
+// Should be called before the server starts handling requests
+func SetDuplicatePolicy(policy string) error {
+	switch policy {
+	case DuplicatePolicyReject, DuplicatePolicyReturnExisting, DuplicatePolicyAllow:
+		duplicatePolicy = policy
+		return nil
+	default:
+		return fmt.Errorf("unknown duplicate policy %q, expected %v, %v or %v", policy,
+			DuplicatePolicyReject, DuplicatePolicyReturnExisting, DuplicatePolicyAllow)
+	}
+}
 
 // Validate a request to process a receipt, then calculate and store the points for the given receipt
+// Requests with a `Prefer: respond-async` header are answered with a 202 and a job to poll instead
+// Retries carrying the same `Idempotency-Key` header are answered with the original response
 func ProcessReceipt(w http.ResponseWriter, r *http.Request) {
 
-	// Unmarshal the request bytes
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Failed to read HTTP request body: %v", err)
@@ -43,54 +88,245 @@ func ProcessReceipt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	async := prefersAsync(r)
+	key := r.Header.Get(idempotencyKeyHeader)
+	if key == "" {
+		processReceipt(w, bytes, async)
+		return
+	}
+
+	processIdempotency.serve(w, r, key, sha256.Sum256(bytes), func(w http.ResponseWriter) {
+		processReceipt(w, bytes, async)
+	})
+}
+
+// Processes the receipt in the request body, or queues it to be processed in the background if `async` is set
+func processReceipt(w http.ResponseWriter, bytes []byte, async bool) {
+
+	// Unmarshal the request bytes
 	var receiptData models.Receipt
-	err = json.Unmarshal(bytes, &receiptData)
+	err := json.Unmarshal(bytes, &receiptData)
 	if err != nil {
 		log.Printf("Failed to unmarshal HTTP request body: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("The receipt is invalid."))
+		writeInvalidReceipt(w, decodeErrors(err))
+		return
+	}
+
+	if async && writeQueuedReceipt(w, &receiptData) {
 		return
 	}
 
+	id, problem := scoreReceipt(&receiptData)
+	if problem != nil {
+		switch problem.Type {
+		case ErrorTypeInternal:
+			w.WriteHeader(http.StatusInternalServerError)
+		case ErrorTypeInvalidReceipt:
+			writeInvalidReceipt(w, problem.Errors)
+		default:
+			writeProblem(w, problem.Status, problem)
+		}
+		return
+	}
+
+	// Provide the ID as a response
+	buf, err := json.Marshal(&models.ProcessReceiptResponse{Id: id})
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validates the receipt, then calculates and stores its points
+// Returns the ID the receipt is stored under, or a structured error describing why it wasn't processed
+func scoreReceipt(receiptData *models.Receipt) (string, *models.ErrorResponse) {
+
 	// Validate the request
-	err = receiptData.ValidateProperties()
+	err := receiptData.ValidateProperties()
 	if err != nil {
 		log.Printf("Reciept data was invalid: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("The receipt is invalid."))
-		return
+		return "", invalidReceiptProblem(err)
+	}
+
+	// Run the semantic checks of the rules the receipt will be scored with
+	rules := ActiveRuleSet()
+	err = rules.CheckReceipt(receiptData, time.Now().UTC())
+	if err != nil {
+		log.Printf("Reciept data was inconsistent: %v", err)
+		return "", invalidReceiptProblem(err)
+	}
+
+	// Look for an earlier copy of the receipt, holding the lock until this one is saved
+	fingerprint := receiptData.Fingerprint()
+	if duplicatePolicy != DuplicatePolicyAllow {
+		unlock := fingerprintLocks.Lock(fingerprint)
+		defer unlock()
+
+		existingID, err := receiptStore.FindReceiptByFingerprint(fingerprint)
+		if err == nil {
+			return duplicateReceipt(existingID)
+		}
+		if !errors.Is(err, ErrReceiptNotFound) {
+			log.Printf("Failed to look up receipt fingerprint: %v", err)
+			return "", internalProblem()
+		}
 	}
 
 	// Calculate and store the points
 	id := uuid.New().String()
 
-	bonusPoints := int64(0)
-	n := int64(0)
-	timesProcessed, ok := bonusMap.Load(receiptData.UserID)
-	if ok {
-		n = timesProcessed.(int64)
+	// The count is claimed atomically so concurrent receipts from one user can't earn the same bonus tier
+	// If saving the receipt fails below the tier stays claimed, which errs on the side of not paying a bonus twice
+	n, err := receiptStore.IncrementReceiptCount(receiptData.UserID)
+	if err != nil {
+		log.Printf("Failed to increment receipt count: %v", err)
+		return "", internalProblem()
 	}
 
-	if n < 3 {
-		bonusPoints = 250
+	bonusPoints := rules.Bonus(n)
+	breakdown := rules.Evaluate(receiptData)
+	if bonusPoints > 0 {
+		breakdown = append(breakdown, models.RuleResult{
+			Rule:   models.ReceiptBonusName,
+			Points: bonusPoints,
+			Reason: fmt.Sprintf("Receipt #%v for the user earns a bonus", n+1),
+		})
 	}
-	if n < 2 {
-		bonusPoints = 500
+
+	nPoints := int64(0)
+	for _, result := range breakdown {
+		nPoints += result.Points
 	}
-	if n < 1 {
-		bonusPoints = 1000
+
+	record := &models.ReceiptRecord{
+		ID:             id,
+		Receipt:        *receiptData,
+		Points:         nPoints,
+		Breakdown:      breakdown,
+		RuleSetVersion: rules.Version,
+		ProcessedAt:    time.Now().UTC(),
+		Fingerprint:    fingerprint,
+		PurchasedAt:    receiptData.PurchasedAt(),
 	}
+	record.PointsExpireAt = ExpiryPolicy().ExpiresAt(record)
 
-	nPoints := receiptData.CalculatePoints(bonusPoints)
-	pointsStore.Store(id, nPoints)
-	bonusMap.Store(receiptData.UserID, n+1)
-	resp := &models.ProcessReceiptResponse{
-		Id: id,
+	err = receiptStore.SaveReceipt(record)
+	if err != nil {
+		log.Printf("Failed to save receipt: %v", err)
+		return "", internalProblem()
 	}
 
-	log.Printf("Created entry for receipt: (%v, %v)", id, nPoints)
+	log.Printf("Created entry for receipt: (%v, %v) with rules %v", id, nPoints, rules.Version)
+
+	return id, nil
+}
+
+// Handles a receipt that was already processed, according to the duplicate policy
+// Returns the ID of the receipt processed first, or a `duplicate-receipt` error naming it
+func duplicateReceipt(existingID string) (string, *models.ErrorResponse) {
+	log.Printf("Receipt is a duplicate of '%v'", existingID)
+
+	if duplicatePolicy == DuplicatePolicyReject {
+		return "", &models.ErrorResponse{
+			Type:      ErrorTypeDuplicateReceipt,
+			Title:     http.StatusText(http.StatusConflict),
+			Status:    http.StatusConflict,
+			Detail:    "This receipt was already processed.",
+			ReceiptID: existingID,
+		}
+	}
+
+	return existingID, nil
+}
+
+// Validate a request to query a receipt by ID, then return the receipt as it was submitted along with its points
+func GetReceipt(w http.ResponseWriter, r *http.Request) {
+
+	record, ok := loadReceiptRecord(w, r)
+	if !ok {
+		return
+	}
+
+	resp := receiptResponse(record)
+
+	log.Printf("Retrieved receipt '%v'", record.ID)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Returns the receipt as it was submitted along with its points
+func receiptResponse(record *models.ReceiptRecord) *models.GetReceiptResponse {
+	return &models.GetReceiptResponse{
+		ID:             record.ID,
+		Receipt:        record.Receipt,
+		Points:         record.Points,
+		RuleSetVersion: record.RuleSetVersion,
+		ProcessedAt:    record.ProcessedAt,
+		PurchasedAt:    record.PurchasedAt,
+		VoidedAt:       record.VoidedAt,
+		VoidReason:     record.VoidReason,
+	}
+}
+
+// Validate a request to list receipts, then return a page of the matching receipts, oldest processed first
+// Supports the `userId`, `retailer`, `purchaseDateFrom`, `purchaseDateTo`, `minPoints`, `maxPoints`, `processedFrom`,
+// `processedTo`, `limit` and `cursor` query parameters
+func ListReceipts(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	filter, limit, err := parseReceiptsQuery(query)
+	if err != nil {
+		log.Printf("Receipts query was invalid: %v", err)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	after, ok := decodeReceiptsCursor(query.Get("cursor"))
+	if !ok {
+		log.Printf("Cursor was invalid")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The cursor is invalid.",
+		})
+		return
+	}
+
+	// Ask for one extra receipt to tell whether there's another page
+	records, err := receiptStore.ListReceipts(filter, after, limit+1)
+	if err != nil {
+		log.Printf("Failed to list receipts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &models.ListReceiptsResponse{
+		Receipts: []models.GetReceiptResponse{},
+	}
+
+	if len(records) > limit {
+		records = records[:limit]
+		resp.NextCursor = encodeReceiptsCursor(records[limit-1].Position())
+	}
+
+	for _, record := range records {
+		resp.Receipts = append(resp.Receipts, *receiptResponse(record))
+	}
+
+	log.Printf("Listed %v receipts", len(resp.Receipts))
 
-	// Provide the ID as a response
 	buf, err := json.Marshal(resp)
 	if err != nil {
 		log.Printf("Failed to marshal HTTP response body")
@@ -101,50 +337,233 @@ func ProcessReceipt(w http.ResponseWriter, r *http.Request) {
 	w.Write(buf)
 }
 
+// Returns the filter and page size described by the query parameters of a request to list receipts
+func parseReceiptsQuery(query url.Values) (models.ReceiptFilter, int, error) {
+	filter := models.ReceiptFilter{
+		UserID:   query.Get("userId"),
+		Retailer: query.Get("retailer"),
+	}
+
+	var err error
+	if filter.PurchaseDateFrom, err = queryDate(query, "purchaseDateFrom"); err != nil {
+		return filter, 0, err
+	}
+	if filter.PurchaseDateTo, err = queryDate(query, "purchaseDateTo"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MinPoints, err = queryInt64(query, "minPoints"); err != nil {
+		return filter, 0, err
+	}
+	if filter.MaxPoints, err = queryInt64(query, "maxPoints"); err != nil {
+		return filter, 0, err
+	}
+	if filter.ProcessedFrom, err = queryTime(query, "processedFrom"); err != nil {
+		return filter, 0, err
+	}
+	if filter.ProcessedTo, err = queryTime(query, "processedTo"); err != nil {
+		return filter, 0, err
+	}
+
+	limit := defaultReceiptsLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxReceiptsLimit {
+			return filter, 0, fmt.Errorf("limit must be an integer from 1 to %v", maxReceiptsLimit)
+		}
+		limit = n
+	}
+
+	return filter, limit, nil
+}
+
+// Returns the date in the query parameter, or "" if it's missing
+func queryDate(query url.Values, name string) (string, error) {
+	s := query.Get(name)
+	if s == "" {
+		return "", nil
+	}
+
+	_, err := time.Parse(models.DateFormat, s)
+	if err != nil {
+		return "", fmt.Errorf("%v must be a date formatted as YYYY-MM-DD", name)
+	}
+
+	return s, nil
+}
+
+// Returns the integer in the query parameter, or nil if it's missing
+func queryInt64(query url.Values, name string) (*int64, error) {
+	s := query.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%v must be an integer", name)
+	}
+
+	return &n, nil
+}
+
+// Returns the time in the query parameter, or nil if it's missing
+func queryTime(query url.Values, name string) (*time.Time, error) {
+	s := query.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, fmt.Errorf("%v must be a time formatted as RFC 3339, e.g. 2024-12-01T15:04:05Z", name)
+	}
+
+	return &t, nil
+}
+
+// Returns the cursor for the page of receipts after the given position
+func encodeReceiptsCursor(position models.ReceiptPosition) string {
+	return encodeCursor(position.ProcessedAt.UTC().Format(time.RFC3339Nano) + " " + position.ID)
+}
+
+// Returns the position encoded in the cursor, or the zero position for an empty cursor
+func decodeReceiptsCursor(cursor string) (models.ReceiptPosition, bool) {
+	if cursor == "" {
+		return models.ReceiptPosition{}, true
+	}
+
+	position, ok := decodeCursor(cursor)
+	if !ok {
+		return models.ReceiptPosition{}, false
+	}
+
+	processedAt, id, ok := strings.Cut(position, " ")
+	if !ok || id == "" {
+		return models.ReceiptPosition{}, false
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, processedAt)
+	if err != nil {
+		return models.ReceiptPosition{}, false
+	}
+
+	return models.ReceiptPosition{ProcessedAt: t, ID: id}, true
+}
+
 // Validate a request to query the points for a given receipt ID, then return the result of the query
 func GetPoints(w http.ResponseWriter, r *http.Request) {
 
-	// Retrieve the 'id' path parameter
-	receiptID := r.PathValue("id")
-	if receiptID == "" {
-		log.Printf("No ID was supplied")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No receipt found for that ID."))
+	record, ok := loadReceiptRecord(w, r)
+	if !ok {
 		return
 	}
 
-	// Validate the ID parameter
-	ok := idRgx.MatchString(receiptID)
+	// Return the points as the response
+	resp := &models.GetPointsResponse{
+		Points:         record.Points,
+		RuleSetVersion: record.RuleSetVersion,
+		Voided:         record.VoidedAt != nil,
+		VoidedAt:       record.VoidedAt,
+		VoidReason:     record.VoidReason,
+	}
+
+	log.Printf("Retrieved ID '%v': %v points", record.ID, record.Points)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validate a request to query the points for a given receipt ID, then return every rule that awarded points
+func GetPointsBreakdown(w http.ResponseWriter, r *http.Request) {
+
+	record, ok := loadReceiptRecord(w, r)
 	if !ok {
-		log.Printf("ID didn't match pattern: %v", idRgx.String())
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No receipt found for that ID."))
 		return
 	}
 
-	// Attempt to retrieve the points for the given ID
-	receiptPoints, ok := pointsStore.Load(receiptID)
+	resp := &models.GetPointsBreakdownResponse{
+		Points:         record.Points,
+		Breakdown:      record.Breakdown,
+		RuleSetVersion: record.RuleSetVersion,
+	}
+
+	log.Printf("Retrieved breakdown for ID '%v': %v rules", record.ID, len(record.Breakdown))
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validate a request to void a receipt, then mark it voided and debit its points from the user's ledger
+// The receipt itself is kept as it was processed, so it can still be queried
+func VoidReceipt(w http.ResponseWriter, r *http.Request) {
+
+	record, ok := loadReceiptRecord(w, r)
 	if !ok {
+		return
+	}
+
+	var req models.VoidReceiptRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Printf("Failed to unmarshal HTTP request body: %v", err)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The void request is invalid.",
+		})
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > maxVoidReasonLength {
+		log.Printf("Void reason was empty or too long")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: fmt.Sprintf("A reason of at most %v characters is required.", maxVoidReasonLength),
+		})
+		return
+	}
+
+	record, debit, err := receiptStore.VoidReceipt(record.ID, req.Reason, time.Now().UTC())
+	if errors.Is(err, ErrReceiptNotFound) {
 		log.Printf("ID does not exist")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("No receipt found for that ID."))
 		return
 	}
-
-	// Convert to int64
-	n, ok := receiptPoints.(int64)
-	if !ok {
-		log.Printf("Points could not be converted to int64")
+	if errors.Is(err, ErrReceiptVoided) {
+		log.Printf("Receipt was already voided")
+		writeProblem(w, http.StatusConflict, &models.ErrorResponse{
+			Type:   ErrorTypeReceiptVoided,
+			Detail: "The receipt was already voided.",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to void receipt: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Return the points as the response
-	resp := &models.GetPointsResponse{
-		Points: n,
-	}
+	log.Printf("Voided receipt '%v', debiting %v points from user '%v'", record.ID, -debit.Amount, debit.UserID)
 
-	log.Printf("Retrieved ID '%v': %v points", receiptID, n)
+	resp := &models.VoidReceiptResponse{
+		ID:         record.ID,
+		VoidedAt:   *record.VoidedAt,
+		VoidReason: record.VoidReason,
+		Debit:      debit,
+	}
 
 	buf, err := json.Marshal(resp)
 	if err != nil {
@@ -155,3 +574,42 @@ func GetPoints(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(buf)
 }
+
+// Validate the 'id' path parameter and retrieve the matching record
+// Writes an error response and returns false if no record could be retrieved
+func loadReceiptRecord(w http.ResponseWriter, r *http.Request) (*models.ReceiptRecord, bool) {
+
+	// Retrieve the 'id' path parameter
+	receiptID := r.PathValue("id")
+	if receiptID == "" {
+		log.Printf("No ID was supplied")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No receipt found for that ID."))
+		return nil, false
+	}
+
+	// Validate the ID parameter
+	ok := idRgx.MatchString(receiptID)
+	if !ok {
+		log.Printf("ID didn't match pattern: %v", idRgx.String())
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No receipt found for that ID."))
+		return nil, false
+	}
+
+	// Attempt to retrieve the record for the given ID
+	record, err := receiptStore.GetReceipt(receiptID)
+	if errors.Is(err, ErrReceiptNotFound) {
+		log.Printf("ID does not exist")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No receipt found for that ID."))
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Failed to load receipt: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return record, true
+}
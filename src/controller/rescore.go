@@ -0,0 +1,184 @@
+/**
+rescore.go
+
+Rescores stored receipts with a different rule set, reporting how their points change and optionally applying it
+*/
+
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Define the paths for the HTTP server
+const (
+	RescoreReceiptsPath = "/admin/receipts/rescore"
+)
+
+// Number of receipts loaded from the store at a time while rescoring
+const rescorePageSize = 500
+
+// When set, rescore requests may apply the new scores, otherwise they can only report them
+var rescoreApplyAllowed bool
+
+// Lets rescore requests apply the new scores, which rewrites users' ledgers. The rescore command can always apply them
+// Should be called before the server starts handling requests
+func SetRescoreApplyAllowed(allowed bool) {
+	rescoreApplyAllowed = allowed
+}
+
+// Rescores every receipt matching the filter with the given rules, oldest processed first
+// When `apply` is true each changed receipt is saved with its new score and the difference is credited or debited
+// to the user's ledger, otherwise nothing is changed. Voided receipts, and receipts the rules can't convert to their
+// base currency, are skipped
+func RescoreReceipts(rules *models.RuleSet, filter models.ReceiptFilter, apply bool) (*models.RescoreReport, error) {
+	report := &models.RescoreReport{
+		RuleSetVersion: rules.Version,
+		Applied:        apply,
+		Receipts:       []models.ReceiptRescore{},
+		Users:          []models.UserRescore{},
+	}
+
+	users := map[string]*models.UserRescore{}
+	now := time.Now().UTC()
+
+	after := models.ReceiptPosition{}
+	for {
+		records, err := receiptStore.ListReceipts(filter, after, rescorePageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.VoidedAt != nil {
+				report.SkippedVoided++
+				continue
+			}
+			if _, err := rules.ToBase(&record.Receipt); err != nil {
+				report.SkippedUnconvertible++
+				continue
+			}
+
+			rescored := rules.Rescore(record)
+			report.Examined++
+
+			userID := record.Receipt.UserID
+			user, ok := users[userID]
+			if !ok {
+				user = &models.UserRescore{UserID: userID}
+				users[userID] = user
+			}
+			user.Receipts++
+			user.OldPoints += record.Points
+			user.NewPoints += rescored.Points
+
+			if rescored.Points != record.Points {
+				report.Changed++
+				report.Receipts = append(report.Receipts, models.ReceiptRescore{
+					ID:                record.ID,
+					UserID:            userID,
+					OldRuleSetVersion: record.RuleSetVersion,
+					OldPoints:         record.Points,
+					NewPoints:         rescored.Points,
+					Delta:             rescored.Points - record.Points,
+				})
+			}
+
+			// Receipts already scored with these rules are left alone, so applying twice changes nothing
+			if apply && rescored.RuleSetVersion != record.RuleSetVersion {
+				_, err = receiptStore.RescoreReceipt(rescored, now)
+				if errors.Is(err, ErrReceiptVoided) {
+					log.Printf("Receipt '%v' was voided while rescoring", record.ID)
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if len(records) < rescorePageSize {
+			break
+		}
+		after = records[len(records)-1].Position()
+	}
+
+	for _, user := range users {
+		user.Delta = user.NewPoints - user.OldPoints
+		report.Delta += user.Delta
+		if user.Delta != 0 {
+			report.Users = append(report.Users, *user)
+		}
+	}
+
+	sort.Slice(report.Users, func(i, j int) bool {
+		return report.Users[i].UserID < report.Users[j].UserID
+	})
+
+	log.Printf("Rescored %v receipts with rules %v: %v changed by %v points, %v that can't be converted skipped, applied: %v",
+		report.Examined, rules.Version, report.Changed, report.Delta, report.SkippedUnconvertible, apply)
+
+	return report, nil
+}
+
+// Validate a request to rescore receipts with one of the known rule sets, then return how their points change
+// Only reports the changes unless `apply` is set, which is refused unless `SetRescoreApplyAllowed` allowed it
+func RescoreReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var req models.RescoreReceiptsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Printf("Failed to unmarshal HTTP request body: %v", err)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The rescore request is invalid.",
+		})
+		return
+	}
+
+	if req.Apply && !rescoreApplyAllowed {
+		log.Printf("Refused to apply rescore, it isn't allowed over HTTP")
+		writeProblem(w, http.StatusForbidden, &models.ErrorResponse{
+			Type:   ErrorTypeApplyDisabled,
+			Detail: "Applying rescores isn't allowed by this server, start it with -rescore-allow-apply or use the rescore command.",
+		})
+		return
+	}
+
+	rules := ActiveRuleSet()
+	if req.RuleSetVersion != "" {
+		var ok bool
+		rules, ok = LookupRuleSet(req.RuleSetVersion)
+		if !ok {
+			log.Printf("Rule set version %q is not known", req.RuleSetVersion)
+			writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+				Type:   ErrorTypeInvalidRequest,
+				Detail: "No rule set with that version has been loaded.",
+			})
+			return
+		}
+	}
+
+	report, err := RescoreReceipts(rules, models.ReceiptFilter{UserID: req.UserID}, req.Apply)
+	if err != nil {
+		log.Printf("Failed to rescore receipts: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
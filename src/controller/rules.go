@@ -0,0 +1,181 @@
+/**
+rules.go
+
+Manages the active scoring rules, including reloading them from a rules file while the server is running
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Define the paths for the HTTP server
+const (
+	ReloadRulesPath = "/admin/rules/reload"
+)
+
+// Rules used to score newly processed receipts
+// Swapped atomically so in-flight requests keep scoring with the rules they started with
+var activeRules atomic.Pointer[models.RuleSet]
+
+// Every rule set that has been active, keyed by version, so earlier scores stay reproducible
+// Only holds the versions loaded since the process started, rules active before a restart are forgotten
+var knownRules sync.Map
+
+// Path of the rules file, empty when the built-in rules are used
+var rulesPath string
+
+// Serializes reloads so concurrent triggers can't interleave
+var reloadMu sync.Mutex
+
+func init() {
+	SetRuleSet(models.DefaultRuleSet())
+}
+
+// Makes the given rules the ones used to score newly processed receipts
+// Returns an error if a different rule set was already registered under the same version
+func SetRuleSet(rules *models.RuleSet) error {
+	existing, loaded := knownRules.LoadOrStore(rules.Version, rules)
+	if loaded && existing.(*models.RuleSet).Digest != rules.Digest {
+		return fmt.Errorf("rule set version %q is already in use by different rules", rules.Version)
+	}
+
+	activeRules.Store(rules)
+	return nil
+}
+
+// Returns the rules used to score newly processed receipts
+func ActiveRuleSet() *models.RuleSet {
+	return activeRules.Load()
+}
+
+// Returns the rule set registered under the given version, if it has been active since the process started
+func LookupRuleSet(version string) (*models.RuleSet, bool) {
+	rules, ok := knownRules.Load(version)
+	if !ok {
+		return nil, false
+	}
+
+	return rules.(*models.RuleSet), true
+}
+
+// Loads the rules file at the given path and makes it the active rule set
+// The path is remembered so later calls to `ReloadRules` read the same file
+func LoadRulesFile(path string) (*models.RuleSet, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	return loadRulesFile(path)
+}
+
+// Reloads the rules file passed to `LoadRulesFile`
+// The active rules are left untouched if the file is invalid
+func ReloadRules() (*models.RuleSet, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if rulesPath == "" {
+		return nil, fmt.Errorf("no rules file is configured")
+	}
+
+	rules, err := loadRulesFile(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Reloaded rules from %v: version %v", rulesPath, rules.Version)
+	return rules, nil
+}
+
+// Must be called with `reloadMu` held
+func loadRulesFile(path string) (*models.RuleSet, error) {
+	rules, err := models.LoadRuleSet(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SetRuleSet(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	rulesPath = path
+	return rules, nil
+}
+
+// Polls the rules file at the given path and reloads it whenever it changes, until the context is done
+func WatchRulesFile(ctx context.Context, path string, interval time.Duration) {
+	var lastMod time.Time
+	var lastSize int64
+	info, err := os.Stat(path)
+	if err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Failed to stat rules file: %v", err)
+			continue
+		}
+
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+
+		_, err = ReloadRules()
+		if err != nil {
+			log.Printf("Failed to reload rules, keeping version %v: %v", ActiveRuleSet().Version, err)
+		}
+	}
+}
+
+// Reload the rules file and return the version that is now active
+// Why the file couldn't be reloaded is only logged, since it can reveal the file's path
+func ReloadRulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	rules, err := ReloadRules()
+	if err != nil {
+		log.Printf("Failed to reload rules: %v", err)
+		writeProblem(w, http.StatusUnprocessableEntity, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRules,
+			Detail: "The rules could not be reloaded, the current rules are still active.",
+		})
+		return
+	}
+
+	resp := &models.ReloadRulesResponse{
+		Version: rules.Version,
+		Rules:   rules.RuleNames(),
+	}
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
@@ -0,0 +1,951 @@
+/**
+sqlstore.go
+
+Durable store backed by an embedded SQLite database, so processed receipts can be queried relationally
+*/
+
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	_ "modernc.org/sqlite"
+)
+
+// Schema migrations, applied in order. Migration `i` brings the schema to version `i+1`
+// Never edit a migration once it has shipped, append a new one instead
+var sqlMigrations = []string{
+	`
+	CREATE TABLE receipts (
+		id               TEXT PRIMARY KEY,
+		user_id          TEXT NOT NULL,
+		retailer         TEXT NOT NULL,
+		total            TEXT NOT NULL,
+		purchase_date    TEXT NOT NULL,
+		purchase_time    TEXT NOT NULL,
+		points           INTEGER NOT NULL,
+		rule_set_version TEXT NOT NULL,
+		breakdown        TEXT NOT NULL
+	);
+
+	CREATE INDEX receipts_user_id ON receipts (user_id);
+
+	CREATE TABLE items (
+		receipt_id        TEXT NOT NULL REFERENCES receipts (id) ON DELETE CASCADE,
+		position          INTEGER NOT NULL,
+		short_description TEXT NOT NULL,
+		price             TEXT NOT NULL,
+		PRIMARY KEY (receipt_id, position)
+	);
+
+	CREATE TABLE users (
+		user_id       TEXT PRIMARY KEY,
+		receipt_count INTEGER NOT NULL DEFAULT 0
+	);
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN processed_at TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX receipts_processed_at ON receipts (processed_at);
+	`,
+	`
+	CREATE TABLE ledger (
+		user_id    TEXT NOT NULL,
+		seq        INTEGER NOT NULL,
+		kind       TEXT NOT NULL,
+		amount     INTEGER NOT NULL,
+		balance    INTEGER NOT NULL,
+		receipt_id TEXT REFERENCES receipts (id),
+		created_at TEXT NOT NULL,
+		PRIMARY KEY (user_id, seq)
+	);
+
+	ALTER TABLE users ADD COLUMN balance INTEGER NOT NULL DEFAULT 0;
+
+	-- Credit every receipt processed before the ledger existed, splitting out the bonus like LedgerCredits does
+	WITH bonuses AS (
+		SELECT r.id AS receipt_id, SUM(json_extract(b.value, '$.points')) AS amount
+		FROM receipts r, json_each(r.breakdown) b
+		WHERE json_extract(b.value, '$.rule') = 'receiptBonus'
+		GROUP BY r.id
+	), credits AS (
+		SELECT r.user_id, r.id AS receipt_id, r.processed_at, 0 AS ord, 'receipt' AS kind,
+			r.points - COALESCE(bonuses.amount, 0) AS amount
+		FROM receipts r LEFT JOIN bonuses ON bonuses.receipt_id = r.id
+		UNION ALL
+		SELECT r.user_id, r.id, r.processed_at, 1, 'bonus', bonuses.amount
+		FROM receipts r JOIN bonuses ON bonuses.receipt_id = r.id
+		WHERE bonuses.amount != 0
+	)
+	INSERT INTO ledger (user_id, seq, kind, amount, balance, receipt_id, created_at)
+	SELECT user_id, ROW_NUMBER() OVER w, kind, amount, SUM(amount) OVER w, receipt_id, processed_at
+	FROM credits
+	WINDOW w AS (PARTITION BY user_id ORDER BY processed_at, receipt_id, ord);
+
+	INSERT INTO users (user_id) SELECT DISTINCT user_id FROM ledger WHERE true
+	ON CONFLICT (user_id) DO NOTHING;
+
+	UPDATE users SET balance = COALESCE((SELECT SUM(amount) FROM ledger WHERE ledger.user_id = users.user_id), 0);
+	`,
+	`
+	ALTER TABLE ledger ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	ALTER TABLE ledger ADD COLUMN idempotency_key TEXT;
+
+	CREATE UNIQUE INDEX ledger_idempotency_key ON ledger (user_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN points_expire_at TEXT;
+	ALTER TABLE ledger ADD COLUMN expires_at TEXT;
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN fingerprint TEXT;
+
+	CREATE INDEX receipts_fingerprint ON receipts (fingerprint);
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN currency TEXT;
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN time_zone TEXT;
+	ALTER TABLE receipts ADD COLUMN purchased_at TEXT;
+	`,
+	`
+	ALTER TABLE items ADD COLUMN quantity INTEGER;
+	ALTER TABLE items ADD COLUMN unit_price TEXT;
+	ALTER TABLE items ADD COLUMN sku TEXT;
+	ALTER TABLE items ADD COLUMN upc TEXT;
+	ALTER TABLE items ADD COLUMN discount INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN subtotal TEXT;
+	ALTER TABLE receipts ADD COLUMN tax TEXT;
+	ALTER TABLE receipts ADD COLUMN tip TEXT;
+	`,
+	`
+	ALTER TABLE receipts ADD COLUMN voided_at TEXT;
+	ALTER TABLE receipts ADD COLUMN void_reason TEXT;
+	`,
+}
+
+// Keeps everything in a SQLite database file
+type SQLStore struct {
+	db *sql.DB
+}
+
+// Opens the database at the given path, creating it if needed, and migrates it to the latest schema
+func OpenSQLStore(path string) (*SQLStore, error) {
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout(5000)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database; %v", err)
+	}
+
+	s := &SQLStore{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Applies every migration newer than the database's schema version
+func (s *SQLStore) migrate() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations; %v", err)
+	}
+
+	var current int
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version; %v", err)
+	}
+
+	if current > len(sqlMigrations) {
+		return fmt.Errorf("database schema version %v is newer than this server supports (%v)", current, len(sqlMigrations))
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		err = s.inTx(func(tx *sql.Tx) error {
+			_, err := tx.Exec(sqlMigrations[version-1])
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+				version, time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %v; %v", version, err)
+		}
+	}
+
+	return nil
+}
+
+// Runs the function in a transaction, committing if it succeeds and rolling back otherwise
+func (s *SQLStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) SaveReceipt(record *models.ReceiptRecord) error {
+	breakdown, err := json.Marshal(record.Breakdown)
+	if err != nil {
+		return fmt.Errorf("failed to marshal breakdown; %v", err)
+	}
+
+	receipt := &record.Receipt
+	return s.inTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM receipts WHERE id = ?)`, record.ID).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check for receipt; %v", err)
+		}
+		if exists {
+			return ErrReceiptExists
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO receipts (id, user_id, retailer, total, purchase_date, purchase_time, points, rule_set_version, breakdown,
+				processed_at, points_expire_at, fingerprint, currency, time_zone, purchased_at, subtotal, tax, tip)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, record.ID, receipt.UserID, receipt.Retailer, receipt.Total.String(), receipt.PurchaseDate, receipt.PurchaseTime,
+			record.Points, record.RuleSetVersion, string(breakdown), formatSQLTime(record.ProcessedAt),
+			formatNullSQLTime(record.PointsExpireAt), nullIfEmpty(record.Fingerprint), nullIfEmpty(receipt.Currency),
+			nullIfEmpty(receipt.TimeZone), formatNullSQLTime(record.PurchasedAt), formatNullMoney(receipt.Subtotal),
+			formatNullMoney(receipt.Tax), formatNullMoney(receipt.Tip))
+		if err != nil {
+			return fmt.Errorf("failed to save receipt; %v", err)
+		}
+
+		for i, item := range receipt.Items {
+			_, err = tx.Exec(`
+				INSERT INTO items (receipt_id, position, short_description, price, quantity, unit_price, sku, upc, discount)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`, record.ID, i, item.ShortDescription, item.Price.String(), item.Quantity,
+				formatNullMoney(item.UnitPrice),
+				nullIfEmpty(item.SKU), nullIfEmpty(item.UPC), item.Discount)
+			if err != nil {
+				return fmt.Errorf("failed to save item %v; %v", i, err)
+			}
+		}
+
+		for _, entry := range record.LedgerCredits() {
+			_, err = appendSQLLedger(tx, entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Assigns the entry the user's next sequence number and running balance, then appends it to their ledger
+func appendSQLLedger(tx *sql.Tx, entry models.LedgerEntry) (models.LedgerEntry, error) {
+	err := tx.QueryRow(`
+		INSERT INTO users (user_id, balance) VALUES (?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET balance = balance + excluded.balance
+		RETURNING balance
+	`, entry.UserID, entry.Amount).Scan(&entry.Balance)
+	if err != nil {
+		return entry, fmt.Errorf("failed to update balance; %v", err)
+	}
+
+	err = tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) + 1 FROM ledger WHERE user_id = ?`, entry.UserID).Scan(&entry.Seq)
+	if err != nil {
+		return entry, fmt.Errorf("failed to get ledger sequence; %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO ledger (user_id, seq, kind, amount, balance, receipt_id, description, idempotency_key, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.UserID, entry.Seq, entry.Kind, entry.Amount, entry.Balance, nullIfEmpty(entry.ReceiptID), entry.Description,
+		nullIfEmpty(entry.IdempotencyKey), formatSQLTime(entry.CreatedAt), formatNullSQLTime(entry.ExpiresAt))
+	if err != nil {
+		return entry, fmt.Errorf("failed to append ledger entry; %v", err)
+	}
+
+	return entry, nil
+}
+
+func (s *SQLStore) GetReceipt(id string) (*models.ReceiptRecord, error) {
+	record, err := scanReceipt(s.db.QueryRow(`SELECT `+receiptColumns+` FROM receipts WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrReceiptNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load receipt; %v", err)
+	}
+
+	err = loadSQLItems(s.db, []*models.ReceiptRecord{record})
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Columns read by `scanReceipt`
+const receiptColumns = `id, user_id, retailer, total, purchase_date, purchase_time, points, rule_set_version, breakdown,
+	processed_at, COALESCE(points_expire_at, ''), COALESCE(fingerprint, ''), COALESCE(currency, ''),
+	COALESCE(time_zone, ''), COALESCE(purchased_at, ''), COALESCE(subtotal, ''), COALESCE(tax, ''), COALESCE(tip, ''),
+	COALESCE(voided_at, ''), COALESCE(void_reason, '')`
+
+// Reads a receipt selected with `receiptColumns`, leaving its items to `loadSQLItems`
+func scanReceipt(row interface{ Scan(dest ...any) error }) (*models.ReceiptRecord, error) {
+	record := &models.ReceiptRecord{}
+	receipt := &record.Receipt
+
+	var total, breakdown, processedAt, pointsExpireAt, purchasedAt, subtotal, tax, tip, voidedAt string
+	err := row.Scan(&record.ID, &receipt.UserID, &receipt.Retailer, &total, &receipt.PurchaseDate, &receipt.PurchaseTime,
+		&record.Points, &record.RuleSetVersion, &breakdown, &processedAt, &pointsExpireAt, &record.Fingerprint,
+		&receipt.Currency, &receipt.TimeZone, &purchasedAt, &subtotal, &tax, &tip, &voidedAt, &record.VoidReason)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt.Total, err = models.ParseMoney(total)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse total; %v", err)
+	}
+
+	receipt.Subtotal, err = parseNullMoney(subtotal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse subtotal; %v", err)
+	}
+
+	receipt.Tax, err = parseNullMoney(tax)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tax; %v", err)
+	}
+
+	receipt.Tip, err = parseNullMoney(tip)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tip; %v", err)
+	}
+
+	err = json.Unmarshal([]byte(breakdown), &record.Breakdown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal breakdown; %v", err)
+	}
+
+	record.ProcessedAt, err = parseSQLTime(processedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse processed_at; %v", err)
+	}
+
+	record.PointsExpireAt, err = parseNullSQLTime(pointsExpireAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse points_expire_at; %v", err)
+	}
+
+	record.PurchasedAt, err = parseNullSQLTime(purchasedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse purchased_at; %v", err)
+	}
+
+	record.VoidedAt, err = parseNullSQLTime(voidedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse voided_at; %v", err)
+	}
+
+	return record, nil
+}
+
+// Something `loadSQLItems` can query, either the database or a transaction
+type sqlQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// Loads the items of every receipt, in order, with a single query
+func loadSQLItems(q sqlQuerier, records []*models.ReceiptRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	byID := map[string]*models.ReceiptRecord{}
+	args := make([]any, len(records))
+	for i, record := range records {
+		record.Receipt.Items = []models.Item{}
+		byID[record.ID] = record
+		args[i] = record.ID
+	}
+
+	rows, err := q.Query(`
+		SELECT receipt_id, short_description, price, quantity, COALESCE(unit_price, ''), COALESCE(sku, ''),
+			COALESCE(upc, ''), discount
+		FROM items WHERE receipt_id IN (?`+strings.Repeat(", ?", len(records)-1)+`) ORDER BY receipt_id, position
+	`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to load items; %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item models.Item
+		var receiptID, price, unitPrice string
+		err = rows.Scan(&receiptID, &item.ShortDescription, &price, &item.Quantity, &unitPrice, &item.SKU, &item.UPC,
+			&item.Discount)
+		if err != nil {
+			return fmt.Errorf("failed to load item; %v", err)
+		}
+
+		item.Price, err = models.ParseMoney(price)
+		if err != nil {
+			return fmt.Errorf("failed to parse item price; %v", err)
+		}
+
+		item.UnitPrice, err = parseNullMoney(unitPrice)
+		if err != nil {
+			return fmt.Errorf("failed to parse item unit price; %v", err)
+		}
+
+		receipt := &byID[receiptID].Receipt
+		receipt.Items = append(receipt.Items, item)
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLStore) VoidReceipt(id string, reason string, at time.Time) (*models.ReceiptRecord, models.LedgerEntry, error) {
+	var debit models.LedgerEntry
+	err := s.inTx(func(tx *sql.Tx) error {
+		var userID, voidedAt string
+		var points int64
+		err := tx.QueryRow(`
+			SELECT user_id, points, COALESCE(voided_at, '') FROM receipts WHERE id = ?
+		`, id).Scan(&userID, &points, &voidedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrReceiptNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load receipt; %v", err)
+		}
+		if voidedAt != "" {
+			return ErrReceiptVoided
+		}
+
+		_, err = tx.Exec(`
+			UPDATE receipts SET voided_at = ?, void_reason = ? WHERE id = ?
+		`, formatSQLTime(at), reason, id)
+		if err != nil {
+			return fmt.Errorf("failed to void receipt; %v", err)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE users SET receipt_count = MAX(receipt_count - 1, 0) WHERE user_id = ?
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to decrement receipt count; %v", err)
+		}
+
+		ledger, err := loadSQLLedger(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		record := &models.ReceiptRecord{ID: id, Points: points, VoidedAt: &at, VoidReason: reason}
+		record.Receipt.UserID = userID
+		debit, err = appendSQLLedger(tx, record.VoidDebit(ledger))
+		return err
+	})
+	if err != nil {
+		return nil, models.LedgerEntry{}, err
+	}
+
+	record, err := s.GetReceipt(id)
+	if err != nil {
+		return nil, models.LedgerEntry{}, err
+	}
+
+	return record, debit, nil
+}
+
+func (s *SQLStore) RescoreReceipt(rescored *models.ReceiptRecord, at time.Time) (*models.LedgerEntry, error) {
+	breakdown, err := json.Marshal(rescored.Breakdown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal breakdown; %v", err)
+	}
+
+	var adjusted *models.LedgerEntry
+	err = s.inTx(func(tx *sql.Tx) error {
+		var voidedAt, pointsExpireAt string
+		record := &models.ReceiptRecord{ID: rescored.ID}
+		err := tx.QueryRow(`
+			SELECT user_id, points, COALESCE(points_expire_at, ''), COALESCE(voided_at, '') FROM receipts WHERE id = ?
+		`, rescored.ID).Scan(&record.Receipt.UserID, &record.Points, &pointsExpireAt, &voidedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrReceiptNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load receipt; %v", err)
+		}
+		if voidedAt != "" {
+			return ErrReceiptVoided
+		}
+
+		record.PointsExpireAt, err = parseNullSQLTime(pointsExpireAt)
+		if err != nil {
+			return fmt.Errorf("failed to parse points_expire_at; %v", err)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE receipts SET points = ?, breakdown = ?, rule_set_version = ? WHERE id = ?
+		`, rescored.Points, string(breakdown), rescored.RuleSetVersion, rescored.ID)
+		if err != nil {
+			return fmt.Errorf("failed to rescore receipt; %v", err)
+		}
+
+		ledger, err := loadSQLLedger(tx, record.Receipt.UserID)
+		if err != nil {
+			return err
+		}
+
+		adjustment := record.RescoreAdjustment(rescored, at, ledger)
+		if adjustment.Amount == 0 {
+			return nil
+		}
+
+		entry, err := appendSQLLedger(tx, adjustment)
+		if err != nil {
+			return err
+		}
+
+		adjusted = &entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return adjusted, nil
+}
+
+func (s *SQLStore) ListReceipts(filter models.ReceiptFilter, after models.ReceiptPosition, limit int) ([]*models.ReceiptRecord, error) {
+	conditions := []string{"(processed_at > ? OR (processed_at = ? AND id > ?))"}
+	args := []any{formatSQLTime(after.ProcessedAt), formatSQLTime(after.ProcessedAt), after.ID}
+
+	if filter.UserID != "" {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.Retailer != "" {
+		// LIKE ignores ASCII letter case, which is every letter a retailer can have
+		conditions = append(conditions, `retailer LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(filter.Retailer)+"%")
+	}
+	if filter.PurchaseDateFrom != "" {
+		conditions = append(conditions, "purchase_date >= ?")
+		args = append(args, filter.PurchaseDateFrom)
+	}
+	if filter.PurchaseDateTo != "" {
+		conditions = append(conditions, "purchase_date <= ?")
+		args = append(args, filter.PurchaseDateTo)
+	}
+	if filter.MinPoints != nil {
+		conditions = append(conditions, "points >= ?")
+		args = append(args, *filter.MinPoints)
+	}
+	if filter.MaxPoints != nil {
+		conditions = append(conditions, "points <= ?")
+		args = append(args, *filter.MaxPoints)
+	}
+	if filter.ProcessedFrom != nil {
+		conditions = append(conditions, "processed_at >= ?")
+		args = append(args, formatSQLTime(*filter.ProcessedFrom))
+	}
+	if filter.ProcessedTo != nil {
+		conditions = append(conditions, "processed_at < ?")
+		args = append(args, formatSQLTime(*filter.ProcessedTo))
+	}
+
+	// Both queries read from one transaction, so a page can't mix receipts from before and after a change
+	records := []*models.ReceiptRecord{}
+	err := s.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`
+			SELECT `+receiptColumns+` FROM receipts WHERE `+strings.Join(conditions, " AND ")+`
+			ORDER BY processed_at, id LIMIT ?
+		`, append(args, limit)...)
+		if err != nil {
+			return fmt.Errorf("failed to list receipts; %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			record, err := scanReceipt(rows)
+			if err != nil {
+				return fmt.Errorf("failed to list receipts; %v", err)
+			}
+			records = append(records, record)
+		}
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("failed to list receipts; %v", err)
+		}
+		rows.Close()
+
+		return loadSQLItems(tx, records)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Escapes the wildcards of a LIKE pattern, for patterns using `ESCAPE '\'`
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *SQLStore) FindReceiptByFingerprint(fingerprint string) (string, error) {
+	var id string
+	err := s.db.QueryRow(`
+		SELECT id FROM receipts WHERE fingerprint = ? ORDER BY rowid LIMIT 1
+	`, fingerprint).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrReceiptNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find receipt; %v", err)
+	}
+
+	return id, nil
+}
+
+func (s *SQLStore) ReceiptCount(userID string) (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT receipt_count FROM users WHERE user_id = ?`, userID).Scan(&n)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load receipt count; %v", err)
+	}
+
+	return n, nil
+}
+
+func (s *SQLStore) IncrementReceiptCount(userID string) (int64, error) {
+	// A single statement is atomic, so concurrent increments can't observe the same count
+	var n int64
+	err := s.db.QueryRow(`
+		INSERT INTO users (user_id, receipt_count) VALUES (?, 1)
+		ON CONFLICT (user_id) DO UPDATE SET receipt_count = receipt_count + 1
+		RETURNING receipt_count
+	`, userID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment receipt count; %v", err)
+	}
+
+	return n - 1, nil
+}
+
+func (s *SQLStore) Balance(userID string) (int64, error) {
+	var balance int64
+	err := s.db.QueryRow(`
+		SELECT balance FROM users WHERE user_id = ? AND EXISTS (SELECT 1 FROM ledger WHERE user_id = ?)
+	`, userID, userID).Scan(&balance)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load balance; %v", err)
+	}
+
+	return balance, nil
+}
+
+func (s *SQLStore) ListLedger(userID string, afterSeq int64, limit int) ([]models.LedgerEntry, error) {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ledger WHERE user_id = ?)`, userID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for ledger; %v", err)
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+ledgerColumns+`
+		FROM ledger WHERE user_id = ? AND seq > ?
+		ORDER BY seq LIMIT ?
+	`, userID, afterSeq, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ledger; %v", err)
+	}
+	defer rows.Close()
+
+	entries := []models.LedgerEntry{}
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Returns every entry of the user's ledger, oldest first
+func loadSQLLedger(tx *sql.Tx, userID string) ([]models.LedgerEntry, error) {
+	rows, err := tx.Query(`SELECT `+ledgerColumns+` FROM ledger WHERE user_id = ? ORDER BY seq`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ledger; %v", err)
+	}
+	defer rows.Close()
+
+	ledger := []models.LedgerEntry{}
+	for rows.Next() {
+		entry, err := scanLedgerEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		ledger = append(ledger, entry)
+	}
+
+	return ledger, rows.Err()
+}
+
+// Columns read by `scanLedgerEntry`
+const ledgerColumns = `user_id, seq, kind, amount, balance, COALESCE(receipt_id, ''), description, COALESCE(idempotency_key, ''),
+	created_at, COALESCE(expires_at, '')`
+
+// Reads a ledger entry selected with `ledgerColumns`
+func scanLedgerEntry(row interface{ Scan(dest ...any) error }) (models.LedgerEntry, error) {
+	var entry models.LedgerEntry
+	var createdAt, expiresAt string
+	err := row.Scan(&entry.UserID, &entry.Seq, &entry.Kind, &entry.Amount, &entry.Balance, &entry.ReceiptID,
+		&entry.Description, &entry.IdempotencyKey, &createdAt, &expiresAt)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.CreatedAt, err = parseSQLTime(createdAt)
+	if err != nil {
+		return entry, fmt.Errorf("failed to parse created_at; %v", err)
+	}
+
+	entry.ExpiresAt, err = parseNullSQLTime(expiresAt)
+	if err != nil {
+		return entry, fmt.Errorf("failed to parse expires_at; %v", err)
+	}
+
+	return entry, nil
+}
+
+func (s *SQLStore) Redeem(entry models.LedgerEntry) (models.LedgerEntry, bool, error) {
+	var result models.LedgerEntry
+	var replayed bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		if entry.IdempotencyKey != "" {
+			existing, err := scanLedgerEntry(tx.QueryRow(`
+				SELECT `+ledgerColumns+` FROM ledger WHERE user_id = ? AND idempotency_key = ?
+			`, entry.UserID, entry.IdempotencyKey))
+			if err == nil {
+				if existing.Kind != entry.Kind || existing.Amount != entry.Amount || existing.Description != entry.Description {
+					return ErrIdempotencyKeyReused
+				}
+
+				result, replayed = existing, true
+				return nil
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("failed to look up idempotency key; %v", err)
+			}
+		}
+
+		var balance int64
+		err := tx.QueryRow(`SELECT balance FROM users WHERE user_id = ?`, entry.UserID).Scan(&balance)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to load balance; %v", err)
+		}
+
+		if balance+entry.Amount < 0 {
+			return &InsufficientBalanceError{Balance: balance, Requested: -entry.Amount}
+		}
+
+		result, err = appendSQLLedger(tx, entry)
+		return err
+	})
+	if err != nil {
+		return models.LedgerEntry{}, false, err
+	}
+
+	return result, replayed, nil
+}
+
+// Points expired by a given time but not yet debited, as the total of expired credits less the debits spending them
+// Debits spend the soonest expiring credits first, see `models.UnspentExpiringPoints`. A receipt's own debits only
+// cancel its credits, so they count once those have expired, and never for a receipt whose points don't expire
+const sqlPointsToExpire = `MAX(0, SUM(CASE
+	WHEN amount > 0 THEN CASE WHEN expires_at <= :at THEN amount ELSE 0 END
+	WHEN receipt_id IS NULL THEN amount
+	WHEN EXISTS (
+		SELECT 1 FROM ledger AS credits
+		WHERE credits.user_id = ledger.user_id AND credits.receipt_id = ledger.receipt_id AND credits.amount > 0
+			AND credits.expires_at <= :at
+	) THEN amount
+	ELSE 0
+END))`
+
+func (s *SQLStore) ExpiringUsers(at time.Time) ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id FROM ledger GROUP BY user_id HAVING `+sqlPointsToExpire+` > 0
+	`, sql.Named("at", formatSQLTime(at)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expiring users; %v", err)
+	}
+	defer rows.Close()
+
+	userIDs := []string{}
+	for rows.Next() {
+		var userID string
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load user; %v", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	return userIDs, rows.Err()
+}
+
+func (s *SQLStore) ExpirePoints(userID string, at time.Time) (*models.LedgerEntry, error) {
+	var result *models.LedgerEntry
+	err := s.inTx(func(tx *sql.Tx) error {
+		var n int64
+		err := tx.QueryRow(`
+			SELECT COALESCE(`+sqlPointsToExpire+`, 0) FROM ledger WHERE user_id = :user
+		`, sql.Named("at", formatSQLTime(at)), sql.Named("user", userID)).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("failed to compute expiring points; %v", err)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		entry, err := appendSQLLedger(tx, models.NewExpiryDebit(userID, n, at))
+		if err != nil {
+			return err
+		}
+
+		result = &entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Optional text columns are stored as NULL rather than empty strings
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+
+	return s
+}
+
+// Optional amounts are stored as NULL when missing
+func formatNullMoney(m *models.Money) any {
+	if m == nil {
+		return nil
+	}
+
+	return m.String()
+}
+
+// Returns nil for an amount that was stored as NULL and selected as an empty string
+func parseNullMoney(s string) (*models.Money, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	m, err := models.ParseMoney(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// Times are stored as fixed-width UTC text so they sort chronologically
+const sqlTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func formatSQLTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(sqlTimeFormat)
+}
+
+func parseSQLTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(sqlTimeFormat, s)
+}
+
+// Optional times are stored as NULL when missing
+func formatNullSQLTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+
+	return formatSQLTime(*t)
+}
+
+// Returns nil for a time that was stored as NULL and selected as an empty string
+func parseNullSQLTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := parseSQLTime(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
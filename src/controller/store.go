@@ -0,0 +1,442 @@
+/**
+store.go
+
+Describes where processed receipts and per-user counters are kept, along with an in-memory implementation
+*/
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Errors returned by a `Store`
+var (
+	// No receipt exists for an ID
+	ErrReceiptNotFound = errors.New("receipt not found")
+
+	// A receipt with the same ID was already saved
+	ErrReceiptExists = errors.New("receipt already exists")
+
+	// The receipt was already voided
+	ErrReceiptVoided = errors.New("receipt already voided")
+
+	// The user has no ledger entries
+	ErrUserNotFound = errors.New("user not found")
+
+	// An idempotency key was reused for a different request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+)
+
+// Returned by a `Store` when a user doesn't have enough points for a redemption
+type InsufficientBalanceError struct {
+	Balance   int64
+	Requested int64
+}
+
+func (e *InsufficientBalanceError) Error() string {
+	return fmt.Sprintf("balance of %v points is less than the %v requested", e.Balance, e.Requested)
+}
+
+// Describes storage for processed receipts and per-user counters
+// Implementations must be safe for concurrent use
+type Store interface {
+	// Saves a newly processed receipt and credits its points to the user's ledger, see `ReceiptRecord.LedgerCredits`
+	// Returns `ErrReceiptExists` if a receipt with the same ID was already saved
+	SaveReceipt(record *models.ReceiptRecord) error
+
+	// Returns the receipt with the given ID, or `ErrReceiptNotFound`
+	GetReceipt(id string) (*models.ReceiptRecord, error)
+
+	// Atomically marks the receipt voided with the reason, debits its unspent points from the user's ledger,
+	// see `ReceiptRecord.VoidDebit`, and takes it off the user's receipt count. Returns the record as voided and the debit
+	// Returns `ErrReceiptNotFound`, or `ErrReceiptVoided` if it was already voided
+	VoidReceipt(id string, reason string, at time.Time) (*models.ReceiptRecord, models.LedgerEntry, error)
+
+	// Atomically replaces the receipt's points, breakdown and rule set version with those of `rescored`, and credits or
+	// debits the difference to the user's ledger, see `ReceiptRecord.RescoreAdjustment`. Returns the adjustment,
+	// or nil if nothing was credited or debited. Returns `ErrReceiptNotFound`, or `ErrReceiptVoided` if it was voided
+	RescoreReceipt(rescored *models.ReceiptRecord, at time.Time) (*models.LedgerEntry, error)
+
+	// Returns up to `limit` receipts matching the filter that come after the given position,
+	// in the order of `models.ReceiptPosition`
+	ListReceipts(filter models.ReceiptFilter, after models.ReceiptPosition, limit int) ([]*models.ReceiptRecord, error)
+
+	// Returns the ID of the first receipt saved with the given fingerprint, or `ErrReceiptNotFound`
+	FindReceiptByFingerprint(fingerprint string) (string, error)
+
+	// Returns how many receipts have been processed for the user
+	ReceiptCount(userID string) (int64, error)
+
+	// Atomically increments how many receipts have been processed for the user, returning the count from before
+	// Concurrent calls for the same user always observe distinct counts
+	IncrementReceiptCount(userID string) (int64, error)
+
+	// Returns the user's current points balance, or `ErrUserNotFound`
+	Balance(userID string) (int64, error)
+
+	// Returns up to `limit` of the user's ledger entries with a sequence number greater than `afterSeq`, oldest first
+	// Returns `ErrUserNotFound` if the user has no entries at all
+	ListLedger(userID string, afterSeq int64, limit int) ([]models.LedgerEntry, error)
+
+	// Atomically debits a redemption from the user's ledger, given an entry with `UserID`, `Amount`, `Description`,
+	// `CreatedAt` and optionally `IdempotencyKey` filled in. Returns the entry as appended
+	// Returns an `*InsufficientBalanceError` if the balance would go negative
+	// If the user already has an entry with the same idempotency key, it's returned instead along with true,
+	// or `ErrIdempotencyKeyReused` if that entry doesn't match
+	Redeem(entry models.LedgerEntry) (models.LedgerEntry, bool, error)
+
+	// Returns the users with points that expired by the given time but haven't been debited yet
+	ExpiringUsers(at time.Time) ([]string, error)
+
+	// Atomically debits the user's points that expired by the given time, see `models.PointsToExpire`
+	// Returns the entry as appended, or nil if nothing had expired
+	ExpirePoints(userID string, at time.Time) (*models.LedgerEntry, error)
+
+	// Releases any resources held by the store
+	Close() error
+}
+
+// Store used by the HTTP handlers
+var receiptStore Store = NewMemoryStore()
+
+// Replaces the store used by the HTTP handlers
+// Should be called before the server starts handling requests
+func SetStore(s Store) {
+	receiptStore = s
+}
+
+// Returns the store used by the HTTP handlers
+func ActiveStore() Store {
+	return receiptStore
+}
+
+// Describes everything a `MemoryStore` holds, in a form that can be serialized
+type memoryState struct {
+	Receipts      map[string]*models.ReceiptRecord `json:"receipts"`
+	ReceiptCounts map[string]int64                 `json:"receiptCounts"`
+	Ledgers       map[string][]models.LedgerEntry  `json:"ledgers"`
+
+	// Sequence numbers of ledger entries, keyed by user then idempotency key
+	IdempotencyKeys map[string]map[string]int64 `json:"idempotencyKeys"`
+
+	// IDs of the first receipt saved with each fingerprint
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+// Keeps everything in memory, so all data is lost when the process exits
+type MemoryStore struct {
+	mu    sync.RWMutex
+	state memoryState
+}
+
+// Creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		state: memoryState{
+			Receipts:      map[string]*models.ReceiptRecord{},
+			ReceiptCounts: map[string]int64{},
+			Ledgers:       map[string][]models.LedgerEntry{},
+
+			IdempotencyKeys: map[string]map[string]int64{},
+			Fingerprints:    map[string]string{},
+		},
+	}
+}
+
+func (s *MemoryStore) SaveReceipt(record *models.ReceiptRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.state.Receipts[record.ID]
+	if ok {
+		return ErrReceiptExists
+	}
+
+	s.state.Receipts[record.ID] = record
+	if record.Fingerprint != "" {
+		_, ok = s.state.Fingerprints[record.Fingerprint]
+		if !ok {
+			s.state.Fingerprints[record.Fingerprint] = record.ID
+		}
+	}
+
+	for _, entry := range record.LedgerCredits() {
+		s.appendLedger(entry)
+	}
+
+	return nil
+}
+
+// Assigns the entry the user's next sequence number and running balance, then appends it to their ledger
+// Must be called with `mu` held
+func (s *MemoryStore) appendLedger(entry models.LedgerEntry) models.LedgerEntry {
+	ledger := s.state.Ledgers[entry.UserID]
+
+	entry.Seq = 1
+	entry.Balance = entry.Amount
+	if len(ledger) > 0 {
+		last := ledger[len(ledger)-1]
+		entry.Seq = last.Seq + 1
+		entry.Balance = last.Balance + entry.Amount
+	}
+
+	s.state.Ledgers[entry.UserID] = append(ledger, entry)
+
+	if entry.IdempotencyKey != "" {
+		keys := s.state.IdempotencyKeys[entry.UserID]
+		if keys == nil {
+			keys = map[string]int64{}
+			s.state.IdempotencyKeys[entry.UserID] = keys
+		}
+		keys[entry.IdempotencyKey] = entry.Seq
+	}
+
+	return entry
+}
+
+func (s *MemoryStore) GetReceipt(id string) (*models.ReceiptRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, ok := s.state.Receipts[id]
+	if !ok {
+		return nil, ErrReceiptNotFound
+	}
+
+	return record, nil
+}
+
+func (s *MemoryStore) VoidReceipt(id string, reason string, at time.Time) (*models.ReceiptRecord, models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.state.Receipts[id]
+	if !ok {
+		return nil, models.LedgerEntry{}, ErrReceiptNotFound
+	}
+	if record.VoidedAt != nil {
+		return nil, models.LedgerEntry{}, ErrReceiptVoided
+	}
+
+	// Records handed out by `GetReceipt` are shared, so the voided record replaces the original rather than changing it
+	voided := *record
+	voided.VoidedAt = &at
+	voided.VoidReason = reason
+	s.state.Receipts[id] = &voided
+
+	userID := voided.Receipt.UserID
+	s.state.ReceiptCounts[userID] = max(s.state.ReceiptCounts[userID]-1, 0)
+
+	return &voided, s.appendLedger(voided.VoidDebit(s.state.Ledgers[userID])), nil
+}
+
+func (s *MemoryStore) RescoreReceipt(rescored *models.ReceiptRecord, at time.Time) (*models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.state.Receipts[rescored.ID]
+	if !ok {
+		return nil, ErrReceiptNotFound
+	}
+	if record.VoidedAt != nil {
+		return nil, ErrReceiptVoided
+	}
+
+	// As with voiding, the original is replaced rather than changed since it may be shared
+	updated := *record
+	updated.Points = rescored.Points
+	updated.Breakdown = rescored.Breakdown
+	updated.RuleSetVersion = rescored.RuleSetVersion
+	s.state.Receipts[updated.ID] = &updated
+
+	adjustment := record.RescoreAdjustment(&updated, at, s.state.Ledgers[updated.Receipt.UserID])
+	if adjustment.Amount == 0 {
+		return nil, nil
+	}
+
+	entry := s.appendLedger(adjustment)
+	return &entry, nil
+}
+
+func (s *MemoryStore) ListReceipts(filter models.ReceiptFilter, after models.ReceiptPosition, limit int) ([]*models.ReceiptRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := []*models.ReceiptRecord{}
+	for _, record := range s.state.Receipts {
+		if after.Before(record.Position()) && filter.Matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Position().Before(records[j].Position())
+	})
+
+	return records[:min(limit, len(records))], nil
+}
+
+func (s *MemoryStore) FindReceiptByFingerprint(fingerprint string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.state.Fingerprints[fingerprint]
+	if !ok {
+		return "", ErrReceiptNotFound
+	}
+
+	return id, nil
+}
+
+func (s *MemoryStore) ReceiptCount(userID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state.ReceiptCounts[userID], nil
+}
+
+func (s *MemoryStore) IncrementReceiptCount(userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.state.ReceiptCounts[userID]
+	s.state.ReceiptCounts[userID] = n + 1
+	return n, nil
+}
+
+// Only used to replay logs written before counts were incremented atomically
+func (s *MemoryStore) setReceiptCount(userID string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.ReceiptCounts[userID] = n
+}
+
+func (s *MemoryStore) Balance(userID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ledger := s.state.Ledgers[userID]
+	if len(ledger) == 0 {
+		return 0, ErrUserNotFound
+	}
+
+	return ledger[len(ledger)-1].Balance, nil
+}
+
+func (s *MemoryStore) ListLedger(userID string, afterSeq int64, limit int) ([]models.LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ledger := s.state.Ledgers[userID]
+	if len(ledger) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	// Sequence numbers start at 1 and have no gaps, so they double as indexes
+	start := min(max(afterSeq, 0), int64(len(ledger)))
+	end := min(start+int64(limit), int64(len(ledger)))
+
+	entries := make([]models.LedgerEntry, end-start)
+	copy(entries, ledger[start:end])
+	return entries, nil
+}
+
+// Returns the user's most recent ledger entry, which must exist
+func (s *MemoryStore) lastLedgerEntry(userID string) models.LedgerEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ledger := s.state.Ledgers[userID]
+	return ledger[len(ledger)-1]
+}
+
+func (s *MemoryStore) Redeem(entry models.LedgerEntry) (models.LedgerEntry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.findRedemption(entry)
+	if err != nil {
+		return models.LedgerEntry{}, false, err
+	}
+	if existing != nil {
+		return *existing, true, nil
+	}
+
+	return s.appendLedger(entry), false, nil
+}
+
+// Returns the entry a redemption was already recorded as, or an error if the redemption can't be made
+// Returns nil and no error if the redemption can go ahead
+// Must be called with `mu` held
+func (s *MemoryStore) findRedemption(entry models.LedgerEntry) (*models.LedgerEntry, error) {
+	ledger := s.state.Ledgers[entry.UserID]
+
+	if entry.IdempotencyKey != "" {
+		seq, ok := s.state.IdempotencyKeys[entry.UserID][entry.IdempotencyKey]
+		if ok {
+			existing := ledger[seq-1]
+			if existing.Kind != entry.Kind || existing.Amount != entry.Amount || existing.Description != entry.Description {
+				return nil, ErrIdempotencyKeyReused
+			}
+			return &existing, nil
+		}
+	}
+
+	balance := int64(0)
+	if len(ledger) > 0 {
+		balance = ledger[len(ledger)-1].Balance
+	}
+
+	if balance+entry.Amount < 0 {
+		return nil, &InsufficientBalanceError{Balance: balance, Requested: -entry.Amount}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) ExpiringUsers(at time.Time) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userIDs := []string{}
+	for userID, ledger := range s.state.Ledgers {
+		if models.PointsToExpire(ledger, at) > 0 {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	return userIDs, nil
+}
+
+func (s *MemoryStore) ExpirePoints(userID string, at time.Time) (*models.LedgerEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := models.PointsToExpire(s.state.Ledgers[userID], at)
+	if n == 0 {
+		return nil, nil
+	}
+
+	entry := s.appendLedger(models.NewExpiryDebit(userID, n, at))
+	return &entry, nil
+}
+
+// Appends an entry that was already checked, such as one being replayed from a log
+func (s *MemoryStore) appendEntry(entry models.LedgerEntry) models.LedgerEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.appendLedger(entry)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
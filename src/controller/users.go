@@ -0,0 +1,356 @@
+/**
+users.go
+
+Contains 'business' logic for querying and redeeming a user's points
+*/
+
+package controller
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+)
+
+// Define the paths for the HTTP server
+const (
+	GetUserPointsPath = "/users/{userId}/points"
+	GetUserLedgerPath = "/users/{userId}/ledger"
+
+	GetUserExpiringPointsPath = "/users/{userId}/points/expiring"
+
+	CreateRedemptionPath = "/users/{userId}/redemptions"
+)
+
+// How far ahead to look for expiring points, in days
+const (
+	defaultExpiringDays = 30
+	maxExpiringDays     = 3660
+)
+
+// Request header that makes a request safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Response header set when a request is answered from an earlier request with the same idempotency key
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// Longest idempotency key accepted
+const maxIdempotencyKeyLength = 255
+
+// Page sizes for the ledger
+const (
+	defaultLedgerLimit = 50
+	maxLedgerLimit     = 500
+)
+
+// Responds to a request for a user that has no ledger
+func writeUserNotFound(w http.ResponseWriter) {
+	writeProblem(w, http.StatusNotFound, &models.ErrorResponse{
+		Type:   ErrorTypeUserNotFound,
+		Detail: "No user found for that ID.",
+	})
+}
+
+// Validate a request to query a user's points, then return their current balance
+func GetUserPoints(w http.ResponseWriter, r *http.Request) {
+
+	userID := r.PathValue("userId")
+	balance, err := receiptStore.Balance(userID)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("User does not exist")
+		writeUserNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load balance: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &models.GetUserPointsResponse{
+		UserID:  userID,
+		Balance: balance,
+	}
+
+	log.Printf("Retrieved balance for user '%v': %v points", userID, balance)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validate a request to query a user's ledger, then return a page of their entries, oldest first
+// Supports the `limit` and `cursor` query parameters
+func GetUserLedger(w http.ResponseWriter, r *http.Request) {
+
+	userID := r.PathValue("userId")
+
+	limit := defaultLedgerLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxLedgerLimit {
+			log.Printf("Limit was invalid: %v", s)
+			writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+				Type:   ErrorTypeInvalidRequest,
+				Detail: "The limit is invalid.",
+			})
+			return
+		}
+		limit = n
+	}
+
+	afterSeq, ok := decodeLedgerCursor(r.URL.Query().Get("cursor"))
+	if !ok {
+		log.Printf("Cursor was invalid")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The cursor is invalid.",
+		})
+		return
+	}
+
+	// Ask for one extra entry to tell whether there's another page
+	entries, err := receiptStore.ListLedger(userID, afterSeq, limit+1)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("User does not exist")
+		writeUserNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &models.GetUserLedgerResponse{
+		UserID:  userID,
+		Entries: entries,
+	}
+
+	if len(entries) > limit {
+		resp.Entries = entries[:limit]
+		resp.NextCursor = encodeLedgerCursor(resp.Entries[limit-1].Seq)
+	}
+
+	log.Printf("Retrieved %v ledger entries for user '%v'", len(resp.Entries), userID)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validate a request to query a user's expiring points, then return the unspent points expiring within the window
+// Supports the `days` query parameter
+func GetUserExpiringPoints(w http.ResponseWriter, r *http.Request) {
+
+	userID := r.PathValue("userId")
+
+	days := defaultExpiringDays
+	if s := r.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxExpiringDays {
+			log.Printf("Days were invalid: %v", s)
+			writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+				Type:   ErrorTypeInvalidRequest,
+				Detail: "The number of days is invalid.",
+			})
+			return
+		}
+		days = n
+	}
+
+	ledger, err := receiptStore.ListLedger(userID, 0, math.MaxInt)
+	if errors.Is(err, ErrUserNotFound) {
+		log.Printf("User does not exist")
+		writeUserNotFound(w)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp := &models.GetUserExpiringPointsResponse{
+		UserID:   userID,
+		Days:     days,
+		Expiring: []models.ExpiringPoints{},
+	}
+
+	// Includes points that have already expired but haven't been debited yet
+	until := time.Now().UTC().AddDate(0, 0, days)
+	for _, points := range models.UnspentExpiringPoints(ledger) {
+		if points.ExpiresAt.After(until) {
+			break
+		}
+		resp.Points += points.Points
+		resp.Expiring = append(resp.Expiring, points)
+	}
+
+	log.Printf("User '%v' has %v points expiring in the next %v days", userID, resp.Points, days)
+
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(buf)
+}
+
+// Validate a request to redeem a user's points, then debit them from the user's ledger
+// Retries carrying the same `Idempotency-Key` header return the original debit instead of debiting again
+func CreateRedemption(w http.ResponseWriter, r *http.Request) {
+
+	userID := r.PathValue("userId")
+
+	var req models.CreateRedemptionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		log.Printf("Failed to unmarshal HTTP request body: %v", err)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The redemption is invalid.",
+		})
+		return
+	}
+
+	if req.Points <= 0 {
+		log.Printf("Redemption points were not positive: %v", req.Points)
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The points to redeem must be a positive integer.",
+		})
+		return
+	}
+
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		log.Printf("Idempotency key was too long")
+		writeProblem(w, http.StatusBadRequest, &models.ErrorResponse{
+			Type:   ErrorTypeInvalidRequest,
+			Detail: "The idempotency key is too long.",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+
+	// Expired points can't be spent, even if the expiry job hasn't debited them yet
+	if ExpiryPolicy().Enabled() {
+		_, err = receiptStore.ExpirePoints(userID, now)
+		if err != nil {
+			log.Printf("Failed to expire points: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	entry, replayed, err := receiptStore.Redeem(models.LedgerEntry{
+		UserID:         userID,
+		Kind:           models.LedgerEntryRedemption,
+		Amount:         -req.Points,
+		Description:    req.Description,
+		CreatedAt:      now,
+		IdempotencyKey: key,
+	})
+
+	var insufficient *InsufficientBalanceError
+	if errors.As(err, &insufficient) {
+		log.Printf("Redemption rejected for user '%v': %v", userID, err)
+		writeProblem(w, http.StatusUnprocessableEntity, &models.ErrorResponse{
+			Type:      ErrorTypeInsufficientBalance,
+			Detail:    "The user does not have enough points for this redemption.",
+			Balance:   &insufficient.Balance,
+			Requested: &insufficient.Requested,
+		})
+		return
+	}
+	if errors.Is(err, ErrIdempotencyKeyReused) {
+		log.Printf("Idempotency key was reused for a different redemption")
+		writeProblem(w, http.StatusUnprocessableEntity, &models.ErrorResponse{
+			Type:   ErrorTypeIdempotencyKeyReused,
+			Detail: "The idempotency key was already used for a different redemption.",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to redeem points: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if replayed {
+		log.Printf("Replayed redemption %v for user '%v'", entry.Seq, userID)
+		w.Header().Set(idempotentReplayedHeader, "true")
+	} else {
+		log.Printf("Redeemed %v points for user '%v', balance is now %v", req.Points, userID, entry.Balance)
+	}
+
+	buf, err := json.Marshal(&entry)
+	if err != nil {
+		log.Printf("Failed to marshal HTTP response body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(buf)
+}
+
+// Cursors are opaque to clients so the pagination scheme can change without breaking them
+func encodeCursor(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// Returns the position encoded in the cursor, or false if it isn't a cursor
+func decodeCursor(cursor string) (string, bool) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", false
+	}
+
+	return string(buf), true
+}
+
+// Returns the cursor for the ledger page after the entry with the given sequence number
+func encodeLedgerCursor(seq int64) string {
+	return encodeCursor(strconv.FormatInt(seq, 10))
+}
+
+// Returns the sequence number encoded in the cursor, or 0 for an empty cursor
+func decodeLedgerCursor(cursor string) (int64, bool) {
+	if cursor == "" {
+		return 0, true
+	}
+
+	position, ok := decodeCursor(cursor)
+	if !ok {
+		return 0, false
+	}
+
+	seq, err := strconv.ParseInt(position, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false
+	}
+
+	return seq, true
+}
@@ -0,0 +1,162 @@
+/**
+currency.go
+
+Describes the supported currencies and how amounts in them are converted to the base currency rules score in
+*/
+
+package models
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Currency of receipts that don't name one, and the base currency by default
+const DefaultCurrency = "USD"
+
+// Bounds on exchange rates, wide enough for any real rate between two supported currencies
+var (
+	minExchangeRate = big.NewRat(1, 1_000_000)
+	maxExchangeRate = big.NewRat(1_000_000, 1)
+)
+
+// Decimal places of the minor units of every supported ISO 4217 currency
+var currencyExponents = map[string]int{
+	"AED": 2, "ARS": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLF": 4, "CLP": 0, "CNY": 2,
+	"COP": 2, "CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "IDR": 2, "ILS": 2, "INR": 2,
+	"ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PEN": 2,
+	"PHP": 2, "PLN": 2, "SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "TWD": 2, "USD": 2,
+	"UYW": 4, "VND": 0, "ZAR": 2,
+}
+
+// Returns the number of decimal places amounts in the currency have, e.g. 2 for USD and 0 for JPY
+// Returns false if the currency isn't supported
+func CurrencyExponent(currency string) (int, bool) {
+	exponent, ok := currencyExponents[currency]
+	return exponent, ok
+}
+
+// Returns the codes of every supported currency, sorted
+func SupportedCurrencies() []string {
+	codes := make([]string, 0, len(currencyExponents))
+	for code := range currencyExponents {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	return codes
+}
+
+// Describes how amounts in other currencies are converted to the base currency that rules score in
+type ExchangeRates struct {
+	Base string
+
+	// Units of the base currency that one unit of each other currency is worth
+	rates map[string]*big.Rat
+}
+
+// Returns exchange rates that only support the default currency
+func DefaultExchangeRates() *ExchangeRates {
+	return &ExchangeRates{Base: DefaultCurrency, rates: map[string]*big.Rat{}}
+}
+
+// Creates exchange rates to the base currency from decimal rates keyed by currency, e.g. {"CAD": "0.73"}
+// Rates are kept exactly as written
+func NewExchangeRates(base string, rates map[string]string) (*ExchangeRates, error) {
+	if _, ok := CurrencyExponent(base); !ok {
+		return nil, fmt.Errorf("base currency %q is not a supported ISO 4217 currency code", base)
+	}
+
+	x := &ExchangeRates{Base: base, rates: map[string]*big.Rat{}}
+	for currency, rate := range rates {
+		if _, ok := CurrencyExponent(currency); !ok {
+			return nil, fmt.Errorf("exchange rate for %q: not a supported ISO 4217 currency code", currency)
+		}
+
+		exact, ok := new(big.Rat).SetString(rate)
+		if !ok || exact.Sign() <= 0 {
+			return nil, fmt.Errorf("exchange rate for %v must be a positive number", currency)
+		}
+		if exact.Cmp(minExchangeRate) < 0 || exact.Cmp(maxExchangeRate) > 0 {
+			return nil, fmt.Errorf("exchange rate for %v must be from %v to %v", currency,
+				minExchangeRate.FloatString(6), maxExchangeRate.FloatString(0))
+		}
+
+		x.rates[currency] = exact
+	}
+
+	return x, nil
+}
+
+// Returns the rate from the currency to the base currency, or nil if there isn't one
+func (x *ExchangeRates) rate(currency string) *big.Rat {
+	if currency == x.Base {
+		return big.NewRat(1, 1)
+	}
+
+	return x.rates[currency]
+}
+
+// Returns true if amounts in the currency can be converted to the base currency
+func (x *ExchangeRates) Supports(currency string) bool {
+	return x.rate(currency) != nil
+}
+
+// Returns the amount in the base currency, rounded half up to the base currency's minor units
+// Returns `ErrMoneyOverflow` if the converted amount is too large to represent
+// The currency must be supported, see `ExchangeRates.Supports`
+func (x *ExchangeRates) Convert(m Money, currency string) (Money, error) {
+	exponent := currencyExponents[x.Base]
+
+	converted := m.rat()
+	converted.Mul(converted, x.rate(currency))
+	converted.Mul(converted, new(big.Rat).SetInt64(pow10(exponent)))
+
+	// Rounds half up by flooring the amount plus a half
+	converted.Add(converted, big.NewRat(1, 2))
+	return moneyFromBig(new(big.Int).Div(converted.Num(), converted.Denom()), exponent)
+}
+
+// Returns a copy of the receipt with every amount converted to the base currency
+// Returns an error if the receipt's currency isn't supported, or `ErrMoneyOverflow` if an amount is too large once
+// converted
+func (x *ExchangeRates) ToBase(r *Receipt) (*Receipt, error) {
+	currency := r.CurrencyCode()
+	if !x.Supports(currency) {
+		return nil, fmt.Errorf("no exchange rate from %v to %v", currency, x.Base)
+	}
+
+	var err error
+	convert := func(m Money) Money {
+		converted, convertErr := x.Convert(m, currency)
+		if convertErr != nil {
+			err = convertErr
+		}
+		return converted
+	}
+
+	converted := *r
+	converted.Currency = x.Base
+	converted.Total = convert(r.Total)
+	for _, amount := range []**Money{&converted.Subtotal, &converted.Tax, &converted.Tip} {
+		if *amount != nil {
+			convertedAmount := convert(**amount)
+			*amount = &convertedAmount
+		}
+	}
+	converted.Items = make([]Item, len(r.Items))
+	for i, item := range r.Items {
+		item.Price = convert(item.Price)
+		if item.UnitPrice != nil {
+			unitPrice := convert(*item.UnitPrice)
+			item.UnitPrice = &unitPrice
+		}
+		converted.Items[i] = item
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &converted, nil
+}
@@ -0,0 +1,165 @@
+/**
+expiry.go
+
+Describes when awarded points expire, and how much of a user's balance is due to expire
+*/
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// What the expiry of a receipt's points is measured from
+const (
+	ExpiryBasisPurchase  = "purchase"
+	ExpiryBasisProcessed = "processed"
+)
+
+// Describes when the points awarded for a receipt expire
+// The zero value means points never expire
+type ExpiryPolicy struct {
+	// How many months points last, or 0 if they never expire
+	Months int
+
+	// Either `ExpiryBasisPurchase` or `ExpiryBasisProcessed`
+	Basis string
+}
+
+// Returns an error if the policy can't be applied
+func (p ExpiryPolicy) Validate() error {
+	if p.Months < 0 {
+		return fmt.Errorf("months must not be negative")
+	}
+	if !p.Enabled() {
+		return nil
+	}
+	if p.Basis != ExpiryBasisPurchase && p.Basis != ExpiryBasisProcessed {
+		return fmt.Errorf("basis must be %q or %q", ExpiryBasisPurchase, ExpiryBasisProcessed)
+	}
+
+	return nil
+}
+
+// Returns true if the policy makes points expire at all
+func (p ExpiryPolicy) Enabled() bool {
+	return p.Months > 0
+}
+
+// Returns when the points awarded for the receipt expire, or nil if they never do
+// The receipt must already have been validated
+func (p ExpiryPolicy) ExpiresAt(record *ReceiptRecord) *time.Time {
+	if !p.Enabled() {
+		return nil
+	}
+
+	from := record.ProcessedAt
+	if p.Basis == ExpiryBasisPurchase {
+		from, _ = time.Parse(DateFormat, record.Receipt.PurchaseDate)
+	}
+
+	expiresAt := from.UTC().AddDate(0, p.Months, 0)
+	return &expiresAt
+}
+
+// Describes points from a single credit that are still unspent
+type ExpiringPoints struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+	Points    int64     `json:"points"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+}
+
+// Returns the unspent points of every credit that expires, soonest first
+// Debits spend the credits that expire soonest first, which always leaves the user the most points. A receipt's own
+// debits, from voiding it or rescoring it lower, instead cancel that receipt's credits, see `UnspentReceiptPoints`
+func UnspentExpiringPoints(ledger []LedgerEntry) []ExpiringPoints {
+	cancelled := map[string]int64{}
+	credits := []LedgerEntry{}
+	spent := int64(0)
+	for _, entry := range ledger {
+		switch {
+		case entry.Amount < 0 && entry.ReceiptID != "":
+			cancelled[entry.ReceiptID] -= entry.Amount
+		case entry.Amount < 0:
+			spent -= entry.Amount
+		case entry.ExpiresAt != nil:
+			credits = append(credits, entry)
+		}
+	}
+
+	sort.SliceStable(credits, func(i, j int) bool {
+		return credits[i].ExpiresAt.Before(*credits[j].ExpiresAt)
+	})
+
+	unspent := []ExpiringPoints{}
+	for _, credit := range credits {
+		n := credit.Amount - min(cancelled[credit.ReceiptID], credit.Amount)
+		cancelled[credit.ReceiptID] -= credit.Amount - n
+
+		used := min(spent, n)
+		spent -= used
+		n -= used
+		if n > 0 {
+			unspent = append(unspent, ExpiringPoints{ExpiresAt: *credit.ExpiresAt, Points: n, ReceiptID: credit.ReceiptID})
+		}
+	}
+
+	return unspent
+}
+
+// Returns how many of the receipt's points are still in the user's balance, which is the most its debits may take back
+// Points that expire are unspent as reported by `UnspentExpiringPoints`, so none are left once they expire or are spent
+// Points that never expire are only spent after every expiring point, so they are unspent up to what the balance holds
+func UnspentReceiptPoints(ledger []LedgerEntry, receiptID string) int64 {
+	expiring, unspent := int64(0), int64(0)
+	for _, points := range UnspentExpiringPoints(ledger) {
+		expiring += points.Points
+		if points.ReceiptID == receiptID {
+			unspent += points.Points
+		}
+	}
+
+	balance, lasting, expires := int64(0), int64(0), false
+	for _, entry := range ledger {
+		balance += entry.Amount
+		if entry.ReceiptID != receiptID {
+			continue
+		}
+		if entry.ExpiresAt != nil {
+			expires = true
+		} else {
+			lasting += entry.Amount
+		}
+	}
+	if expires {
+		return unspent
+	}
+
+	return max(0, min(lasting, balance-expiring))
+}
+
+// Returns how many of the user's points have expired by the given time but haven't been debited yet
+func PointsToExpire(ledger []LedgerEntry, at time.Time) int64 {
+	n := int64(0)
+	for _, points := range UnspentExpiringPoints(ledger) {
+		if points.ExpiresAt.After(at) {
+			break
+		}
+		n += points.Points
+	}
+
+	return n
+}
+
+// Returns the ledger entry that debits points which have expired by the given time
+func NewExpiryDebit(userID string, points int64, at time.Time) LedgerEntry {
+	return LedgerEntry{
+		UserID:      userID,
+		Kind:        LedgerEntryExpiry,
+		Amount:      -points,
+		Description: "Points expired",
+		CreatedAt:   at,
+	}
+}
@@ -7,231 +7,713 @@ Describes the request/response struct definitions along with some helper methods
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
-	"math"
 	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
-	"unicode"
 )
 
 // Regexes for validating properties
 var (
 	shortDescRgx = regexp.MustCompile(`^[\w\s\-]+$`)
-	dollarAmtRgx = regexp.MustCompile(`^\d+\.\d{2}$`)
 	retailerRgx  = regexp.MustCompile(`^[\w\s\-&]+$`)
+	skuRgx       = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9\-_.]{0,63}$`)
 	DateFormat   = "2006-01-02"
 	TimeFormat   = "15:04"
 )
 
-// Describes a purchased item in a receipt
+// Most units of a single item a receipt line can have
+// Kept to what a real purchase could have, since the `itemPairs` rule awards points for every pair
+const MaxItemQuantity = 100
+
+// Describes a purchased item in a receipt, or a discount applied to it
 type Item struct {
 	ShortDescription string `json:"shortDescription"`
-	Price            string `json:"price"`
+
+	// Total for the line, i.e. `UnitPrice` times `Quantity`. Negative for discount lines
+	Price Money `json:"price"`
+
+	// Number of units bought, 1 if omitted
+	Quantity *int64 `json:"quantity,omitempty"`
+
+	// Price of a single unit, optional
+	UnitPrice *Money `json:"unitPrice,omitempty"`
+
+	// Retailer's stock keeping unit and the item's UPC or EAN barcode number, both optional
+	SKU string `json:"sku,omitempty"`
+	UPC string `json:"upc,omitempty"`
+
+	// Set for lines that take money off the total, e.g. coupons, rather than items bought
+	Discount bool `json:"discount,omitempty"`
+}
+
+// Returns the number of units the line is for, 0 for discount lines
+func (item *Item) Count() int64 {
+	if item.Discount {
+		return 0
+	}
+	if item.Quantity == nil {
+		return 1
+	}
+
+	return *item.Quantity
 }
 
-// Returns an error if any of the properties are invalid
+// Returns a `ValidationErrors` listing every property that is invalid
 // Returns `nil` otherwise
 func (item *Item) ValidateProperties() error {
-	ok := shortDescRgx.MatchString(item.ShortDescription)
-	if !ok {
-		return fmt.Errorf("property ShortDescription didn't follow pattern: %v", shortDescRgx.String())
+	return item.validate("", currencyExponents[DefaultCurrency]).orNil()
+}
+
+// Returns every invalid property, with field paths starting with the given prefix
+// Amounts must have `exponent` decimal places, any number of them if it's negative
+func (item *Item) validate(prefix string, exponent int) ValidationErrors {
+	var errs ValidationErrors
+	errs.checkPattern(prefix+"shortDescription", item.ShortDescription, shortDescRgx)
+	errs.checkMoney(prefix+"price", item.Price, exponent)
+
+	if item.Discount {
+		if item.Price.IsValid() && item.Price.Sign() >= 0 {
+			errs.add(prefix+"price", ValidationOutOfRange, fmt.Sprintf("%vprice must be negative on discount lines", prefix))
+		}
+		if item.Quantity != nil || item.UnitPrice != nil {
+			errs.add(prefix+"discount", ValidationInconsistent,
+				fmt.Sprintf("%vquantity and %vunitPrice aren't allowed on discount lines", prefix, prefix))
+		}
+	} else if item.Price.IsValid() && item.Price.Sign() < 0 {
+		errs.add(prefix+"price", ValidationOutOfRange,
+			fmt.Sprintf("%vprice must not be negative, unless %vdiscount is set", prefix, prefix))
 	}
 
-	ok = dollarAmtRgx.MatchString(item.Price)
-	if !ok {
-		return fmt.Errorf("property Price didn't follow pattern: %v", dollarAmtRgx.String())
+	if item.Quantity != nil && (*item.Quantity < 1 || *item.Quantity > MaxItemQuantity) {
+		errs.add(prefix+"quantity", ValidationOutOfRange,
+			fmt.Sprintf("%vquantity must be between 1 and %v", prefix, MaxItemQuantity))
+	}
+
+	if item.UnitPrice != nil {
+		errs.checkMoney(prefix+"unitPrice", *item.UnitPrice, exponent)
+		if item.UnitPrice.IsValid() && item.UnitPrice.Sign() < 0 {
+			errs.add(prefix+"unitPrice", ValidationOutOfRange, fmt.Sprintf("%vunitPrice must not be negative", prefix))
+		}
 	}
 
-	return nil
+	// Only compared once every amount involved is known to be valid, a product too large to represent never matches
+	if len(errs) == 0 && item.UnitPrice != nil {
+		product, err := item.UnitPrice.Mul(item.Count())
+		if err != nil || product.Cmp(item.Price) != 0 {
+			errs.add(prefix+"price", ValidationInconsistent,
+				fmt.Sprintf("%vprice must be %vunitPrice times %vquantity", prefix, prefix, prefix))
+		}
+	}
+
+	if item.SKU != "" && !skuRgx.MatchString(item.SKU) {
+		errs.add(prefix+"sku", ValidationInvalidFormat, fmt.Sprintf("%vsku didn't follow pattern: %v", prefix, skuRgx.String()))
+	}
+	if item.UPC != "" && !validGTIN(item.UPC) {
+		errs.add(prefix+"upc", ValidationInvalidFormat,
+			fmt.Sprintf("%vupc must be a 12 digit UPC or 13 digit EAN with a valid check digit", prefix))
+	}
+
+	return errs
 }
 
 // Describes a receipt of a transaction
 type Receipt struct {
 	UserID       string `json:"userId"`
 	Retailer     string `json:"retailer"`
-	Total        string `json:"total"`
+	Total        Money  `json:"total"`
 	PurchaseDate string `json:"purchaseDate"`
 	PurchaseTime string `json:"purchaseTime"`
 	Items        []Item `json:"items"`
+
+	// ISO 4217 code of the currency the amounts are in, `DefaultCurrency` if omitted
+	Currency string `json:"currency,omitempty"`
+
+	// Optional parts of the total: the items before tax, the tax and the tip
+	// The subtotal is required if either of the others is given
+	Subtotal *Money `json:"subtotal,omitempty"`
+	Tax      *Money `json:"tax,omitempty"`
+	Tip      *Money `json:"tip,omitempty"`
+
+	// IANA time zone or UTC offset of the store, e.g. America/Chicago or -05:00
+	// The purchase date and time are the store's local time, see `Receipt.LocalPurchaseTime`
+	TimeZone string `json:"timeZone,omitempty"`
 }
 
-// Returns an error if any of the properties are invalid
+// Returns a `ValidationErrors` listing every property that is invalid, including those of each item
 // Returns `nil` otherwise
 func (r *Receipt) ValidateProperties() error {
+	var errs ValidationErrors
+	errs.checkPattern("retailer", r.Retailer, retailerRgx)
 
-	if len(r.Items) < 1 {
-		return fmt.Errorf("property Items must have at least 1 item")
+	// Amounts are only checked against the currency's decimal places once the currency is known to be valid
+	exponent, ok := CurrencyExponent(r.CurrencyCode())
+	if !ok {
+		exponent = -1
+		errs.add("currency", ValidationUnsupportedCurrency, "currency must be a supported ISO 4217 currency code")
 	}
 
-	ok := retailerRgx.MatchString(r.Retailer)
-	if !ok {
-		return fmt.Errorf("property Retailer didn't follow pattern: %v", retailerRgx.String())
+	errs.checkMoney("total", r.Total, exponent)
+	if r.Total.IsValid() && r.Total.Sign() < 0 {
+		errs.add("total", ValidationOutOfRange, "total must not be negative")
 	}
 
-	ok = dollarAmtRgx.MatchString(r.Total)
-	if !ok {
-		return fmt.Errorf("property Total didn't follow pattern: %v", dollarAmtRgx.String())
+	errs.checkOptionalMoney("subtotal", r.Subtotal, exponent)
+	errs.checkOptionalMoney("tax", r.Tax, exponent)
+	errs.checkOptionalMoney("tip", r.Tip, exponent)
+	if r.Subtotal == nil && (r.Tax != nil || r.Tip != nil) {
+		errs.add("subtotal", ValidationRequired, "subtotal is required when tax or tip is given")
 	}
+	errs.checkDate("purchaseDate", r.PurchaseDate)
+	errs.checkTime("purchaseTime", r.PurchaseTime, TimeFormat, "a 24-hour time formatted as HH:MM")
 
-	_, err := time.Parse(DateFormat, r.PurchaseDate)
-	if err != nil {
-		return fmt.Errorf("property PruchaseDate is not a valid date; %v", err)
+	if r.TimeZone != "" {
+		_, err := LoadTimeZone(r.TimeZone)
+		if err != nil {
+			errs.add("timeZone", ValidationInvalidFormat,
+				"timeZone must be an IANA time zone like America/Chicago or a UTC offset like -05:00")
+		}
 	}
 
-	_, err = time.Parse(TimeFormat, r.PurchaseTime)
-	if err != nil {
-		return fmt.Errorf("property PurchaseTime is not a valid time; %v", err)
+	if r.Items == nil {
+		errs.add("items", ValidationRequired, "items is required")
+	} else if len(r.Items) < 1 {
+		errs.add("items", ValidationTooFewItems, "items must have at least 1 item")
 	}
 
-	for _, item := range r.Items {
-		err := item.ValidateProperties()
-		if err != nil {
-			return err
-		}
+	for i, item := range r.Items {
+		errs = append(errs, item.validate(fmt.Sprintf("items[%v].", i), exponent)...)
 	}
 
-	return nil
+	return errs.orNil()
 }
 
-// Calculates the points based on the receipt details
-// Assumes properties are valid, if not then calling this will result in UB since conversion errors are unchecked
-func (r *Receipt) CalculatePoints(bonusPoints int64) int64 {
+// Returns the number of units bought, counting quantities and leaving out discount lines
+func (r *Receipt) ItemCount() int64 {
+	n := int64(0)
+	for _, item := range r.Items {
+		n += item.Count()
+	}
 
-	totalPoints := int64(0)
+	return n
+}
 
-	// Retailer alphanum rule
-	for _, r := range r.Retailer {
-		if unicode.IsDigit(r) || unicode.IsLetter(r) {
-			totalPoints += 1
-		}
+// Returns the amount money-based rules score on, either `ScoreOnTotal` or `ScoreOnSubtotal`
+// Falls back to the total if the receipt doesn't have a subtotal
+func (r *Receipt) ScoredAmount(amount string) Money {
+	if amount == ScoreOnSubtotal && r.Subtotal != nil {
+		return *r.Subtotal
 	}
 
-	// Parse total
-	s := dollarAmtRgx.FindString(r.Total)
-	parts := strings.Split(s, ".")
-	// dollars, _ := strconv.Atoi(parts[0])
-	cents, _ := strconv.Atoi(parts[1])
+	return r.Total
+}
 
-	// Round dollar rule
-	if cents == 0 {
-		totalPoints += 50
+// Returns the ISO 4217 code of the currency the receipt's amounts are in
+func (r *Receipt) CurrencyCode() string {
+	if r.Currency == "" {
+		return DefaultCurrency
 	}
 
-	// Multiple of 0.25 rule
-	if cents%25 == 0 {
-		totalPoints += 25
-	}
+	return r.Currency
+}
 
-	// Every 2 items rule
-	totalPoints += 5 * int64(len(r.Items)/2)
+// Returns a fingerprint of the receipt's contents, identical for receipts that only differ in the user,
+// letter case or whitespace in text, or the order of items
+func (r *Receipt) Fingerprint() string {
+	items := make([]string, len(r.Items))
+	for i, item := range r.Items {
+		items[i] = normalizeText(item.ShortDescription) + "\x1f" + item.Price.String()
 
-	// Trimmed description rule
-	for _, item := range r.Items {
-		trimmed := strings.TrimSpace(item.ShortDescription)
-		if len(trimmed)%3 == 0 && len(trimmed) > 0 {
-			priceAmt, _ := strconv.ParseFloat(item.Price, 64)
-			totalPoints += int64(math.Ceil(priceAmt * 0.2))
+		// Optional properties are only added when set so fingerprints from before they existed still match
+		if item.Quantity != nil {
+			items[i] += fmt.Sprintf("\x1fquantity=%v", *item.Quantity)
+		}
+		if item.UnitPrice != nil {
+			items[i] += "\x1funitPrice=" + item.UnitPrice.String()
+		}
+		if item.SKU != "" {
+			items[i] += "\x1fsku=" + item.SKU
+		}
+		if item.UPC != "" {
+			items[i] += "\x1fupc=" + item.UPC
+		}
+		if item.Discount {
+			items[i] += "\x1fdiscount"
 		}
 	}
+	sort.Strings(items)
+
+	fields := append([]string{normalizeText(r.Retailer), r.Total.String(), r.PurchaseDate, r.PurchaseTime}, items...)
 
-	// Odd day rule
-	d, _ := time.Parse(DateFormat, r.PurchaseDate)
-	if d.Day()%2 != 0 {
-		totalPoints += 6
+	// Optional properties are only added when set, like those of items
+	if r.Subtotal != nil {
+		fields = append(fields, "subtotal="+r.Subtotal.String())
+	}
+	if r.Tax != nil {
+		fields = append(fields, "tax="+r.Tax.String())
+	}
+	if r.Tip != nil {
+		fields = append(fields, "tip="+r.Tip.String())
 	}
 
-	// 2-4 PM rule
-	t, _ := time.Parse(TimeFormat, r.PurchaseTime)
-	twoPM, _ := time.Parse(TimeFormat, "14:00")
-	fourPM, _ := time.Parse(TimeFormat, "16:00")
-	if t.After(twoPM) && t.Before(fourPM) {
-		totalPoints += 10
+	// Left out for the default currency so fingerprints from before currencies were supported still match
+	if r.CurrencyCode() != DefaultCurrency {
+		fields = append(fields, "currency="+r.CurrencyCode())
+	}
+	if r.TimeZone != "" {
+		fields = append(fields, "timeZone="+r.TimeZone)
 	}
 
-	return totalPoints + bonusPoints
+	// Separators can't appear in valid fields, so different receipts can't produce the same input
+	h := sha256.New()
+	for _, field := range fields {
+		h.Write([]byte(field))
+		h.Write([]byte{0x1e})
+	}
 
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Lowercases text and collapses runs of whitespace, trimming it from either end
+func normalizeText(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// Calculates the points based on the receipt details using the default rule set
+// Assumes properties are valid, invalid amounts are scored as if they were 0.00
+func (r *Receipt) CalculatePoints(bonusPoints int64) int64 {
+	return DefaultRuleSet().Score(r) + bonusPoints
 }
 
-// Same method as above but with print statements, for debugging
-func (r *Receipt) CalculatePointsVerbose() int64 {
+// Same method as above but logs the reason for every rule that fired, for debugging
+func (r *Receipt) CalculatePointsVerbose(bonusPoints int64) int64 {
 
 	totalPoints := int64(0)
+	for _, result := range DefaultRuleSet().Evaluate(r) {
+		log.Printf("%v +%v", result.Reason, result.Points)
+		totalPoints += result.Points
+	}
 
-	// Retailer alphanum rule
-	addition := int64(0)
-	for _, r := range r.Retailer {
-		if unicode.IsDigit(r) || unicode.IsLetter(r) {
-			addition += 1
-		}
+	if bonusPoints != 0 {
+		log.Printf("Bonus points +%v", bonusPoints)
 	}
 
-	log.Printf("%v alphanum chars +%v", r.Retailer, addition)
-	totalPoints += addition
+	return totalPoints + bonusPoints
+}
+
+// Describes the response structure for the `ProcessReceipt` endpoint
+type ProcessReceiptResponse struct {
+	Id string `json:"id"`
+}
+
+// Statuses of a job processing a receipt in the background
+const (
+	JobStatusPending = "pending"
+	JobStatusDone    = "done"
+	JobStatusFailed  = "failed"
+)
+
+// Describes a job processing a receipt in the background
+// Returned by the `ProcessReceipt` endpoint when processing is deferred, and by the `GetJob` endpoint
+type Job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// Set once the job is done, the ID the receipt was stored under
+	ReceiptID string `json:"receiptId,omitempty"`
+
+	// Set if the job failed, why the receipt wasn't processed
+	Error *ErrorResponse `json:"error,omitempty"`
+
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// Describes the response structure for the `ProcessReceiptBatch` endpoint
+type ProcessReceiptBatchResponse struct {
+	// One result per receipt, in the order they were sent
+	Results []BatchReceiptResult `json:"results"`
+
+	// Number of results with an ID and with an error
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+}
+
+// Describes the outcome of one receipt in a batch, either the ID it was stored under or why it wasn't processed
+type BatchReceiptResult struct {
+	Index int            `json:"index"`
+	ID    string         `json:"id,omitempty"`
+	Error *ErrorResponse `json:"error,omitempty"`
+}
+
+// Describes a processed receipt along with the points it was awarded
+type ReceiptRecord struct {
+	ID             string       `json:"id"`
+	Receipt        Receipt      `json:"receipt"`
+	Points         int64        `json:"points"`
+	Breakdown      []RuleResult `json:"breakdown"`
+	RuleSetVersion string       `json:"ruleSetVersion"`
+	ProcessedAt    time.Time    `json:"processedAt"`
+
+	// When the awarded points expire, or nil if they never do
+	PointsExpireAt *time.Time `json:"pointsExpireAt,omitempty"`
+
+	// See `Receipt.Fingerprint`
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Instant of purchase in UTC, or nil if the receipt doesn't have a time zone
+	PurchasedAt *time.Time `json:"purchasedAt,omitempty"`
+
+	// When the receipt was voided and why, or nil if it wasn't. A voided receipt's points are debited, see `VoidDebit`
+	VoidedAt   *time.Time `json:"voidedAt,omitempty"`
+	VoidReason string     `json:"voidReason,omitempty"`
+}
 
-	// Parse total
-	s := dollarAmtRgx.FindString(r.Total)
-	parts := strings.Split(s, ".")
-	// dollars, _ := strconv.Atoi(parts[0])
-	cents, _ := strconv.Atoi(parts[1])
+// Describes which receipts to list, where every field left empty matches any receipt
+type ReceiptFilter struct {
+	UserID string
+
+	// Matches retailers containing it, ignoring letter case
+	Retailer string
+
+	// Purchase dates, formatted like `DateFormat`, both inclusive
+	PurchaseDateFrom string
+	PurchaseDateTo   string
+
+	// Points awarded, both inclusive
+	MinPoints *int64
+	MaxPoints *int64
+
+	// When the receipt was processed, from inclusive and to exclusive
+	ProcessedFrom *time.Time
+	ProcessedTo   *time.Time
+}
 
-	// Round dollar rule
-	if cents == 0 {
-		log.Printf("%v is a round dollar amount +50", r.Total)
-		totalPoints += 50
+// Returns true if the record matches every field of the filter
+func (f *ReceiptFilter) Matches(record *ReceiptRecord) bool {
+	r := &record.Receipt
+	switch {
+	case f.UserID != "" && r.UserID != f.UserID:
+		return false
+	case f.Retailer != "" && !strings.Contains(strings.ToLower(r.Retailer), strings.ToLower(f.Retailer)):
+		return false
+	case f.PurchaseDateFrom != "" && r.PurchaseDate < f.PurchaseDateFrom:
+		return false
+	case f.PurchaseDateTo != "" && r.PurchaseDate > f.PurchaseDateTo:
+		return false
+	case f.MinPoints != nil && record.Points < *f.MinPoints:
+		return false
+	case f.MaxPoints != nil && record.Points > *f.MaxPoints:
+		return false
+	case f.ProcessedFrom != nil && record.ProcessedAt.Before(*f.ProcessedFrom):
+		return false
+	case f.ProcessedTo != nil && !record.ProcessedAt.Before(*f.ProcessedTo):
+		return false
 	}
 
-	// Multiple of 0.25 rule
-	if cents%25 == 0 {
-		log.Printf("%v is a multiple of 0.25 +50", r.Total)
-		totalPoints += 25
+	return true
+}
+
+// Describes where a receipt falls in the order receipts are listed in: by when they were processed, then by ID
+// The zero value comes before every receipt
+type ReceiptPosition struct {
+	ProcessedAt time.Time
+	ID          string
+}
+
+// Returns the position of the record
+func (record *ReceiptRecord) Position() ReceiptPosition {
+	return ReceiptPosition{ProcessedAt: record.ProcessedAt, ID: record.ID}
+}
+
+// Returns true if the position comes before the other one
+func (p ReceiptPosition) Before(other ReceiptPosition) bool {
+	if !p.ProcessedAt.Equal(other.ProcessedAt) {
+		return p.ProcessedAt.Before(other.ProcessedAt)
 	}
 
-	// Every 2 items rule
-	addition = 5 * int64(len(r.Items)/2)
-	log.Printf("For every two items +%v", addition)
-	totalPoints += addition
+	return p.ID < other.ID
+}
 
-	// Trimmed description rule
-	for _, item := range r.Items {
-		trimmed := strings.TrimSpace(item.ShortDescription)
-		if len(trimmed)%3 == 0 && len(trimmed) > 0 {
-			priceAmt, _ := strconv.ParseFloat(item.Price, 64)
-			addition := int64(math.Ceil(priceAmt * 0.2))
+// Kinds of ledger entries
+const (
+	// Points awarded by the rules for a processed receipt
+	LedgerEntryReceipt = "receipt"
+
+	// Bonus points awarded for one of a user's first receipts
+	LedgerEntryBonus = "bonus"
+
+	// Points spent by the user
+	LedgerEntryRedemption = "redemption"
 
-			log.Printf("%v trimmed len is multiple of 3 +%v", item.ShortDescription, addition)
-			totalPoints += addition
+	// Points that went unspent past their expiry
+	LedgerEntryExpiry = "expiry"
+
+	// Points taken back because the receipt they were awarded for was voided
+	LedgerEntryVoid = "void"
+
+	// Points credited or taken back because the receipt they were awarded for was rescored with different rules
+	LedgerEntryRescore = "rescore"
+)
+
+// Describes a single change to a user's points balance
+type LedgerEntry struct {
+	// Position of the entry in the user's ledger, starting at 1
+	Seq    int64  `json:"seq"`
+	UserID string `json:"userId"`
+	Kind   string `json:"kind"`
+
+	// Positive for credits, negative for debits
+	Amount int64 `json:"amount"`
+
+	// The user's balance after this entry
+	Balance     int64     `json:"balance"`
+	ReceiptID   string    `json:"receiptId,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	// Client supplied key that makes retrying the request that created the entry safe
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// When the points of a credit expire, or nil if they never do
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Returns the ledger credits for a newly processed receipt: one for the points awarded by the rules,
+// plus one for the bonus if there was one. `Seq` and `Balance` are left for the store to fill in
+func (record *ReceiptRecord) LedgerCredits() []LedgerEntry {
+	bonus := int64(0)
+	for _, result := range record.Breakdown {
+		if result.Rule == ReceiptBonusName {
+			bonus += result.Points
 		}
 	}
 
-	// Odd day rule
-	d, _ := time.Parse(DateFormat, r.PurchaseDate)
-	if d.Day()%2 != 0 {
-		log.Printf("%v contains an odd day +6", r.PurchaseDate)
-		totalPoints += 6
+	credits := []LedgerEntry{{
+		UserID:    record.Receipt.UserID,
+		Kind:      LedgerEntryReceipt,
+		Amount:    record.Points - bonus,
+		ReceiptID: record.ID,
+		CreatedAt: record.ProcessedAt,
+		ExpiresAt: record.PointsExpireAt,
+	}}
+
+	if bonus != 0 {
+		credits = append(credits, LedgerEntry{
+			UserID:    record.Receipt.UserID,
+			Kind:      LedgerEntryBonus,
+			Amount:    bonus,
+			ReceiptID: record.ID,
+			CreatedAt: record.ProcessedAt,
+			ExpiresAt: record.PointsExpireAt,
+		})
 	}
 
-	// 2-4 PM rule
-	t, _ := time.Parse(TimeFormat, r.PurchaseTime)
-	twoPM, _ := time.Parse(TimeFormat, "14:00")
-	fourPM, _ := time.Parse(TimeFormat, "18:00")
-	if t.After(twoPM) && t.Before(fourPM) {
-		log.Printf("%v is between 2 and 4 +10", r.PurchaseTime)
-		totalPoints += 10
+	return credits
+}
+
+// Returns the ledger debit taking back the points awarded for a voided receipt, bonus included, given the user's ledger
+// Points that were already spent or expired are left alone, see `UnspentReceiptPoints`, so the balance can't go negative
+// `Seq` and `Balance` are left for the store to fill in
+func (record *ReceiptRecord) VoidDebit(ledger []LedgerEntry) LedgerEntry {
+	return LedgerEntry{
+		UserID:      record.Receipt.UserID,
+		Kind:        LedgerEntryVoid,
+		Amount:      -min(record.Points, UnspentReceiptPoints(ledger, record.ID)),
+		ReceiptID:   record.ID,
+		Description: "Receipt voided: " + record.VoidReason,
+		CreatedAt:   *record.VoidedAt,
 	}
+}
 
-	return totalPoints
+// Returns the ledger entry crediting or debiting the difference in points when the receipt is rescored as `rescored`,
+// given the user's ledger. Credits expire along with the receipt's points, and debits take back no more than the
+// receipt's unspent points, see `UnspentReceiptPoints`. `Seq` and `Balance` are left for the store to fill in
+func (record *ReceiptRecord) RescoreAdjustment(rescored *ReceiptRecord, at time.Time, ledger []LedgerEntry) LedgerEntry {
+	entry := LedgerEntry{
+		UserID:      record.Receipt.UserID,
+		Kind:        LedgerEntryRescore,
+		Amount:      rescored.Points - record.Points,
+		ReceiptID:   record.ID,
+		Description: fmt.Sprintf("Receipt rescored with rules %v", rescored.RuleSetVersion),
+		CreatedAt:   at,
+	}
+	if entry.Amount > 0 {
+		entry.ExpiresAt = record.PointsExpireAt
+	} else {
+		entry.Amount = -min(-entry.Amount, UnspentReceiptPoints(ledger, record.ID))
+	}
 
+	return entry
 }
 
-// Describes the response structure for the `ProcessReceipt` endpoint
-type ProcessReceiptResponse struct {
-	Id string `json:"id"`
+// Describes the response structure for the `GetReceipt` endpoint
+type GetReceiptResponse struct {
+	ID string `json:"id"`
+	Receipt
+	Points         int64     `json:"points"`
+	RuleSetVersion string    `json:"ruleSetVersion"`
+	ProcessedAt    time.Time `json:"processedAt"`
+
+	// See `ReceiptRecord.PurchasedAt`
+	PurchasedAt *time.Time `json:"purchasedAt,omitempty"`
+
+	// See `ReceiptRecord.VoidedAt`
+	VoidedAt   *time.Time `json:"voidedAt,omitempty"`
+	VoidReason string     `json:"voidReason,omitempty"`
+}
+
+// Describes the response structure for the `ListReceipts` endpoint
+type ListReceiptsResponse struct {
+	Receipts []GetReceiptResponse `json:"receipts"`
+
+	// Pass as the `cursor` query parameter to get the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
 }
 
 // Describes the response structure for the `GetPoints` endpoint
 type GetPointsResponse struct {
-	Points int64 `json:"points"`
+	Points         int64  `json:"points"`
+	RuleSetVersion string `json:"ruleSetVersion,omitempty"`
+
+	// Set if the receipt was voided, in which case `Points` were debited again
+	Voided     bool       `json:"voided,omitempty"`
+	VoidedAt   *time.Time `json:"voidedAt,omitempty"`
+	VoidReason string     `json:"voidReason,omitempty"`
+}
+
+// Describes the response structure for the `GetPointsBreakdown` endpoint
+type GetPointsBreakdownResponse struct {
+	Points         int64        `json:"points"`
+	Breakdown      []RuleResult `json:"breakdown"`
+	RuleSetVersion string       `json:"ruleSetVersion,omitempty"`
+}
+
+// Describes the response structure for the `GetUserPoints` endpoint
+type GetUserPointsResponse struct {
+	UserID  string `json:"userId"`
+	Balance int64  `json:"balance"`
+}
+
+// Describes the response structure for the `GetUserLedger` endpoint
+type GetUserLedgerResponse struct {
+	UserID  string        `json:"userId"`
+	Entries []LedgerEntry `json:"entries"`
+
+	// Pass as the `cursor` query parameter to get the next page, empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Describes the response structure for the `GetUserExpiringPoints` endpoint
+type GetUserExpiringPointsResponse struct {
+	UserID string `json:"userId"`
+	Days   int    `json:"days"`
+
+	// Total of `Expiring`
+	Points   int64            `json:"points"`
+	Expiring []ExpiringPoints `json:"expiring"`
+}
+
+// Describes the request structure for the `CreateRedemption` endpoint
+type CreateRedemptionRequest struct {
+	Points      int64  `json:"points"`
+	Description string `json:"description"`
+}
+
+// Describes the request structure for the `VoidReceipt` endpoint
+type VoidReceiptRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Describes the response structure for the `VoidReceipt` endpoint
+type VoidReceiptResponse struct {
+	ID         string    `json:"id"`
+	VoidedAt   time.Time `json:"voidedAt"`
+	VoidReason string    `json:"voidReason"`
+
+	// Ledger entry taking back the receipt's points
+	Debit LedgerEntry `json:"debit"`
+}
+
+// Describes a structured error response, in the style of RFC 7807 (application/problem+json)
+type ErrorResponse struct {
+	// Machine-readable code identifying the kind of error
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+
+	// Set for `insufficient-balance` errors
+	Balance   *int64 `json:"balance,omitempty"`
+	Requested *int64 `json:"requested,omitempty"`
+
+	// Set for `duplicate-receipt` errors, the ID of the receipt that was processed first
+	ReceiptID string `json:"receiptId,omitempty"`
+
+	// Set for `invalid-receipt` errors, every field that is invalid
+	Errors ValidationErrors `json:"errors,omitempty"`
+}
+
+// Describes the response structure for the `ReloadRules` endpoint
+type ReloadRulesResponse struct {
+	Version string   `json:"version"`
+	Rules   []string `json:"rules"`
+}
+
+// Describes the request structure for the `RescoreReceipts` endpoint
+type RescoreReceiptsRequest struct {
+	// Version of the rule set to score with, the active one if empty
+	RuleSetVersion string `json:"ruleSetVersion,omitempty"`
+
+	// Only rescores the user's receipts if set
+	UserID string `json:"userId,omitempty"`
+
+	// Saves the new scores and adjusts the ledgers when true, otherwise only reports what would change
+	Apply bool `json:"apply"`
+}
+
+// Describes how rescoring one receipt changes its points
+type ReceiptRescore struct {
+	ID                string `json:"id"`
+	UserID            string `json:"userId"`
+	OldRuleSetVersion string `json:"oldRuleSetVersion"`
+	OldPoints         int64  `json:"oldPoints"`
+	NewPoints         int64  `json:"newPoints"`
+	Delta             int64  `json:"delta"`
+}
+
+// Describes how rescoring a user's receipts changes their points in total
+type UserRescore struct {
+	UserID    string `json:"userId"`
+	Receipts  int    `json:"receipts"`
+	OldPoints int64  `json:"oldPoints"`
+	NewPoints int64  `json:"newPoints"`
+	Delta     int64  `json:"delta"`
+}
+
+// Describes the result of rescoring receipts with a rule set, listing only the receipts and users whose points change
+type RescoreReport struct {
+	RuleSetVersion string `json:"ruleSetVersion"`
+
+	// True if the new scores were saved and the ledgers adjusted
+	Applied bool `json:"applied"`
+
+	// Receipts rescored, and how many of them had their points changed
+	Examined int `json:"examined"`
+	Changed  int `json:"changed"`
+
+	// Voided receipts, which are left as they are since their points were already taken back
+	SkippedVoided int `json:"skippedVoided"`
+
+	// Receipts the rule set can't convert to its base currency, having no exchange rate for theirs or amounts too large
+	// once converted, which are left as they are since they can't be scored
+	SkippedUnconvertible int `json:"skippedUnconvertible"`
+
+	Delta    int64            `json:"delta"`
+	Receipts []ReceiptRescore `json:"receipts"`
+	Users    []UserRescore    `json:"users"`
 }
@@ -0,0 +1,281 @@
+/**
+money.go
+
+Describes an exact amount of money, stored as a whole number of minor units (e.g. cents) so that scoring never
+depends on floating-point rounding
+*/
+
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Most decimal places an amount can have, the most any ISO 4217 currency uses
+const maxMoneyExponent = 4
+
+// Most significant digits an amount can have, which keeps amounts to realistic sizes
+const maxMoneyDigits = 15
+
+// Returned by arithmetic whose result is too large to represent
+var ErrMoneyOverflow = errors.New("amount is too large")
+
+// Regex for a decimal amount, capturing the sign, whole and fractional parts
+var moneyRgx = regexp.MustCompile(fmt.Sprintf(`^(-?)(\d+)(?:\.(\d{1,%d}))?$`, maxMoneyExponent))
+
+// Describes an amount of money as a whole number of minor units, along with how many decimal places they have
+// The zero value is a missing amount, use `NewMoney` or `ParseMoney` to create one
+type Money struct {
+	units    int64
+	exponent int
+
+	// Whether the amount was given at all
+	set bool
+
+	// Text of an amount that couldn't be parsed, kept so validation can report it
+	invalid string
+
+	// JSON kind of an amount that wasn't given as a string, e.g. number
+	invalidKind string
+}
+
+// Returns the amount of `units` minor units with `exponent` decimal places, e.g. `NewMoney(649, 2)` is 6.49
+func NewMoney(units int64, exponent int) Money {
+	return Money{units: units, exponent: exponent, set: true}
+}
+
+// Returns the amount for the given number of cents
+func MoneyFromCents(cents int64) Money {
+	return NewMoney(cents, 2)
+}
+
+// Parses a decimal amount with up to 4 decimal places and 15 significant digits, e.g. 6.49, 1500 or -0.50
+// The number of decimal places is kept, see `Money.Exponent`
+func ParseMoney(s string) (Money, error) {
+	match := moneyRgx.FindStringSubmatch(s)
+	if match == nil {
+		return Money{}, fmt.Errorf("%q is not a decimal amount", s)
+	}
+
+	if len(strings.TrimLeft(match[2]+match[3], "0")) > maxMoneyDigits {
+		return Money{}, fmt.Errorf("%q has more than %v significant digits", s, maxMoneyDigits)
+	}
+
+	units, err := strconv.ParseInt(match[1]+match[2]+match[3], 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%q is too large", s)
+	}
+
+	return NewMoney(units, len(match[3])), nil
+}
+
+// Same as `ParseMoney` but panics if the amount is invalid, for amounts known ahead of time
+func MustParseMoney(s string) Money {
+	m, err := ParseMoney(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// Returns the amount written as the given text, the same way it would be decoded from JSON
+// Text that isn't a valid amount is kept as is and reported by `Receipt.ValidateProperties`, an empty string is missing
+func MoneyFromString(s string) Money {
+	if s == "" {
+		return Money{}
+	}
+
+	m, err := ParseMoney(s)
+	if err != nil {
+		return Money{set: true, invalid: s}
+	}
+
+	return m
+}
+
+// Returns true if the amount was given, even if it's invalid
+func (m Money) IsSet() bool {
+	return m.set
+}
+
+// Returns true if the amount was given and is a valid decimal amount
+func (m Money) IsValid() bool {
+	return m.set && m.invalid == ""
+}
+
+// Returns the amount in minor units, see `Money.Exponent`
+func (m Money) MinorUnits() int64 {
+	return m.units
+}
+
+// Returns the number of decimal places of the amount's minor units
+func (m Money) Exponent() int {
+	return m.exponent
+}
+
+// Returns -1, 0 or 1 if the amount is negative, zero or positive
+func (m Money) Sign() int {
+	return m.Cmp(NewMoney(0, 0))
+}
+
+// Returns the amount formatted with its decimal places, e.g. 6.49
+// Invalid amounts are returned as they were written
+func (m Money) String() string {
+	if m.invalid != "" {
+		return m.invalid
+	}
+
+	// The magnitude is taken as unsigned so the most negative amount doesn't overflow
+	sign, units := "", uint64(m.units)
+	if m.units < 0 {
+		sign, units = "-", -units
+	}
+
+	if m.exponent == 0 {
+		return fmt.Sprintf("%v%d", sign, units)
+	}
+
+	scale := uint64(pow10(m.exponent))
+	return fmt.Sprintf("%v%d.%0*d", sign, units/scale, m.exponent, units%scale)
+}
+
+// Returns the amount in minor units with the given number of decimal places, which must be at least `m.Exponent()`
+// Computed exactly, since aligning a large amount to more decimal places can overflow an int64
+func (m Money) unitsAt(exponent int) *big.Int {
+	return new(big.Int).Mul(big.NewInt(m.units), big.NewInt(pow10(exponent-m.exponent)))
+}
+
+// Returns both amounts in minor units with the same number of decimal places, along with that number
+func alignMoney(a Money, b Money) (*big.Int, *big.Int, int) {
+	exponent := max(a.exponent, b.exponent)
+	return a.unitsAt(exponent), b.unitsAt(exponent), exponent
+}
+
+// Returns the amount of `units` minor units with `exponent` decimal places, or `ErrMoneyOverflow` if it doesn't fit
+func moneyFromBig(units *big.Int, exponent int) (Money, error) {
+	if !units.IsInt64() {
+		return Money{}, ErrMoneyOverflow
+	}
+
+	return NewMoney(units.Int64(), exponent), nil
+}
+
+// Returns the sum of both amounts, with the larger number of decimal places
+// Returns `ErrMoneyOverflow` if the sum is too large to represent
+func (m Money) Add(other Money) (Money, error) {
+	a, b, exponent := alignMoney(m, other)
+	return moneyFromBig(a.Add(a, b), exponent)
+}
+
+// Returns the difference of both amounts, with the larger number of decimal places
+// Returns `ErrMoneyOverflow` if the difference is too large to represent
+func (m Money) Sub(other Money) (Money, error) {
+	a, b, exponent := alignMoney(m, other)
+	return moneyFromBig(a.Sub(a, b), exponent)
+}
+
+// Returns the amount multiplied by a whole number
+// Returns `ErrMoneyOverflow` if the product is too large to represent
+func (m Money) Mul(n int64) (Money, error) {
+	return moneyFromBig(new(big.Int).Mul(big.NewInt(m.units), big.NewInt(n)), m.exponent)
+}
+
+// Returns -1, 0 or 1 if the amount is less than, equal to or greater than the other
+func (m Money) Cmp(other Money) int {
+	a, b, _ := alignMoney(m, other)
+	return a.Cmp(b)
+}
+
+// Returns true if the amount is a whole multiple of `step`, e.g. 9.00 is a multiple of 0.25
+func (m Money) IsMultipleOf(step Money) bool {
+	a, b, _ := alignMoney(m, step)
+	return b.Sign() != 0 && new(big.Int).Rem(a, b).Sign() == 0
+}
+
+// Returns the amount as an exact fraction of whole units, e.g. 6.49 is 649/100
+func (m Money) rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.units), big.NewInt(pow10(m.exponent)))
+}
+
+// Returns the amount multiplied by the factor, rounded up to a whole number of units
+// The factor is taken as the shortest decimal that represents it, so 0.2 is exactly one fifth and 5.00 * 0.2 is 1
+func (m Money) MulCeil(factor float64) int64 {
+	exact, ok := new(big.Rat).SetString(strconv.FormatFloat(factor, 'g', -1, 64))
+	if !ok {
+		return 0
+	}
+
+	product := exact.Mul(exact, m.rat())
+
+	// Rat denominators are always positive, so Euclidean division rounds down
+	quotient, remainder := new(big.Int).DivMod(product.Num(), product.Denom(), new(big.Int))
+	if remainder.Sign() != 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+
+	if !quotient.IsInt64() {
+		return math.MaxInt64
+	}
+
+	return quotient.Int64()
+}
+
+// Missing amounts are encoded as null and invalid ones as they were written
+func (m Money) MarshalJSON() ([]byte, error) {
+	if !m.set {
+		return []byte("null"), nil
+	}
+
+	return json.Marshal(m.String())
+}
+
+// Amounts must be JSON strings, see `MoneyFromString`
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*m = Money{}
+		return nil
+	}
+
+	// Reported by validation rather than failing to decode, so the error has the path to the field
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		*m = Money{set: true, invalid: string(data), invalidKind: jsonKind(data)}
+		return nil
+	}
+
+	*m = MoneyFromString(s)
+	return nil
+}
+
+// Returns the kind of a JSON value for error messages
+func jsonKind(data []byte) string {
+	switch data[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "bool"
+	default:
+		return "number"
+	}
+}
+
+// Returns 10 to the power of n, for the small exponents amounts use
+func pow10(n int) int64 {
+	p := int64(1)
+	for range n {
+		p *= 10
+	}
+
+	return p
+}
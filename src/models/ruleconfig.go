@@ -0,0 +1,238 @@
+/**
+ruleconfig.go
+
+Describes the rules file format and how it is loaded into a rule set
+*/
+
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported formats for a rules file
+const (
+	RuleConfigFormatJSON = "json"
+	RuleConfigFormatYAML = "yaml"
+)
+
+// Describes a rules file
+type RuleSetConfig struct {
+	// Identifies the rule set, derived from the file contents if omitted
+	// A version must always describe the same rules, so change it whenever the rules change
+	Version string `json:"version"`
+
+	// Bonus points for a user's first, second, third... receipt
+	// Uses `DefaultBonusTiers` if omitted, an empty list disables the bonus
+	BonusTiers *[]int64 `json:"bonusTiers"`
+
+	// Active rules, applied in order
+	Rules []RuleConfig `json:"rules"`
+
+	// Checks a receipt must pass before it's scored, configured like rules
+	// Uses `DefaultValidators` if omitted, an empty list disables them
+	Validators *[]RuleConfig `json:"validators,omitempty"`
+
+	// Currency amounts are converted to before they're scored, `DefaultCurrency` if omitted
+	BaseCurrency string `json:"baseCurrency,omitempty"`
+
+	// Units of the base currency that one unit of each other currency is worth, e.g. {"CAD": 0.73}
+	// Receipts in currencies other than the base currency without a rate are rejected
+	ExchangeRates map[string]json.Number `json:"exchangeRates,omitempty"`
+}
+
+// Describes a single active rule or validator in a rules file
+type RuleConfig struct {
+	// Name the rule is registered under, see `RegisteredRules` and `RegisteredValidators`
+	Name string `json:"name"`
+
+	// Overrides for the rule's default parameters
+	Params json.RawMessage `json:"params"`
+}
+
+// Reads the rules file at the given path and builds a rule set from it
+// The format is determined by the file extension (.json, .yaml or .yml)
+func LoadRuleSet(path string) (*RuleSet, error) {
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		format = RuleConfigFormatJSON
+	case ".yaml", ".yml":
+		format = RuleConfigFormatYAML
+	default:
+		return nil, fmt.Errorf("rules file %v must have a .json, .yaml or .yml extension", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file; %v", err)
+	}
+
+	return ParseRuleSet(data, format)
+}
+
+// Builds a rule set from the contents of a rules file in the given format
+// Unknown fields, unknown rules, duplicate rules and invalid parameters are all rejected
+func ParseRuleSet(data []byte, format string) (*RuleSet, error) {
+
+	// YAML is converted to JSON first so both formats go through the same strict decoding
+	switch format {
+	case RuleConfigFormatJSON:
+	case RuleConfigFormatYAML:
+		var doc any
+		err := yaml.Unmarshal(data, &doc)
+		if err != nil {
+			return nil, fmt.Errorf("rules file is not valid YAML; %v", err)
+		}
+
+		data, err = json.Marshal(doc)
+		if err != nil {
+			return nil, fmt.Errorf("rules file can't be represented as JSON; %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rules file format %q", format)
+	}
+
+	var config RuleSetConfig
+	err := decodeStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("rules file is invalid; %v", err)
+	}
+
+	return config.Build()
+}
+
+// Builds the rule set described by the config
+func (config *RuleSetConfig) Build() (*RuleSet, error) {
+
+	if len(config.Rules) < 1 {
+		return nil, fmt.Errorf("property rules must have at least 1 rule")
+	}
+
+	bonusTiers := DefaultBonusTiers
+	if config.BonusTiers != nil {
+		bonusTiers = *config.BonusTiers
+	}
+
+	for i, bonus := range bonusTiers {
+		if bonus < 0 {
+			return nil, fmt.Errorf("property bonusTiers[%v] must not be negative", i)
+		}
+	}
+
+	rules, err := buildConfigured("rules", "rule", config.Rules, NewRule)
+	if err != nil {
+		return nil, err
+	}
+
+	validators := DefaultValidators()
+	if config.Validators != nil {
+		validators, err = buildConfigured("validators", "validator", *config.Validators, NewValidator)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	baseCurrency := config.BaseCurrency
+	if baseCurrency == "" {
+		baseCurrency = DefaultCurrency
+	}
+
+	rates := map[string]string{}
+	for currency, rate := range config.ExchangeRates {
+		rates[currency] = rate.String()
+	}
+
+	exchangeRates, err := NewExchangeRates(baseCurrency, rates)
+	if err != nil {
+		return nil, fmt.Errorf("property exchangeRates: %v", err)
+	}
+
+	// Re-encoding the config normalizes formatting, so only meaningful changes affect the digest
+	normalized, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize rules config; %v", err)
+	}
+
+	sum := sha256.Sum256(normalized)
+	digest := hex.EncodeToString(sum[:])
+
+	version := config.Version
+	if version == "" {
+		version = "sha256-" + digest[:12]
+	}
+
+	return &RuleSet{
+		Version:       version,
+		Digest:        digest,
+		Rules:         rules,
+		BonusTiers:    bonusTiers,
+		Validators:    validators,
+		ExchangeRates: exchangeRates,
+	}, nil
+}
+
+// Creates a rule or validator for every config, in order, with its parameters decoded over its defaults
+// `property` and `kind` name the configs in error messages
+func buildConfigured[T interface{ Validate() error }](property string, kind string, configs []RuleConfig,
+	construct func(name string) (T, error)) ([]T, error) {
+
+	seen := map[string]bool{}
+	built := make([]T, 0, len(configs))
+	for i, config := range configs {
+		if seen[config.Name] {
+			return nil, fmt.Errorf("%v[%v]: %v %q is listed more than once", property, i, kind, config.Name)
+		}
+		seen[config.Name] = true
+
+		v, err := construct(config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%v[%v]: %v", property, i, err)
+		}
+
+		// Parameters are decoded over the defaults, so omitted ones keep their default value
+		if len(config.Params) > 0 && !bytes.Equal(config.Params, []byte("null")) {
+			err = decodeStrict(config.Params, v)
+			if err != nil {
+				return nil, fmt.Errorf("%v[%v]: invalid params for %v %q; %v", property, i, kind, config.Name, err)
+			}
+		}
+
+		err = v.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("%v[%v]: invalid params for %v %q; %v", property, i, kind, config.Name, err)
+		}
+
+		built = append(built, v)
+	}
+
+	return built, nil
+}
+
+// Decodes a single JSON value into v, rejecting unknown fields and trailing data
+func decodeStrict(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = decoder.Token()
+	if err != io.EOF {
+		return fmt.Errorf("unexpected data after the top-level value")
+	}
+
+	return nil
+}
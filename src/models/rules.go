@@ -0,0 +1,529 @@
+/**
+rules.go
+
+Describes the scoring rules applied to receipts along with a registry of the built-in rules
+*/
+
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Names of the built-in rules, in the order they are applied by default
+const (
+	RetailerAlphanumericRuleName = "retailerAlphanumeric"
+	RoundDollarRuleName          = "roundDollar"
+	QuarterMultipleRuleName      = "quarterMultiple"
+	ItemPairsRuleName            = "itemPairs"
+	DescriptionLengthRuleName    = "descriptionLength"
+	OddDayRuleName               = "oddDay"
+	AfternoonRuleName            = "afternoon"
+)
+
+// Amounts money-based rules can score on
+const (
+	ScoreOnTotal    = "total"
+	ScoreOnSubtotal = "subtotal"
+)
+
+// Name used for the per-user receipt bonus in a points breakdown
+// The bonus isn't a rule since it depends on the user's history rather than the receipt
+const ReceiptBonusName = "receiptBonus"
+
+// Describes the points awarded by a single rule, along with a human-readable reason
+type RuleResult struct {
+	Rule   string `json:"rule"`
+	Points int64  `json:"points"`
+	Reason string `json:"reason"`
+}
+
+// Describes a single scoring rule
+// Rules assume the receipt properties are valid, see `Receipt.ValidateProperties`
+type Rule interface {
+	// Returns the name the rule is registered under
+	Name() string
+
+	// Returns an error if the rule's parameters are invalid
+	Validate() error
+
+	// Returns one result per award the rule makes for the receipt, or nothing if the rule didn't fire
+	Apply(r *Receipt) []RuleResult
+}
+
+// Bonus points awarded for a user's first, second and third receipts by default
+var DefaultBonusTiers = []int64{1000, 500, 250}
+
+// Version of the built-in rule set
+const DefaultRuleSetVersion = "builtin"
+
+// Describes an ordered set of rules used to score a receipt, along with the per-user receipt bonus
+type RuleSet struct {
+	// Identifies the rule set so a score can be traced back to the rules that produced it
+	Version string
+
+	// Hash of the configuration the rule set was built from, empty for rule sets built in code
+	Digest string
+
+	Rules []Rule
+
+	// Bonus points for a user's nth receipt (0-indexed), receipts past the last tier earn no bonus
+	BonusTiers []int64
+
+	// Checks a receipt must pass before it's scored
+	Validators []Validator
+
+	// Converts receipt amounts to the base currency before they're scored, `DefaultExchangeRates` if nil
+	ExchangeRates *ExchangeRates
+}
+
+// Creates a rule set applying the given rules in order with the default bonus tiers and validators
+func NewRuleSet(rules ...Rule) *RuleSet {
+	return &RuleSet{
+		Version:       DefaultRuleSetVersion,
+		Rules:         rules,
+		BonusTiers:    DefaultBonusTiers,
+		Validators:    DefaultValidators(),
+		ExchangeRates: DefaultExchangeRates(),
+	}
+}
+
+// Returns the exchange rates amounts are converted with
+func (rs *RuleSet) exchangeRates() *ExchangeRates {
+	if rs.ExchangeRates == nil {
+		return DefaultExchangeRates()
+	}
+
+	return rs.ExchangeRates
+}
+
+// Returns a copy of the receipt with its amounts converted to the base currency the rules score in
+// Returns an error if there's no exchange rate for its currency, or `ErrMoneyOverflow` if an amount is too large
+func (rs *RuleSet) ToBase(r *Receipt) (*Receipt, error) {
+	return rs.exchangeRates().ToBase(r)
+}
+
+// Returns the names of the rules in the set, in order
+func (rs *RuleSet) RuleNames() []string {
+	names := make([]string, 0, len(rs.Rules))
+	for _, rule := range rs.Rules {
+		names = append(names, rule.Name())
+	}
+
+	return names
+}
+
+// Returns the bonus points for a user that has already had `timesProcessed` receipts processed
+func (rs *RuleSet) Bonus(timesProcessed int64) int64 {
+	if timesProcessed < 0 || timesProcessed >= int64(len(rs.BonusTiers)) {
+		return 0
+	}
+
+	return rs.BonusTiers[timesProcessed]
+}
+
+// Returns a `ValidationErrors` listing every problem the validators found with the receipt, or nil if there were none
+// The receipt properties must already be valid
+func (rs *RuleSet) CheckReceipt(r *Receipt, now time.Time) error {
+	var errs ValidationErrors
+	rates := rs.exchangeRates()
+	if !rates.Supports(r.CurrencyCode()) {
+		errs.add("currency", ValidationUnsupportedCurrency,
+			fmt.Sprintf("currency %v isn't accepted, there is no exchange rate to %v", r.CurrencyCode(), rates.Base))
+	} else if _, err := rates.ToBase(r); err != nil {
+		errs.add("currency", ValidationOutOfRange,
+			fmt.Sprintf("amounts in %v are too large to convert to %v", r.CurrencyCode(), rates.Base))
+	}
+
+	for _, validator := range rs.Validators {
+		errs = append(errs, validator.Check(r, now)...)
+	}
+
+	return errs.orNil()
+}
+
+// Returns the results of every rule that fired for the receipt, in rule order
+// Amounts are converted to the base currency first. Receipts that can't be converted are rejected by `CheckReceipt`,
+// and are scored as they are if they get here anyway
+func (rs *RuleSet) Evaluate(r *Receipt) []RuleResult {
+	if converted, err := rs.ToBase(r); err == nil {
+		r = converted
+	}
+
+	results := []RuleResult{}
+	for _, rule := range rs.Rules {
+		results = append(results, rule.Apply(r)...)
+	}
+
+	return results
+}
+
+// Returns a copy of the processed receipt scored by this rule set instead of the one it was processed with
+// The bonus the receipt earned is kept as it was, since it depends on how many of the user's receipts came before it
+func (rs *RuleSet) Rescore(record *ReceiptRecord) *ReceiptRecord {
+	breakdown := rs.Evaluate(&record.Receipt)
+	for _, result := range record.Breakdown {
+		if result.Rule == ReceiptBonusName {
+			breakdown = append(breakdown, result)
+		}
+	}
+
+	rescored := *record
+	rescored.Points = 0
+	rescored.Breakdown = breakdown
+	rescored.RuleSetVersion = rs.Version
+	for _, result := range breakdown {
+		rescored.Points += result.Points
+	}
+
+	return &rescored
+}
+
+// Returns the sum of the points awarded by every rule for the receipt
+func (rs *RuleSet) Score(r *Receipt) int64 {
+	totalPoints := int64(0)
+	for _, result := range rs.Evaluate(r) {
+		totalPoints += result.Points
+	}
+
+	return totalPoints
+}
+
+// Registry of rule constructors, keyed by rule name
+// Each constructor returns the rule configured with its default parameters
+var (
+	ruleRegistry = map[string]func() Rule{}
+	defaultRules []string
+)
+
+func init() {
+	registerDefaultRule(RetailerAlphanumericRuleName, func() Rule { return &RetailerAlphanumericRule{PointsPerChar: 1} })
+	registerDefaultRule(RoundDollarRuleName, func() Rule { return &RoundDollarRule{Points: 50, Amount: ScoreOnTotal} })
+	registerDefaultRule(QuarterMultipleRuleName, func() Rule { return &QuarterMultipleRule{Points: 25, Amount: ScoreOnTotal} })
+	registerDefaultRule(ItemPairsRuleName, func() Rule { return &ItemPairsRule{PointsPerPair: 5} })
+	registerDefaultRule(DescriptionLengthRuleName, func() Rule { return &DescriptionLengthRule{LengthMultiple: 3, PriceMultiplier: 0.2} })
+	registerDefaultRule(OddDayRuleName, func() Rule { return &OddDayRule{Points: 6} })
+	registerDefaultRule(AfternoonRuleName, func() Rule { return &AfternoonRule{Points: 10, Start: "14:00", End: "16:00"} })
+}
+
+func registerDefaultRule(name string, constructor func() Rule) {
+	RegisterRule(name, constructor)
+	defaultRules = append(defaultRules, name)
+}
+
+// Registers a rule constructor under the given name
+// Panics if a rule is already registered under that name, since that's a programming error
+func RegisterRule(name string, constructor func() Rule) {
+	if _, ok := ruleRegistry[name]; ok {
+		panic(fmt.Sprintf("rule %q is already registered", name))
+	}
+
+	ruleRegistry[name] = constructor
+}
+
+// Returns a new instance of the rule registered under the given name
+func NewRule(name string) (Rule, error) {
+	constructor, ok := ruleRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("no rule registered with name %q", name)
+	}
+
+	return constructor(), nil
+}
+
+// Returns the names of all registered rules, sorted
+func RegisteredRules() []string {
+	names := make([]string, 0, len(ruleRegistry))
+	for name := range ruleRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns a rule set containing every built-in rule with its default parameters
+func DefaultRuleSet() *RuleSet {
+	rules := make([]Rule, 0, len(defaultRules))
+	for _, name := range defaultRules {
+		rules = append(rules, ruleRegistry[name]())
+	}
+
+	return NewRuleSet(rules...)
+}
+
+// Returns an error if the amount a rule scores on isn't `ScoreOnTotal` or `ScoreOnSubtotal`
+func validateScoredAmount(amount string) error {
+	if amount != ScoreOnTotal && amount != ScoreOnSubtotal {
+		return fmt.Errorf("amount must be %q or %q", ScoreOnTotal, ScoreOnSubtotal)
+	}
+
+	return nil
+}
+
+// Returns an error if a rule's flat points award is invalid
+func validatePoints(points int64) error {
+	if points < 0 {
+		return fmt.Errorf("points must not be negative")
+	}
+
+	return nil
+}
+
+// Awards points for every alphanumeric character in the retailer name
+type RetailerAlphanumericRule struct {
+	PointsPerChar int64 `json:"pointsPerChar"`
+}
+
+func (rule *RetailerAlphanumericRule) Name() string {
+	return RetailerAlphanumericRuleName
+}
+
+func (rule *RetailerAlphanumericRule) Validate() error {
+	if rule.PointsPerChar < 0 {
+		return fmt.Errorf("pointsPerChar must not be negative")
+	}
+
+	return nil
+}
+
+func (rule *RetailerAlphanumericRule) Apply(r *Receipt) []RuleResult {
+	n := int64(0)
+	for _, c := range r.Retailer {
+		if unicode.IsDigit(c) || unicode.IsLetter(c) {
+			n += 1
+		}
+	}
+
+	if n == 0 || rule.PointsPerChar == 0 {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: n * rule.PointsPerChar,
+		Reason: fmt.Sprintf("%v has %v alphanumeric characters", r.Retailer, n),
+	}}
+}
+
+// Awards points if the total, or subtotal if `Amount` says so, is a round dollar amount with no cents
+type RoundDollarRule struct {
+	Points int64  `json:"points"`
+	Amount string `json:"amount"`
+}
+
+func (rule *RoundDollarRule) Name() string {
+	return RoundDollarRuleName
+}
+
+func (rule *RoundDollarRule) Validate() error {
+	err := validatePoints(rule.Points)
+	if err != nil {
+		return err
+	}
+
+	return validateScoredAmount(rule.Amount)
+}
+
+func (rule *RoundDollarRule) Apply(r *Receipt) []RuleResult {
+	amount := r.ScoredAmount(rule.Amount)
+	if !amount.IsMultipleOf(NewMoney(1, 0)) {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: rule.Points,
+		Reason: fmt.Sprintf("%v is a round dollar amount", amount),
+	}}
+}
+
+// Awards points if the total, or subtotal if `Amount` says so, is a multiple of 0.25
+type QuarterMultipleRule struct {
+	Points int64  `json:"points"`
+	Amount string `json:"amount"`
+}
+
+func (rule *QuarterMultipleRule) Name() string {
+	return QuarterMultipleRuleName
+}
+
+func (rule *QuarterMultipleRule) Validate() error {
+	err := validatePoints(rule.Points)
+	if err != nil {
+		return err
+	}
+
+	return validateScoredAmount(rule.Amount)
+}
+
+func (rule *QuarterMultipleRule) Apply(r *Receipt) []RuleResult {
+	amount := r.ScoredAmount(rule.Amount)
+	if !amount.IsMultipleOf(NewMoney(25, 2)) {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: rule.Points,
+		Reason: fmt.Sprintf("%v is a multiple of 0.25", amount),
+	}}
+}
+
+// Awards points for every two items on the receipt, counting quantities and leaving out discount lines
+type ItemPairsRule struct {
+	PointsPerPair int64 `json:"pointsPerPair"`
+}
+
+func (rule *ItemPairsRule) Name() string {
+	return ItemPairsRuleName
+}
+
+func (rule *ItemPairsRule) Validate() error {
+	if rule.PointsPerPair < 0 {
+		return fmt.Errorf("pointsPerPair must not be negative")
+	}
+
+	return nil
+}
+
+func (rule *ItemPairsRule) Apply(r *Receipt) []RuleResult {
+	count := r.ItemCount()
+	pairs := count / 2
+	if pairs == 0 || rule.PointsPerPair == 0 {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: pairs * rule.PointsPerPair,
+		Reason: fmt.Sprintf("%v items make %v pairs", count, pairs),
+	}}
+}
+
+// Awards a fraction of the item price, rounded up, for every item whose trimmed description length
+// is a multiple of `LengthMultiple`. Discount lines never earn points
+type DescriptionLengthRule struct {
+	LengthMultiple  int     `json:"lengthMultiple"`
+	PriceMultiplier float64 `json:"priceMultiplier"`
+}
+
+func (rule *DescriptionLengthRule) Name() string {
+	return DescriptionLengthRuleName
+}
+
+func (rule *DescriptionLengthRule) Validate() error {
+	if rule.LengthMultiple < 1 {
+		return fmt.Errorf("lengthMultiple must be at least 1")
+	}
+
+	if rule.PriceMultiplier < 0 || math.IsNaN(rule.PriceMultiplier) || math.IsInf(rule.PriceMultiplier, 0) {
+		return fmt.Errorf("priceMultiplier must be a non-negative number")
+	}
+
+	return nil
+}
+
+func (rule *DescriptionLengthRule) Apply(r *Receipt) []RuleResult {
+	var results []RuleResult
+	for _, item := range r.Items {
+		trimmed := strings.TrimSpace(item.ShortDescription)
+		if item.Discount || len(trimmed) == 0 || len(trimmed)%rule.LengthMultiple != 0 {
+			continue
+		}
+
+		points := item.Price.MulCeil(rule.PriceMultiplier)
+		if points == 0 {
+			continue
+		}
+
+		results = append(results, RuleResult{
+			Rule:   rule.Name(),
+			Points: points,
+			Reason: fmt.Sprintf("%v trimmed length is a multiple of %v", item.ShortDescription, rule.LengthMultiple),
+		})
+	}
+
+	return results
+}
+
+// Awards points if the day of the purchase date is odd
+type OddDayRule struct {
+	Points int64 `json:"points"`
+}
+
+func (rule *OddDayRule) Name() string {
+	return OddDayRuleName
+}
+
+func (rule *OddDayRule) Validate() error {
+	return validatePoints(rule.Points)
+}
+
+func (rule *OddDayRule) Apply(r *Receipt) []RuleResult {
+	if r.LocalPurchaseTime().Day()%2 == 0 {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: rule.Points,
+		Reason: fmt.Sprintf("%v is an odd day", r.LocalPurchaseTime().Format(DateFormat)),
+	}}
+}
+
+// Awards points if the purchase time is strictly between `Start` and `End`
+type AfternoonRule struct {
+	Points int64  `json:"points"`
+	Start  string `json:"start"`
+	End    string `json:"end"`
+}
+
+func (rule *AfternoonRule) Name() string {
+	return AfternoonRuleName
+}
+
+func (rule *AfternoonRule) Validate() error {
+	err := validatePoints(rule.Points)
+	if err != nil {
+		return err
+	}
+
+	start, err := time.Parse(TimeFormat, rule.Start)
+	if err != nil {
+		return fmt.Errorf("start is not a valid time; %v", err)
+	}
+
+	end, err := time.Parse(TimeFormat, rule.End)
+	if err != nil {
+		return fmt.Errorf("end is not a valid time; %v", err)
+	}
+
+	if !start.Before(end) {
+		return fmt.Errorf("start must be before end")
+	}
+
+	return nil
+}
+
+func (rule *AfternoonRule) Apply(r *Receipt) []RuleResult {
+	// Only the time of day is compared, so the purchase time is moved to the same date as the bounds
+	local := r.LocalPurchaseTime()
+	t := time.Date(0, 1, 1, local.Hour(), local.Minute(), 0, 0, time.UTC)
+	start, _ := time.Parse(TimeFormat, rule.Start)
+	end, _ := time.Parse(TimeFormat, rule.End)
+	if !t.After(start) || !t.Before(end) {
+		return nil
+	}
+
+	return []RuleResult{{
+		Rule:   rule.Name(),
+		Points: rule.Points,
+		Reason: fmt.Sprintf("%v is between %v and %v", local.Format(TimeFormat), rule.Start, rule.End),
+	}}
+}
@@ -0,0 +1,94 @@
+/**
+timezone.go
+
+Describes the time zones receipts can be in, and how a receipt's local purchase time maps to an instant
+*/
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Regex for a fixed UTC offset, capturing the sign, hours and minutes, e.g. -05:00 or +05:30
+var utcOffsetRgx = regexp.MustCompile(`^([+-])(\d{2}):(\d{2})$`)
+
+// Loaded locations keyed by name, since loading an IANA time zone reads the time zone database
+var timeZoneCache sync.Map
+
+// Returns the location named by an IANA time zone name, e.g. America/Chicago, or a UTC offset, e.g. -05:00
+func LoadTimeZone(name string) (*time.Location, error) {
+	if cached, ok := timeZoneCache.Load(name); ok {
+		return cached.(*time.Location), nil
+	}
+
+	var loc *time.Location
+	if match := utcOffsetRgx.FindStringSubmatch(name); match != nil {
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		offset := time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+		if match[1] == "-" {
+			offset = -offset
+		}
+
+		if minutes >= 60 || offset > maxUTCOffset || offset < minUTCOffset {
+			return nil, fmt.Errorf("%v is not a UTC offset in use", name)
+		}
+
+		loc = time.FixedZone(name, int(offset.Seconds()))
+	} else {
+		// "Local" and "" would be the server's time zone, which has nothing to do with the store
+		if name == "" || name == "Local" {
+			return nil, fmt.Errorf("%q is not a time zone", name)
+		}
+
+		var err error
+		loc, err = time.LoadLocation(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timeZoneCache.Store(name, loc)
+	return loc, nil
+}
+
+// Returns the purchase date and time in the receipt's time zone, or UTC if it doesn't have one
+// Times skipped by a daylight saving change are moved forward, e.g. 02:30 becomes 03:30
+// The receipt properties must be valid
+func (r *Receipt) LocalPurchaseTime() time.Time {
+	loc := time.UTC
+	if r.TimeZone != "" {
+		if zone, err := LoadTimeZone(r.TimeZone); err == nil {
+			loc = zone
+		}
+	}
+
+	naive, _ := time.Parse(DateFormat+" "+TimeFormat, r.PurchaseDate+" "+r.PurchaseTime)
+	t := time.Date(naive.Year(), naive.Month(), naive.Day(), naive.Hour(), naive.Minute(), 0, 0, loc)
+
+	// Skipped by a daylight saving change, so use whichever offset around the change moves the time forward
+	if t.Hour() != naive.Hour() || t.Minute() != naive.Minute() {
+		_, offset := t.Zone()
+		if forward := naive.Add(-time.Duration(offset) * time.Second); forward.After(t) {
+			t = forward.In(loc)
+		}
+	}
+
+	return t
+}
+
+// Returns the instant of purchase in UTC, or nil if the receipt doesn't have a time zone
+// The receipt properties must be valid
+func (r *Receipt) PurchasedAt() *time.Time {
+	if r.TimeZone == "" {
+		return nil
+	}
+
+	at := r.LocalPurchaseTime().UTC()
+	return &at
+}
@@ -0,0 +1,172 @@
+/**
+validation.go
+
+Describes validation errors that list every invalid field of a request
+*/
+
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Machine-readable codes describing why a field is invalid
+const (
+	// The field is missing or empty
+	ValidationRequired = "required"
+
+	// The field doesn't follow the expected format
+	ValidationInvalidFormat = "invalidFormat"
+
+	// The field has the wrong JSON type
+	ValidationInvalidType = "invalidType"
+
+	// The receipt has no items
+	ValidationTooFewItems = "tooFewItems"
+
+	// The request body isn't valid JSON
+	ValidationMalformed = "malformed"
+
+	// The date is formatted correctly but doesn't exist, e.g. 2022-02-30
+	ValidationInvalidDate = "invalidDate"
+
+	// The currency isn't a supported ISO 4217 code, or there's no exchange rate for it
+	ValidationUnsupportedCurrency = "unsupportedCurrency"
+
+	// The value is formatted correctly but is too small or too large, e.g. a negative total
+	ValidationOutOfRange = "outOfRange"
+
+	// The value contradicts another field, e.g. a price that isn't the unit price times the quantity
+	ValidationInconsistent = "inconsistent"
+)
+
+// Shape of a date, used to tell a badly formatted date apart from one that doesn't exist
+var dateShapeRgx = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// Describes why a single field is invalid
+type FieldError struct {
+	// Path to the field, using JSON names and indexes, e.g. `items[4].price`. Empty for the request as a whole
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Lists every invalid field of a request
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Returns nil when there are no errors, so an empty list isn't mistaken for an error
+func (errs ValidationErrors) orNil() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (errs *ValidationErrors) add(field string, code string, message string) {
+	*errs = append(*errs, FieldError{Field: field, Code: code, Message: message})
+}
+
+// Adds an error if the value is empty or doesn't match the pattern
+func (errs *ValidationErrors) checkPattern(field string, value string, rgx *regexp.Regexp) {
+	if value == "" {
+		errs.add(field, ValidationRequired, fmt.Sprintf("%v is required", field))
+	} else if !rgx.MatchString(value) {
+		errs.add(field, ValidationInvalidFormat, fmt.Sprintf("%v didn't follow pattern: %v", field, rgx.String()))
+	}
+}
+
+// Adds an error if the amount is missing, wasn't a JSON string or isn't a decimal amount with `exponent` decimal places
+// A negative exponent allows any number of decimal places
+func (errs *ValidationErrors) checkMoney(field string, value Money, exponent int) {
+	if !value.IsSet() {
+		errs.add(field, ValidationRequired, fmt.Sprintf("%v is required", field))
+	} else if value.invalidKind != "" {
+		errs.add(field, ValidationInvalidType, fmt.Sprintf("%v can't be a JSON %v", field, value.invalidKind))
+	} else if !value.IsValid() || (exponent >= 0 && value.Exponent() != exponent) {
+		pattern := `^\d+(\.\d+)?$`
+		if exponent == 0 {
+			pattern = `^\d+$`
+		} else if exponent > 0 {
+			pattern = fmt.Sprintf(`^\d+\.\d{%v}$`, exponent)
+		}
+		errs.add(field, ValidationInvalidFormat, fmt.Sprintf("%v didn't follow pattern: %v", field, pattern))
+	}
+}
+
+// Same as `checkMoney` for optional amounts, which must not be negative either
+func (errs *ValidationErrors) checkOptionalMoney(field string, value *Money, exponent int) {
+	if value == nil {
+		return
+	}
+
+	errs.checkMoney(field, *value, exponent)
+	if value.IsValid() && value.Sign() < 0 {
+		errs.add(field, ValidationOutOfRange, fmt.Sprintf("%v must not be negative", field))
+	}
+}
+
+// Adds an error if the value is empty or can't be parsed with the layout
+func (errs *ValidationErrors) checkTime(field string, value string, layout string, description string) {
+	if value == "" {
+		errs.add(field, ValidationRequired, fmt.Sprintf("%v is required", field))
+		return
+	}
+
+	_, err := time.Parse(layout, value)
+	if err != nil {
+		errs.add(field, ValidationInvalidFormat, fmt.Sprintf("%v must be %v", field, description))
+	}
+}
+
+// Adds an error if the value is empty, isn't formatted as a date, or is a date that doesn't exist
+func (errs *ValidationErrors) checkDate(field string, value string) {
+	if value == "" {
+		errs.add(field, ValidationRequired, fmt.Sprintf("%v is required", field))
+		return
+	}
+
+	if !dateShapeRgx.MatchString(value) {
+		errs.add(field, ValidationInvalidFormat, fmt.Sprintf("%v must be a date formatted as YYYY-MM-DD", field))
+		return
+	}
+
+	_, err := time.Parse(DateFormat, value)
+	if err != nil {
+		errs.add(field, ValidationInvalidDate, fmt.Sprintf("%v is not a date that exists", field))
+	}
+}
+
+// Returns true if the value is a 12 digit UPC-A or 13 digit EAN-13 barcode number with a valid check digit
+func validGTIN(value string) bool {
+	if len(value) != 12 && len(value) != 13 {
+		return false
+	}
+
+	// Digits are weighted 3 and 1 alternately, starting with 3 right before the check digit
+	sum := 0
+	for i := len(value) - 1; i >= 0; i-- {
+		c := value[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+
+		digit := int(c - '0')
+		if (len(value)-1-i)%2 == 1 {
+			digit *= 3
+		}
+		sum += digit
+	}
+
+	return sum%10 == 0
+}
@@ -0,0 +1,322 @@
+/**
+validators.go
+
+Describes the semantic checks run on receipts after their format is validated, along with a registry of the
+built-in validators
+*/
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Names of the built-in validators
+const (
+	ItemsTotalValidatorName   = "itemsTotal"
+	TotalPartsValidatorName   = "totalParts"
+	FutureDateValidatorName   = "futureDate"
+	MaxAgeValidatorName       = "maxAge"
+	MaxItemCountValidatorName = "maxItemCount"
+)
+
+// Machine-readable codes for the errors reported by the built-in validators
+const (
+	ValidationItemsTotalMismatch = "itemsTotalMismatch"
+	ValidationTotalPartsMismatch = "totalPartsMismatch"
+	ValidationFutureDate         = "futureDate"
+	ValidationTooOld             = "tooOld"
+	ValidationTooManyItems       = "tooManyItems"
+)
+
+// Receipts without a time zone could be from anywhere from 12 hours behind UTC to 14 hours ahead of it
+const (
+	maxUTCOffset = 14 * time.Hour
+	minUTCOffset = -12 * time.Hour
+)
+
+// Describes a check of a receipt that goes beyond the format of its fields
+// Validators assume the receipt properties are valid, see `Receipt.ValidateProperties`
+type Validator interface {
+	// Returns the name the validator is registered under
+	Name() string
+
+	// Returns an error if the validator's parameters are invalid
+	Validate() error
+
+	// Returns every problem found with the receipt, given the current time
+	Check(r *Receipt, now time.Time) ValidationErrors
+}
+
+// Registry of validator constructors, keyed by validator name
+// Each constructor returns the validator configured with its default parameters
+var (
+	validatorRegistry = map[string]func() Validator{}
+	defaultValidators []string
+)
+
+func init() {
+	RegisterValidator(ItemsTotalValidatorName, func() Validator { return &ItemsTotalValidator{Tolerance: MoneyFromCents(0)} })
+	registerDefaultValidator(TotalPartsValidatorName, func() Validator { return &TotalPartsValidator{Tolerance: MoneyFromCents(1)} })
+	RegisterValidator(FutureDateValidatorName, func() Validator { return &FutureDateValidator{} })
+	RegisterValidator(MaxAgeValidatorName, func() Validator { return &MaxAgeValidator{Days: 365} })
+	RegisterValidator(MaxItemCountValidatorName, func() Validator { return &MaxItemCountValidator{Max: 100} })
+}
+
+func registerDefaultValidator(name string, constructor func() Validator) {
+	RegisterValidator(name, constructor)
+	defaultValidators = append(defaultValidators, name)
+}
+
+// Registers a validator constructor under the given name
+// Panics if a validator is already registered under that name, since that's a programming error
+func RegisterValidator(name string, constructor func() Validator) {
+	if _, ok := validatorRegistry[name]; ok {
+		panic(fmt.Sprintf("validator %q is already registered", name))
+	}
+
+	validatorRegistry[name] = constructor
+}
+
+// Returns a new instance of the validator registered under the given name
+func NewValidator(name string) (Validator, error) {
+	constructor, ok := validatorRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("no validator registered with name %q", name)
+	}
+
+	return constructor(), nil
+}
+
+// Returns the names of all registered validators, sorted
+func RegisteredValidators() []string {
+	names := make([]string, 0, len(validatorRegistry))
+	for name := range validatorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns the validators that run by default, with their default parameters
+func DefaultValidators() []Validator {
+	validators := make([]Validator, 0, len(defaultValidators))
+	for _, name := range defaultValidators {
+		validators = append(validators, validatorRegistry[name]())
+	}
+
+	return validators
+}
+
+// Returns the earliest and latest instants the receipt could have been purchased at
+// They're the same if the receipt has a time zone, otherwise they span every time zone
+func purchaseWindow(r *Receipt) (time.Time, time.Time) {
+	if at := r.PurchasedAt(); at != nil {
+		return *at, *at
+	}
+
+	local := r.LocalPurchaseTime()
+	return local.Add(-maxUTCOffset), local.Add(-minUTCOffset)
+}
+
+// Reports receipts whose item prices don't add up to the subtotal, or the total if there isn't one,
+// give or take `Tolerance`
+type ItemsTotalValidator struct {
+	Tolerance Money `json:"tolerance"`
+}
+
+func (v *ItemsTotalValidator) Name() string {
+	return ItemsTotalValidatorName
+}
+
+func (v *ItemsTotalValidator) Validate() error {
+	if !v.Tolerance.IsValid() || v.Tolerance.Sign() < 0 {
+		return fmt.Errorf("tolerance must be a non-negative decimal amount like 0.05")
+	}
+
+	return nil
+}
+
+func (v *ItemsTotalValidator) Check(r *Receipt, now time.Time) ValidationErrors {
+	field, expected := "total", r.Total
+	if r.Subtotal != nil {
+		field, expected = "subtotal", *r.Subtotal
+	}
+
+	var err error
+	sum := MoneyFromCents(0)
+	for _, item := range r.Items {
+		sum, err = sum.Add(item.Price)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		return ValidationErrors{{
+			Field:   field,
+			Code:    ValidationItemsTotalMismatch,
+			Message: fmt.Sprintf("%v is %v but the item prices add up to more than can be represented", field, expected),
+		}}
+	}
+
+	if withinTolerance(expected, sum, v.Tolerance) {
+		return nil
+	}
+
+	return ValidationErrors{{
+		Field:   field,
+		Code:    ValidationItemsTotalMismatch,
+		Message: fmt.Sprintf("%v is %v but the item prices add up to %v", field, expected, sum),
+	}}
+}
+
+// Returns true if the amounts differ by at most the tolerance
+// Amounts too far apart to subtract are never within it
+func withinTolerance(a Money, b Money, tolerance Money) bool {
+	diff, err := a.Sub(b)
+	if err != nil {
+		return false
+	}
+
+	negated, err := b.Sub(a)
+	if err != nil {
+		return false
+	}
+
+	return diff.Cmp(tolerance) <= 0 && negated.Cmp(tolerance) <= 0
+}
+
+// Reports receipts whose subtotal, tax and tip don't add up to the total, give or take `Tolerance`
+// Receipts without a subtotal always pass
+type TotalPartsValidator struct {
+	Tolerance Money `json:"tolerance"`
+}
+
+func (v *TotalPartsValidator) Name() string {
+	return TotalPartsValidatorName
+}
+
+func (v *TotalPartsValidator) Validate() error {
+	if !v.Tolerance.IsValid() || v.Tolerance.Sign() < 0 {
+		return fmt.Errorf("tolerance must be a non-negative decimal amount like 0.01")
+	}
+
+	return nil
+}
+
+func (v *TotalPartsValidator) Check(r *Receipt, now time.Time) ValidationErrors {
+	if r.Subtotal == nil {
+		return nil
+	}
+
+	var err error
+	sum := *r.Subtotal
+	for _, part := range []*Money{r.Tax, r.Tip} {
+		if part != nil && err == nil {
+			sum, err = sum.Add(*part)
+		}
+	}
+	if err != nil {
+		return ValidationErrors{{
+			Field:   "total",
+			Code:    ValidationTotalPartsMismatch,
+			Message: fmt.Sprintf("total is %v but the subtotal, tax and tip add up to more than can be represented", r.Total),
+		}}
+	}
+
+	if withinTolerance(r.Total, sum, v.Tolerance) {
+		return nil
+	}
+
+	return ValidationErrors{{
+		Field:   "total",
+		Code:    ValidationTotalPartsMismatch,
+		Message: fmt.Sprintf("total is %v but the subtotal, tax and tip add up to %v", r.Total, sum),
+	}}
+}
+
+// Reports receipts purchased after the current time, in every time zone if the receipt doesn't have one
+type FutureDateValidator struct{}
+
+func (v *FutureDateValidator) Name() string {
+	return FutureDateValidatorName
+}
+
+func (v *FutureDateValidator) Validate() error {
+	return nil
+}
+
+func (v *FutureDateValidator) Check(r *Receipt, now time.Time) ValidationErrors {
+	earliest, _ := purchaseWindow(r)
+	if !earliest.After(now) {
+		return nil
+	}
+
+	return ValidationErrors{{
+		Field:   "purchaseDate",
+		Code:    ValidationFutureDate,
+		Message: "purchaseDate must not be in the future",
+	}}
+}
+
+// Reports receipts purchased more than `Days` days ago, in every time zone if the receipt doesn't have one
+type MaxAgeValidator struct {
+	Days int `json:"days"`
+}
+
+func (v *MaxAgeValidator) Name() string {
+	return MaxAgeValidatorName
+}
+
+func (v *MaxAgeValidator) Validate() error {
+	if v.Days < 1 {
+		return fmt.Errorf("days must be at least 1")
+	}
+
+	return nil
+}
+
+func (v *MaxAgeValidator) Check(r *Receipt, now time.Time) ValidationErrors {
+	_, latest := purchaseWindow(r)
+	if !latest.AddDate(0, 0, v.Days).Before(now) {
+		return nil
+	}
+
+	return ValidationErrors{{
+		Field:   "purchaseDate",
+		Code:    ValidationTooOld,
+		Message: fmt.Sprintf("purchaseDate must be within the last %v days", v.Days),
+	}}
+}
+
+// Reports receipts with more than `Max` items, counting quantities
+type MaxItemCountValidator struct {
+	Max int `json:"max"`
+}
+
+func (v *MaxItemCountValidator) Name() string {
+	return MaxItemCountValidatorName
+}
+
+func (v *MaxItemCountValidator) Validate() error {
+	if v.Max < 1 {
+		return fmt.Errorf("max must be at least 1")
+	}
+
+	return nil
+}
+
+func (v *MaxItemCountValidator) Check(r *Receipt, now time.Time) ValidationErrors {
+	if r.ItemCount() <= int64(v.Max) {
+		return nil
+	}
+
+	return ValidationErrors{{
+		Field:   "items",
+		Code:    ValidationTooManyItems,
+		Message: fmt.Sprintf("items must have at most %v items", v.Max),
+	}}
+}
@@ -7,10 +7,23 @@ Entrypoint for the application. Constructs the HTTP server
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	// Receipts name IANA time zones, which the runtime image may not have a database for
+	_ "time/tzdata"
 
 	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
 )
 
 const (
@@ -20,15 +33,229 @@ const (
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "rescore" {
+		rescore(os.Args[2:])
+		return
+	}
+
+	rulesPath := flag.String("rules", "", "path to a JSON or YAML rules file, the built-in rules are used if empty")
+	rulesPoll := flag.Duration("rules-poll", 5*time.Second, "how often to check the rules file for changes, 0 disables polling")
+	storeKind := flag.String("store", "memory", "where to keep processed receipts: memory, file or sql")
+	dataDir := flag.String("data-dir", "data", "directory used by the file and sql stores")
+	snapshotEvery := flag.Int("snapshot-every", 1000, "number of changes between file store snapshots, 0 disables snapshots")
+	duplicates := flag.String("duplicates", controller.DuplicatePolicyReject, "how to handle a receipt that was already processed: reject, return-existing or allow")
+	legacyErrors := flag.Bool("legacy-errors", false, "respond to invalid receipts with the original plain text instead of a list of invalid fields")
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "how long responses to receipts sent with an Idempotency-Key are kept for retries")
+	expiryMonths := flag.Int("points-expire-months", 0, "number of months awarded points last, 0 means they never expire")
+	expiryBasis := flag.String("points-expire-basis", models.ExpiryBasisPurchase, "what points expiry is measured from: purchase or processed")
+	expiryInterval := flag.Duration("expiry-interval", time.Hour, "how often to debit expired points")
+	batchMaxSize := flag.Int("batch-max-size", controller.DefaultBatchMaxSize, "most receipts accepted in one batch")
+	batchWorkers := flag.Int("batch-workers", controller.DefaultBatchWorkers, "most receipts of one batch processed at the same time")
+	jobQueueSize := flag.Int("job-queue-size", controller.DefaultJobQueueSize, "most receipts waiting to be processed in the background before requests are turned away")
+	jobWorkers := flag.Int("job-workers", controller.DefaultJobWorkers, "number of receipts processed in the background at the same time")
+	jobRetention := flag.Duration("job-retention", controller.DefaultJobRetention, "how long finished background jobs can be polled for")
+	rescoreAllowApply := flag.Bool("rescore-allow-apply", false, "let requests to "+controller.RescoreReceiptsPath+" apply new scores to users' ledgers")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests and queued jobs to finish when stopping")
+	flag.Parse()
+
+	// Open the store, refusing to start if it can't be recovered
+	openStore(*storeKind, *dataDir, *snapshotEvery)
+
+	// Load the scoring rules, refusing to start if they're invalid
+	if *rulesPath != "" {
+		rules, err := controller.LoadRulesFile(*rulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v", err)
+		}
+
+		log.Printf("Loaded %v rules from %v: version %v", len(rules.Rules), *rulesPath, rules.Version)
+
+		// Reload the rules when the file changes or on SIGHUP
+		if *rulesPoll > 0 {
+			go controller.WatchRulesFile(context.Background(), *rulesPath, *rulesPoll)
+		}
+
+		go reloadRulesOnSignal()
+	}
+
+	controller.SetLegacyErrors(*legacyErrors)
+	controller.SetRescoreApplyAllowed(*rescoreAllowApply)
+
+	if *idempotencyWindow <= 0 {
+		log.Fatalf("Invalid idempotency window: must be positive")
+	}
+	controller.SetIdempotencyWindow(*idempotencyWindow)
+
+	err := controller.SetDuplicatePolicy(*duplicates)
+	if err != nil {
+		log.Fatalf("Invalid duplicate policy: %v", err)
+	}
+
+	err = controller.SetBatchLimits(*batchMaxSize, *batchWorkers)
+	if err != nil {
+		log.Fatalf("Invalid batch limits: %v", err)
+	}
+
+	// Start processing receipts in the background, refusing to start if the limits are invalid
+	err = controller.StartJobWorkers(*jobQueueSize, *jobWorkers, *jobRetention)
+	if err != nil {
+		log.Fatalf("Invalid job queue: %v", err)
+	}
+
+	// Set up points expiry, refusing to start if the policy is invalid
+	err = controller.SetExpiryPolicy(models.ExpiryPolicy{Months: *expiryMonths, Basis: *expiryBasis})
+	if err != nil {
+		log.Fatalf("Invalid points expiry: %v", err)
+	}
+
+	if *expiryMonths > 0 {
+		if *expiryInterval <= 0 {
+			log.Fatalf("Invalid points expiry: interval must be positive")
+		}
+
+		log.Printf("Points expire %v months after the %v date, checked every %v", *expiryMonths, *expiryBasis, *expiryInterval)
+		go controller.RunExpiryJob(context.Background(), *expiryInterval)
+	}
+
 	// Register endpoints for the server with a mux
 	mux := http.NewServeMux()
 	mux.Handle(controller.ProcessReceiptPath, http.HandlerFunc(controller.ProcessReceipt))
+	mux.Handle("POST "+controller.ProcessReceiptBatchPath, http.HandlerFunc(controller.ProcessReceiptBatch))
+	mux.Handle("GET "+controller.ListReceiptsPath, http.HandlerFunc(controller.ListReceipts))
+	mux.Handle(controller.GetReceiptPath, http.HandlerFunc(controller.GetReceipt))
+	mux.Handle("GET "+controller.GetJobPath, http.HandlerFunc(controller.GetJob))
 	mux.Handle(controller.GetPointsPath, http.HandlerFunc(controller.GetPoints))
+	mux.Handle(controller.GetPointsBreakdownPath, http.HandlerFunc(controller.GetPointsBreakdown))
+	mux.Handle("POST "+controller.VoidReceiptPath, http.HandlerFunc(controller.VoidReceipt))
+	mux.Handle(controller.GetUserPointsPath, http.HandlerFunc(controller.GetUserPoints))
+	mux.Handle(controller.GetUserLedgerPath, http.HandlerFunc(controller.GetUserLedger))
+	mux.Handle(controller.GetUserExpiringPointsPath, http.HandlerFunc(controller.GetUserExpiringPoints))
+	mux.Handle("POST "+controller.CreateRedemptionPath, http.HandlerFunc(controller.CreateRedemption))
+	mux.Handle("POST "+controller.RescoreReceiptsPath, http.HandlerFunc(controller.RescoreReceiptsHandler))
+
+	// There is nothing to reload when the built-in rules are used
+	if *rulesPath != "" {
+		mux.Handle("POST "+controller.ReloadRulesPath, http.HandlerFunc(controller.ReloadRulesHandler))
+	}
+
+	// Start the server, stopping it on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ServerEndpoint, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to serve: %v", err)
+		}
+	}()
 
-	// Start the server
-	err := http.ListenAndServe(ServerEndpoint, mux)
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down, waiting up to %v for requests and queued jobs to finish", *shutdownTimeout)
+
+	// Stop taking requests first, so nothing more is queued while the queue drains
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Failed to finish every request: %v", err)
+	}
+
+	err = controller.DrainJobs(shutdownCtx)
+	if err != nil {
+		log.Printf("Failed to finish every queued job: %v", err)
+		return
+	}
+
+	err = controller.ActiveStore().Close()
 	if err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+		log.Printf("Failed to close store: %v", err)
 	}
 
 }
+
+// Opens the store of the given kind and makes it the one receipts are kept in, exiting if it can't be recovered
+func openStore(kind string, dataDir string, snapshotEvery int) {
+	switch kind {
+	case "memory":
+	case "file":
+		store, err := controller.OpenFileStore(dataDir, snapshotEvery)
+		if err != nil {
+			log.Fatalf("Failed to open file store: %v", err)
+		}
+
+		controller.SetStore(store)
+		log.Printf("Using file store in %v", dataDir)
+	case "sql":
+		err := os.MkdirAll(dataDir, 0755)
+		if err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
+		}
+
+		store, err := controller.OpenSQLStore(filepath.Join(dataDir, "receipts.db"))
+		if err != nil {
+			log.Fatalf("Failed to open sql store: %v", err)
+		}
+
+		controller.SetStore(store)
+		log.Printf("Using sql store in %v", dataDir)
+	default:
+		log.Fatalf("Unknown store %q, expected memory, file or sql", kind)
+	}
+}
+
+// Runs the `rescore` subcommand: rescores the stored receipts with a rules file and prints the report as JSON
+// The file store can't be shared, so the server must be stopped first when using it
+func rescore(args []string) {
+	flags := flag.NewFlagSet("rescore", flag.ExitOnError)
+	rulesPath := flags.String("rules", "", "path to a JSON or YAML rules file to rescore with, the built-in rules are used if empty")
+	storeKind := flags.String("store", "sql", "where the processed receipts are kept: file or sql")
+	dataDir := flags.String("data-dir", "data", "directory used by the file and sql stores")
+	snapshotEvery := flags.Int("snapshot-every", 1000, "number of changes between file store snapshots, 0 disables snapshots")
+	userID := flags.String("user", "", "only rescore this user's receipts")
+	apply := flags.Bool("apply", false, "save the new scores and adjust the ledgers instead of only reporting the changes")
+	flags.Parse(args)
+
+	if *storeKind == "memory" {
+		log.Fatalf("Cannot rescore the memory store, expected file or sql")
+	}
+
+	rules := models.DefaultRuleSet()
+	if *rulesPath != "" {
+		var err error
+		rules, err = models.LoadRuleSet(*rulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load rules: %v", err)
+		}
+	}
+
+	openStore(*storeKind, *dataDir, *snapshotEvery)
+	defer controller.ActiveStore().Close()
+
+	report, err := controller.RescoreReceipts(rules, models.ReceiptFilter{UserID: *userID}, *apply)
+	if err != nil {
+		log.Fatalf("Failed to rescore receipts: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(report)
+	if err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+}
+
+// Reloads the rules file every time the process receives SIGHUP
+func reloadRulesOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		_, err := controller.ReloadRules()
+		if err != nil {
+			log.Printf("Failed to reload rules, keeping version %v: %v", controller.ActiveRuleSet().Version, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+/**
+batch_test.go
+
+Tests processing many receipts in one request
+*/
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to process a batch without going through the server
+func processBatchInProcess(contentType string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptBatchPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	controller.ProcessReceiptBatch(rec, req)
+
+	return rec
+}
+
+// Helper function to marshal receipts as a JSON array batch
+func marshalBatch(t *testing.T, receipts ...models.Receipt) string {
+	buf, err := json.Marshal(receipts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return string(buf)
+}
+
+func TestProcessReceiptBatch(t *testing.T) {
+	processed := uniqueReceipt(targetReceipt)
+	processedID := processReceiptInProcess(t, &processed)
+
+	invalid := uniqueReceipt(targetReceipt)
+	invalid.Retailer = ""
+
+	// Each user's first receipt also earns a bonus
+	first := uniqueReceipt(targetReceipt)
+	first.UserID = "BatchUser-" + uuid.New().String()
+	last := uniqueReceipt(cornerMarketReceipt)
+	last.UserID = "BatchUser-" + uuid.New().String()
+
+	rec := processBatchInProcess("application/json", marshalBatch(t, first, invalid, processed, last))
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	var resp models.ProcessReceiptBatchResponse
+	if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp)) || !assert.Len(t, resp.Results, 4) {
+		return
+	}
+
+	assert.Equal(t, 2, resp.Processed)
+	assert.Equal(t, 2, resp.Failed)
+	for i, result := range resp.Results {
+		assert.Equal(t, i, result.Index)
+	}
+
+	// Results are in input order, each one either an ID or an error
+	assert.Nil(t, resp.Results[0].Error)
+	assert.Equal(t, int64(1028), getPointsInProcess(t, resp.Results[0].ID).Points)
+
+	if assert.NotNil(t, resp.Results[1].Error) {
+		assert.Empty(t, resp.Results[1].ID)
+		assert.Equal(t, controller.ErrorTypeInvalidReceipt, resp.Results[1].Error.Type)
+		assert.Equal(t, http.StatusBadRequest, resp.Results[1].Error.Status)
+		assert.Equal(t, "retailer", resp.Results[1].Error.Errors[0].Field)
+	}
+
+	if assert.NotNil(t, resp.Results[2].Error) {
+		assert.Equal(t, controller.ErrorTypeDuplicateReceipt, resp.Results[2].Error.Type)
+		assert.Equal(t, processedID, resp.Results[2].Error.ReceiptID)
+	}
+
+	assert.Nil(t, resp.Results[3].Error)
+	assert.Equal(t, int64(1109), getPointsInProcess(t, resp.Results[3].ID).Points)
+}
+
+func TestProcessReceiptBatchNDJSON(t *testing.T) {
+	lines := []string{}
+	for _, receipt := range []models.Receipt{uniqueReceipt(targetReceipt), uniqueReceipt(cornerMarketReceipt)} {
+		buf, err := json.Marshal(receipt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines = append(lines, string(buf))
+	}
+
+	body := lines[0] + "\n{\"retailer\": \n\n" + lines[1] + "\n"
+	rec := processBatchInProcess("application/x-ndjson; charset=utf-8", body)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	var resp models.ProcessReceiptBatchResponse
+	if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp)) || !assert.Len(t, resp.Results, 3) {
+		return
+	}
+
+	assert.NotEmpty(t, resp.Results[0].ID)
+	if assert.NotNil(t, resp.Results[1].Error) {
+		assert.Equal(t, models.ValidationMalformed, resp.Results[1].Error.Errors[0].Code)
+	}
+	assert.NotEmpty(t, resp.Results[2].ID)
+}
+
+func TestProcessReceiptBatchLimits(t *testing.T) {
+	if !assert.NoError(t, controller.SetBatchLimits(2, 1)) {
+		return
+	}
+	defer controller.SetBatchLimits(controller.DefaultBatchMaxSize, controller.DefaultBatchWorkers)
+
+	rec := processBatchInProcess("application/json",
+		marshalBatch(t, uniqueReceipt(targetReceipt), uniqueReceipt(targetReceipt), uniqueReceipt(targetReceipt)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), controller.ErrorTypeBatchTooLarge)
+
+	// Reading stops at the receipt past the limit, before the rest of the body
+	body := marshalBatch(t, uniqueReceipt(targetReceipt), uniqueReceipt(targetReceipt), uniqueReceipt(targetReceipt))
+	rec = processBatchInProcess("application/json", strings.TrimSuffix(body, "]")+`, not json`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	rec = processBatchInProcess("application/x-ndjson", "{}\n{}\n{}\nnot json")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// The body is limited by the number of receipts accepted
+	large := `{"retailer": "` + strings.Repeat("a", 256<<10) + `"}`
+	for contentType, body := range map[string]string{"application/json": "[" + large + "]", "application/x-ndjson": large} {
+		rec = processBatchInProcess(contentType, body)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, contentType)
+		assert.Contains(t, rec.Body.String(), controller.ErrorTypeBatchTooLarge, contentType)
+	}
+
+	for _, body := range []string{`[]`, `{"retailer": "Target"}`, `[{"retailer": "Target"}`, ``} {
+		rec = processBatchInProcess("application/json", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		assert.Contains(t, rec.Body.String(), controller.ErrorTypeInvalidRequest, body)
+	}
+
+	assert.Error(t, controller.SetBatchLimits(0, 1))
+	assert.Error(t, controller.SetBatchLimits(1, 0))
+}
+
+func TestProcessReceiptBatchThroughServer(t *testing.T) {
+	body := marshalBatch(t, uniqueReceipt(targetReceipt), uniqueReceipt(cornerMarketReceipt))
+	resp, err := http.Post(ServerEndpoint+controller.ProcessReceiptBatchPath, "application/json", bytes.NewBufferString(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var respInfo models.ProcessReceiptBatchResponse
+	if assert.NoError(t, json.NewDecoder(resp.Body).Decode(&respInfo)) {
+		assert.Equal(t, 2, respInfo.Processed)
+		assert.Equal(t, 0, respInfo.Failed)
+	}
+}
@@ -0,0 +1,80 @@
+/**
+bonus_test.go
+
+Makes concurrent HTTP calls for one user to check each bonus tier is only ever granted once
+Assumes that the server is running on 'http://localhost:3000'
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentReceiptsGrantEachBonusOnce(t *testing.T) {
+	const nRequests = 300
+
+	userID := "ConcurrentUser-" + uuid.New().String()
+
+	// Submit every receipt at once
+	var wg sync.WaitGroup
+	ids := make(chan string, nRequests)
+	for i := 0; i < nRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			receipt := uniqueReceipt(cornerMarketReceipt)
+			receipt.UserID = userID
+			resp, err := processReceipt(&receipt)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var respInfo models.ProcessReceiptResponse
+			err = json.NewDecoder(resp.Body).Decode(&respInfo)
+			if assert.NoError(t, err) {
+				ids <- respInfo.Id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	// Count the bonuses that were granted
+	bonuses := map[int64]int{}
+	for id := range ids {
+		resp, err := getPointsBreakdown(id)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		respBytes, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.NoError(t, err)
+
+		var respInfo models.GetPointsBreakdownResponse
+		err = json.Unmarshal(respBytes, &respInfo)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		for _, result := range respInfo.Breakdown {
+			if result.Rule == models.ReceiptBonusName {
+				bonuses[result.Points]++
+			}
+		}
+	}
+
+	assert.Equal(t, map[int64]int{1000: 1, 500: 1, 250: 1}, bonuses)
+}
@@ -0,0 +1,214 @@
+/**
+currency_test.go
+
+Tests receipts in currencies other than USD, and scoring them in the base currency
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Same receipt as `cornerMarketReceipt` but in Canadian dollars, worth the same at 0.75 USD per CAD
+var cornerMarketReceiptCAD = models.Receipt{
+	Retailer:     "M&M Corner Market",
+	Total:        models.MustParseMoney("12.00"),
+	Currency:     "CAD",
+	PurchaseDate: "2022-03-20",
+	PurchaseTime: "14:33",
+	Items: []models.Item{
+		{ShortDescription: "Gatorade", Price: models.MustParseMoney("3.00")},
+		{ShortDescription: "Gatorade", Price: models.MustParseMoney("3.00")},
+		{ShortDescription: "Gatorade", Price: models.MustParseMoney("3.00")},
+		{ShortDescription: "Gatorade", Price: models.MustParseMoney("3.00")},
+	},
+}
+
+const currencyRulesConfig = `{
+	"rules": [
+		{"name": "retailerAlphanumeric"}, {"name": "roundDollar"}, {"name": "quarterMultiple"}, {"name": "itemPairs"},
+		{"name": "descriptionLength"}, {"name": "oddDay"}, {"name": "afternoon"}
+	],
+	"exchangeRates": {"CAD": 0.75, "MXN": "0.055"}
+}`
+
+func TestValidateCurrencyMinorUnits(t *testing.T) {
+	for _, c := range []struct {
+		currency string
+		total    string
+		price    string
+		codes    []string
+	}{
+		{"", "1.50", "1.50", nil},
+		{"JPY", "1500", "1500", nil},
+		{"JPY", "1500.00", "1500", []string{models.ValidationInvalidFormat}},
+		{"BHD", "1.500", "1.50", []string{models.ValidationInvalidFormat}},
+		{"usd", "1.50", "1.50", []string{models.ValidationUnsupportedCurrency}},
+		{"XYZ", "1.50", "1.5", []string{models.ValidationUnsupportedCurrency}},
+	} {
+		receipt := targetReceipt
+		receipt.Currency = c.currency
+		receipt.Total = models.MoneyFromString(c.total)
+		receipt.Items = []models.Item{{ShortDescription: "Pizza", Price: models.MoneyFromString(c.price)}}
+
+		var codes []string
+		var errs models.ValidationErrors
+		if errors.As(receipt.ValidateProperties(), &errs) {
+			for _, err := range errs {
+				codes = append(codes, err.Code)
+			}
+		}
+		assert.Equal(t, c.codes, codes, c)
+	}
+}
+
+func TestExchangeRates(t *testing.T) {
+	rates, err := models.NewExchangeRates("USD", map[string]string{"MXN": "0.055", "JPY": "0.0067"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, c := range []struct {
+		amount   string
+		currency string
+		expected string
+	}{
+		{"10.10", "MXN", "0.56"},
+		{"0.10", "MXN", "0.01"},
+		{"0.09", "MXN", "0.00"},
+		{"1500", "JPY", "10.05"},
+		{"6.49", "USD", "6.49"},
+	} {
+		converted, err := rates.Convert(models.MustParseMoney(c.amount), c.currency)
+		if assert.NoError(t, err, c) {
+			assert.Equal(t, models.MustParseMoney(c.expected), converted, c)
+		}
+	}
+	assert.False(t, rates.Supports("CAD"))
+
+	for base, rates := range map[string]map[string]string{
+		"XYZ": {},
+		"USD": {"CAD": "0"},
+		"EUR": {"CAD": "abc"},
+		"GBP": {"XYZ": "1"},
+		"IDR": {"USD": "16000000"},
+		"JPY": {"USD": "0.0000001"},
+	} {
+		_, err = models.NewExchangeRates(base, rates)
+		assert.Error(t, err, base)
+	}
+}
+
+func TestExchangeRatesOverflow(t *testing.T) {
+	rates, err := models.NewExchangeRates("IDR", map[string]string{"USD": "16000"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// About 1.6e19 minor units of rupiah, more than an int64 holds
+	amount := models.MustParseMoney("9999999999999.99")
+	_, err = rates.Convert(amount, "USD")
+	assert.ErrorIs(t, err, models.ErrMoneyOverflow)
+
+	receipt := cornerMarketReceipt
+	receipt.Currency = "USD"
+	receipt.Total = amount
+	_, err = rates.ToBase(&receipt)
+	assert.ErrorIs(t, err, models.ErrMoneyOverflow)
+
+	rules := models.NewRuleSet()
+	rules.ExchangeRates = rates
+	assertCheckCodes(t, rules, &receipt, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC), models.ValidationOutOfRange)
+}
+
+func TestScoreInBaseCurrency(t *testing.T) {
+	rules, err := models.ParseRuleSet([]byte(currencyRulesConfig), models.RuleConfigFormatJSON)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, int64(109), rules.Score(&cornerMarketReceiptCAD))
+	assert.Equal(t, rules.Score(&cornerMarketReceipt), rules.Score(&cornerMarketReceiptCAD))
+
+	now := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, rules.CheckReceipt(&cornerMarketReceiptCAD, now))
+
+	// Receipts in currencies without a rate can't be scored
+	receipt := cornerMarketReceiptCAD
+	receipt.Currency = "EUR"
+	assertCheckCodes(t, rules, &receipt, now, models.ValidationUnsupportedCurrency)
+	assertCheckCodes(t, models.DefaultRuleSet(), &cornerMarketReceiptCAD, now, models.ValidationUnsupportedCurrency)
+
+	_, err = models.ParseRuleSet([]byte(`{"rules": [{"name": "oddDay"}], "exchangeRates": {"CAD": -1}}`),
+		models.RuleConfigFormatJSON)
+	assert.Error(t, err)
+}
+
+func TestFingerprintCurrency(t *testing.T) {
+	usd := targetReceipt
+	usd.Currency = "USD"
+	assert.Equal(t, targetReceipt.Fingerprint(), usd.Fingerprint())
+
+	cad := targetReceipt
+	cad.Currency = "CAD"
+	assert.NotEqual(t, targetReceipt.Fingerprint(), cad.Fingerprint())
+}
+
+func TestProcessReceiptInCurrency(t *testing.T) {
+	rules, err := models.ParseRuleSet([]byte(currencyRulesConfig), models.RuleConfigFormatJSON)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, controller.SetRuleSet(rules)) {
+		return
+	}
+	defer controller.SetRuleSet(models.DefaultRuleSet())
+
+	// The user's first receipt also earns a bonus
+	receipt := uniqueReceipt(cornerMarketReceiptCAD)
+	receipt.UserID = "CurrencyUser-" + uuid.New().String()
+	id := processReceiptInProcess(t, &receipt)
+	assert.Equal(t, int64(1109), getPointsInProcess(t, id).Points)
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id, nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	controller.GetReceipt(rec, req)
+
+	var respInfo models.GetReceiptResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &respInfo)) {
+		assert.Equal(t, "CAD", respInfo.Currency)
+		assert.Equal(t, models.MustParseMoney("12.00"), respInfo.Total)
+	}
+}
+
+func TestStoreReceiptCurrency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        cornerMarketReceiptCAD,
+			Points:         109,
+			Breakdown:      []models.RuleResult{},
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC),
+		}
+		assert.NoError(t, store.SaveReceipt(record))
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, record.Receipt, loaded.Receipt)
+		}
+	})
+}
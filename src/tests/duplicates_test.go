@@ -0,0 +1,140 @@
+/**
+duplicates_test.go
+
+Tests that receipts which were already processed are detected by their fingerprint
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiptFingerprint(t *testing.T) {
+	receipt := cornerMarketReceipt
+	fingerprint := receipt.Fingerprint()
+
+	// Differences that don't change what was bought
+	same := receipt
+	same.UserID = "TestUser2"
+	same.Retailer = "  m&m   CORNER market "
+	same.Items = []models.Item{receipt.Items[3], receipt.Items[1], receipt.Items[0], receipt.Items[2]}
+	same.Items[0].ShortDescription = strings.ToUpper(same.Items[0].ShortDescription)
+	assert.Equal(t, fingerprint, same.Fingerprint())
+
+	different := receipt
+	different.Items = append([]models.Item{}, receipt.Items...)
+	different.Items[0].Price = models.MoneyFromString("2.26")
+	assert.NotEqual(t, fingerprint, different.Fingerprint())
+
+	different = receipt
+	different.PurchaseTime = "14:34"
+	assert.NotEqual(t, fingerprint, different.Fingerprint())
+}
+
+func TestStoreFindReceiptByFingerprint(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		fingerprint := cornerMarketReceipt.Fingerprint()
+		_, err := store.FindReceiptByFingerprint(fingerprint)
+		assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+
+		for _, id := range []string{"a", "b"} {
+			assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: id, Receipt: cornerMarketReceipt, Fingerprint: fingerprint}))
+		}
+
+		id, err := store.FindReceiptByFingerprint(fingerprint)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", id)
+
+		record, err := store.GetReceipt("b")
+		assert.NoError(t, err)
+		assert.Equal(t, fingerprint, record.Fingerprint)
+	})
+}
+
+func TestProcessDuplicateReceipt(t *testing.T) {
+
+	receipt := uniqueReceipt(cornerMarketReceipt)
+	receipt.UserID = "DuplicateUser-" + uuid.New().String()
+	resp, err := processReceipt(&receipt)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var respInfo models.ProcessReceiptResponse
+	err = json.NewDecoder(resp.Body).Decode(&respInfo)
+	assert.NoError(t, err)
+
+	// Resubmitting, even as someone else, doesn't award points again
+	duplicate := receipt
+	duplicate.Retailer = strings.ToLower(receipt.Retailer)
+	duplicate.UserID = "DuplicateUser-" + uuid.New().String()
+	resp, err = processReceipt(&duplicate)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	problem := decodeProblem(t, resp)
+	assert.Equal(t, "duplicate-receipt", problem.Type)
+	assert.Equal(t, respInfo.Id, problem.ReceiptID)
+
+	resp, err = getUserPoints(duplicate.UserID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDuplicatePolicyInProcess(t *testing.T) {
+	defer controller.SetDuplicatePolicy(controller.DuplicatePolicyReject)
+
+	receipt := uniqueReceipt(targetReceipt)
+	receipt.UserID = "DuplicateUser-" + uuid.New().String()
+	id := processReceiptInProcess(t, &receipt)
+
+	assert.NoError(t, controller.SetDuplicatePolicy(controller.DuplicatePolicyReturnExisting))
+	assert.Equal(t, id, processReceiptInProcess(t, &receipt))
+
+	assert.NoError(t, controller.SetDuplicatePolicy(controller.DuplicatePolicyAllow))
+	assert.NotEqual(t, id, processReceiptInProcess(t, &receipt))
+
+	assert.Error(t, controller.SetDuplicatePolicy("ignore"))
+}
+
+// Counts up through the dates handed out by `uniqueReceipt`
+// Starts somewhere random so running the tests again against the same server doesn't reuse dates
+var uniqueReceiptDates = func() *atomic.Int64 {
+	var n atomic.Int64
+	n.Store(rand.Int63n(uniqueReceiptDateCount))
+	return &n
+}()
+
+// Every year has 168 days with an odd day of the month up to the 27th, and as many even ones up to the 28th
+const uniqueReceiptDateCount = 1000 * 12 * 14
+
+// Helper function to copy a receipt so it isn't a duplicate of any other, without changing its points
+// Moves the purchase date to a day of the same parity in a year before 2000
+func uniqueReceipt(receipt models.Receipt) models.Receipt {
+	n := uniqueReceiptDates.Add(1) % uniqueReceiptDateCount
+
+	d, _ := time.Parse(models.DateFormat, receipt.PurchaseDate)
+	day := 2 - d.Day()%2 + int(n%14)*2
+	month := time.Month(n/14%12 + 1)
+	year := 1000 + int(n/(12*14))
+
+	receipt.PurchaseDate = time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Format(models.DateFormat)
+	return receipt
+}
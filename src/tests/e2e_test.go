@@ -32,7 +32,7 @@ func TestProcessReceiptWithoutItems(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "13:01",
 		Items:        []models.Item{},
@@ -45,41 +45,36 @@ func TestProcessReceiptWithoutItems(t *testing.T) {
 
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "items")
 }
 
 func TestProcessReceiptWithInvalidItems(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "13:01",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 			{
 				ShortDescription: "Emils Cheese Pizza",
-				Price:            "12.25",
+				Price:            models.MoneyFromString("12.25"),
 			},
 			{
 				ShortDescription: "Knorr Creamy Chicken",
-				Price:            "1.26",
+				Price:            models.MoneyFromString("1.26"),
 			},
 			{
 				ShortDescription: "Doritos Nacho Cheese",
-				Price:            "3.35",
+				Price:            models.MoneyFromString("3.35"),
 			},
 			{
 				ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ",
-				Price:            "NOT a price",
+				Price:            models.MoneyFromString("NOT a price"),
 			},
 		},
 	}
@@ -90,38 +85,33 @@ func TestProcessReceiptWithInvalidItems(t *testing.T) {
 	}
 
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "items[4].price")
 
 	payload = &models.Receipt{
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "13:01",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 			{
 				ShortDescription: "Emils Cheese Pizza",
-				Price:            "12.25",
+				Price:            models.MoneyFromString("12.25"),
 			},
 			{
 				ShortDescription: "Knorr Creamy Chicken",
-				Price:            "1.26",
+				Price:            models.MoneyFromString("1.26"),
 			},
 			{
 				ShortDescription: "",
-				Price:            "3.35",
+				Price:            models.MoneyFromString("3.35"),
 			},
 			{
 				ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ",
-				Price:            "12.00",
+				Price:            models.MoneyFromString("12.00"),
 			},
 		},
 	}
@@ -132,25 +122,20 @@ func TestProcessReceiptWithInvalidItems(t *testing.T) {
 	}
 
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
-	b, err = io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "items[3].shortDescription")
 }
 
 func TestProcessReceiptWithInvalidRetailer(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "13:01",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 		},
 	}
@@ -161,25 +146,20 @@ func TestProcessReceiptWithInvalidRetailer(t *testing.T) {
 	}
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "retailer")
 }
 
 func TestProcessReceiptWithInvalidTotal(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "Target",
-		Total:        "NOT a total",
+		Total:        models.MoneyFromString("NOT a total"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "13:01",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 		},
 	}
@@ -190,25 +170,20 @@ func TestProcessReceiptWithInvalidTotal(t *testing.T) {
 	}
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "total")
 }
 
 func TestProcessReceiptWithInvalidDate(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "Jan 01",
 		PurchaseTime: "13:01",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 		},
 	}
@@ -219,25 +194,20 @@ func TestProcessReceiptWithInvalidDate(t *testing.T) {
 	}
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "purchaseDate")
 }
 
 func TestProcessReceiptWithInvalidTime(t *testing.T) {
 
 	payload := &models.Receipt{
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "8:00 PM",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 		},
 	}
@@ -248,12 +218,7 @@ func TestProcessReceiptWithInvalidTime(t *testing.T) {
 	}
 	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
 
-	b, err := io.ReadAll(resp.Body)
-	if err != nil {
-		t.Errorf("Failed to read HTTP response: %v", err)
-	}
-
-	assert.Equal(t, "The receipt is invalid.", string(b))
+	assertInvalidFields(t, resp, "purchaseTime")
 }
 
 func TestProcessValidReceipt1(t *testing.T) {
@@ -261,29 +226,29 @@ func TestProcessValidReceipt1(t *testing.T) {
 	payload := &models.Receipt{
 		UserID:       "TestUser1",
 		Retailer:     "Target",
-		Total:        "35.35",
+		Total:        models.MoneyFromString("35.35"),
 		PurchaseDate: "2022-01-01",
 		PurchaseTime: "16:59",
 		Items: []models.Item{
 			{
 				ShortDescription: "Mountain Dew 12PK",
-				Price:            "6.49",
+				Price:            models.MoneyFromString("6.49"),
 			},
 			{
 				ShortDescription: "Emils Cheese Pizza",
-				Price:            "12.25",
+				Price:            models.MoneyFromString("12.25"),
 			},
 			{
 				ShortDescription: "Knorr Creamy Chicken",
-				Price:            "1.26",
+				Price:            models.MoneyFromString("1.26"),
 			},
 			{
 				ShortDescription: "Doritos Nacho Cheese",
-				Price:            "3.35",
+				Price:            models.MoneyFromString("3.35"),
 			},
 			{
 				ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ",
-				Price:            "12.00",
+				Price:            models.MoneyFromString("12.00"),
 			},
 		},
 	}
@@ -315,25 +280,25 @@ func TestProcessValidReceipt2(t *testing.T) {
 	payload := &models.Receipt{
 		UserID:       "TestUser1",
 		Retailer:     "M&M Corner Market",
-		Total:        "9.00",
+		Total:        models.MoneyFromString("9.00"),
 		PurchaseDate: "2022-03-20",
 		PurchaseTime: "14:33",
 		Items: []models.Item{
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 		},
 	}
@@ -365,25 +330,25 @@ func TestProcessValidReceipt3(t *testing.T) {
 	payload := &models.Receipt{
 		UserID:       "TestUser1",
 		Retailer:     "M&M Corner Market",
-		Total:        "9.00",
-		PurchaseDate: "2022-03-20",
+		Total:        models.MoneyFromString("9.00"),
+		PurchaseDate: "2022-03-22", // Another even day, so it isn't a duplicate of receipt 2
 		PurchaseTime: "14:33",
 		Items: []models.Item{
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 		},
 	}
@@ -415,25 +380,25 @@ func TestProcessValidReceipt4(t *testing.T) {
 	payload := &models.Receipt{
 		UserID:       "TestUser1",
 		Retailer:     "M&M Corner Market",
-		Total:        "9.00",
-		PurchaseDate: "2022-03-20",
+		Total:        models.MoneyFromString("9.00"),
+		PurchaseDate: "2022-03-24", // Another even day, so it isn't a duplicate of receipt 2
 		PurchaseTime: "14:33",
 		Items: []models.Item{
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 			{
 				ShortDescription: "Gatorade",
-				Price:            "2.25",
+				Price:            models.MoneyFromString("2.25"),
 			},
 		},
 	}
@@ -579,6 +544,146 @@ func TestGetPointsOfValidID4(t *testing.T) {
 	assert.Equal(t, int64(109), respInfo.Points)
 }
 
+func TestGetPointsBreakdownOfInvalidID(t *testing.T) {
+
+	resp, err := getPointsBreakdown(uuid.New().String())
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read HTTP response: %v", err)
+	}
+
+	assert.Equal(t, "No receipt found for that ID.", string(b))
+}
+
+func TestGetPointsBreakdownOfValidID1(t *testing.T) {
+	resp, err := getPointsBreakdown(Receipt1ID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read HTTP response: %v", err)
+	}
+
+	var respInfo models.GetPointsBreakdownResponse
+	err = json.Unmarshal(respBytes, &respInfo)
+	if !assert.NoError(t, err) {
+		t.Errorf("Recieved unexpected response: %v", string(respBytes))
+	}
+
+	assert.Equal(t, int64(1028), respInfo.Points)
+
+	total := int64(0)
+	for _, result := range respInfo.Breakdown {
+		assert.NotEmpty(t, result.Reason)
+		total += result.Points
+	}
+	assert.Equal(t, respInfo.Points, total)
+
+	last := respInfo.Breakdown[len(respInfo.Breakdown)-1]
+	assert.Equal(t, models.ReceiptBonusName, last.Rule)
+	assert.Equal(t, int64(1000), last.Points)
+}
+
+func TestGetPointsBreakdownOfValidID4(t *testing.T) {
+	resp, err := getPointsBreakdown(Receipt4ID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read HTTP response: %v", err)
+	}
+
+	var respInfo models.GetPointsBreakdownResponse
+	err = json.Unmarshal(respBytes, &respInfo)
+	if !assert.NoError(t, err) {
+		t.Errorf("Recieved unexpected response: %v", string(respBytes))
+	}
+
+	assert.Equal(t, int64(109), respInfo.Points)
+	for _, result := range respInfo.Breakdown {
+		assert.NotEqual(t, models.ReceiptBonusName, result.Rule)
+	}
+}
+
+func TestGetReceiptOfNonexistantReceipt(t *testing.T) {
+
+	resp, err := getReceipt(uuid.New().String())
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read HTTP response: %v", err)
+	}
+
+	assert.Equal(t, "No receipt found for that ID.", string(b))
+}
+
+func TestGetReceiptOfValidID1(t *testing.T) {
+	resp, err := getReceipt(Receipt1ID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("Failed to read HTTP response: %v", err)
+	}
+
+	var respInfo models.GetReceiptResponse
+	err = json.Unmarshal(respBytes, &respInfo)
+	if !assert.NoError(t, err) {
+		t.Errorf("Recieved unexpected response: %v", string(respBytes))
+	}
+
+	assert.Equal(t, Receipt1ID, respInfo.ID)
+	assert.Equal(t, "TestUser1", respInfo.UserID)
+	assert.Equal(t, "Target", respInfo.Retailer)
+	assert.Equal(t, "35.35", respInfo.Total.String())
+	assert.Equal(t, "2022-01-01", respInfo.PurchaseDate)
+	assert.Equal(t, "16:59", respInfo.PurchaseTime)
+	assert.Len(t, respInfo.Items, 5)
+	assert.Equal(t, "   Klarbrunn 12-PK 12 FL OZ  ", respInfo.Items[4].ShortDescription)
+	assert.Equal(t, int64(1028), respInfo.Points)
+	assert.False(t, respInfo.ProcessedAt.IsZero())
+}
+
+// Helper function to check that a receipt was rejected because of exactly the given fields
+func assertInvalidFields(t *testing.T, resp *http.Response, fields ...string) {
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	var problem models.ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&problem)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "invalid-receipt", problem.Type)
+	assert.Equal(t, http.StatusBadRequest, problem.Status)
+
+	invalid := []string{}
+	for _, fieldErr := range problem.Errors {
+		invalid = append(invalid, fieldErr.Field)
+	}
+	assert.Equal(t, fields, invalid)
+}
+
 // Helper function to abstract logic of making call to ProcessReceipt
 func processReceipt(receipt *models.Receipt) (*http.Response, error) {
 	buf, err := json.Marshal(receipt)
@@ -609,3 +714,29 @@ func getPoints(id string) (*http.Response, error) {
 
 	return client.Do(req)
 }
+
+// Helper function to abstract logic of making call to GetPointsBreakdown
+func getPointsBreakdown(id string) (*http.Response, error) {
+	url := ServerEndpoint + "/receipts/" + id + "/points/breakdown"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
+
+// Helper function to abstract logic of making call to GetReceipt
+func getReceipt(id string) (*http.Response, error) {
+	url := ServerEndpoint + "/receipts/" + id
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
@@ -0,0 +1,189 @@
+/**
+expiry_test.go
+
+Tests that awarded points expire according to the expiry policy
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryPolicyExpiresAt(t *testing.T) {
+	record := &models.ReceiptRecord{Receipt: targetReceipt, ProcessedAt: time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)}
+
+	assert.Nil(t, models.ExpiryPolicy{}.ExpiresAt(record))
+	assert.Equal(t, time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		*models.ExpiryPolicy{Months: 12, Basis: models.ExpiryBasisPurchase}.ExpiresAt(record))
+	assert.Equal(t, time.Date(2025, 6, 1, 15, 4, 5, 0, time.UTC),
+		*models.ExpiryPolicy{Months: 6, Basis: models.ExpiryBasisProcessed}.ExpiresAt(record))
+
+	assert.Error(t, models.ExpiryPolicy{Months: 12}.Validate())
+	assert.Error(t, models.ExpiryPolicy{Months: -1, Basis: models.ExpiryBasisPurchase}.Validate())
+}
+
+func TestUnspentExpiringPoints(t *testing.T) {
+	jan := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	ledger := []models.LedgerEntry{
+		{Amount: 100, ExpiresAt: &feb, ReceiptID: "b"},
+		{Amount: 50, ExpiresAt: &jan, ReceiptID: "a"},
+		{Amount: 70},
+		{Amount: -80, Kind: models.LedgerEntryRedemption},
+		{Amount: 40, ExpiresAt: &mar, ReceiptID: "c"},
+	}
+
+	// The redemption spends the credit expiring in January, then part of February's
+	assert.Equal(t, []models.ExpiringPoints{
+		{ExpiresAt: feb, Points: 70, ReceiptID: "b"},
+		{ExpiresAt: mar, Points: 40, ReceiptID: "c"},
+	}, models.UnspentExpiringPoints(ledger))
+
+	assert.Equal(t, int64(0), models.PointsToExpire(ledger, jan))
+	assert.Equal(t, int64(70), models.PointsToExpire(ledger, feb))
+	assert.Equal(t, int64(110), models.PointsToExpire(ledger, mar))
+
+	// Once expired points are debited, nothing is left to expire until the next credit does
+	ledger = append(ledger, models.NewExpiryDebit("", 70, feb))
+	assert.Equal(t, int64(0), models.PointsToExpire(ledger, feb))
+	assert.Equal(t, int64(40), models.PointsToExpire(ledger, mar))
+
+	// A receipt's own debits cancel its credits rather than spending the soonest to expire
+	assert.Equal(t, int64(0), models.UnspentReceiptPoints(ledger, "a"))
+	assert.Equal(t, int64(0), models.UnspentReceiptPoints(ledger, "b"))
+	assert.Equal(t, int64(40), models.UnspentReceiptPoints(ledger, "c"))
+	ledger = append(ledger, models.LedgerEntry{Amount: -15, Kind: models.LedgerEntryRescore, ReceiptID: "c"})
+	assert.Equal(t, int64(25), models.UnspentReceiptPoints(ledger, "c"))
+	assert.Equal(t, int64(25), models.PointsToExpire(ledger, mar))
+
+	// Points that never expire are spent last, so they are unspent up to what the balance holds
+	ledger = append(ledger, models.LedgerEntry{Amount: 30, ReceiptID: "d"})
+	assert.Equal(t, int64(30), models.UnspentReceiptPoints(ledger, "d"))
+	ledger = append(ledger, models.LedgerEntry{Amount: -110, Kind: models.LedgerEntryRedemption})
+	assert.Equal(t, int64(0), models.UnspentReceiptPoints(ledger, "c"))
+	assert.Equal(t, int64(15), models.UnspentReceiptPoints(ledger, "d"))
+}
+
+func TestStoreExpirePoints(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		expiresAt := processedAt.AddDate(1, 0, 0)
+		for i, id := range []string{"a", "b"} {
+			record := &models.ReceiptRecord{ID: id, Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+			record.Receipt.UserID = "TestUser1"
+			if i == 0 {
+				record.PointsExpireAt = &expiresAt
+			}
+			assert.NoError(t, store.SaveReceipt(record))
+		}
+
+		loaded, err := store.GetReceipt("a")
+		assert.NoError(t, err)
+		assert.Equal(t, &expiresAt, loaded.PointsExpireAt)
+
+		_, _, err = store.Redeem(models.LedgerEntry{UserID: "TestUser1", Kind: models.LedgerEntryRedemption, Amount: -9})
+		assert.NoError(t, err)
+
+		userIDs, err := store.ExpiringUsers(expiresAt.Add(-time.Second))
+		assert.NoError(t, err)
+		assert.Empty(t, userIDs)
+
+		entry, err := store.ExpirePoints("TestUser1", expiresAt.Add(-time.Second))
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		userIDs, err = store.ExpiringUsers(expiresAt)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"TestUser1"}, userIDs)
+
+		entry, err = store.ExpirePoints("TestUser1", expiresAt)
+		assert.NoError(t, err)
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, models.LedgerEntryExpiry, entry.Kind)
+			assert.Equal(t, int64(-100), entry.Amount)
+			assert.Equal(t, int64(109), entry.Balance)
+		}
+
+		// Expiring again is a no-op
+		entry, err = store.ExpirePoints("TestUser1", expiresAt.AddDate(1, 0, 0))
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		entries, err := store.ListLedger("TestUser1", 0, 10)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 4) {
+			assert.Equal(t, &expiresAt, entries[0].ExpiresAt)
+			assert.Nil(t, entries[1].ExpiresAt)
+		}
+	})
+}
+
+func TestExpiryPolicyInProcess(t *testing.T) {
+	defer controller.SetExpiryPolicy(models.ExpiryPolicy{})
+
+	// Points for receipts purchased years ago expire a year after the purchase, so they already have
+	assert.NoError(t, controller.SetExpiryPolicy(models.ExpiryPolicy{Months: 12, Basis: models.ExpiryBasisPurchase}))
+	userID := "ExpiryUser-" + uuid.New().String()
+	receipt := uniqueReceipt(targetReceipt)
+	receipt.UserID = userID
+	processReceiptInProcess(t, &receipt)
+
+	expiring := getUserExpiringPointsInProcess(t, userID, "0")
+	assert.Equal(t, int64(1028), expiring.Points)
+	if assert.Len(t, expiring.Expiring, 2) {
+		purchased, _ := time.Parse(models.DateFormat, receipt.PurchaseDate)
+		assert.Equal(t, purchased.AddDate(1, 0, 0), expiring.Expiring[0].ExpiresAt)
+	}
+
+	_, err := controller.ExpirePoints(time.Now().UTC())
+	assert.NoError(t, err)
+
+	expiring = getUserExpiringPointsInProcess(t, userID, "0")
+	assert.Equal(t, int64(0), expiring.Points)
+	assert.Empty(t, expiring.Expiring)
+
+	// Points measured from when they were processed expire well outside a 30 day window
+	assert.NoError(t, controller.SetExpiryPolicy(models.ExpiryPolicy{Months: 12, Basis: models.ExpiryBasisProcessed}))
+	receipt = uniqueReceipt(cornerMarketReceipt)
+	receipt.UserID = userID
+	processReceiptInProcess(t, &receipt)
+
+	assert.Equal(t, int64(0), getUserExpiringPointsInProcess(t, userID, "").Points)
+	assert.Equal(t, int64(609), getUserExpiringPointsInProcess(t, userID, "400").Points)
+}
+
+// Helper function to call GetUserExpiringPoints without a server
+func getUserExpiringPointsInProcess(t *testing.T, userID string, days string) *models.GetUserExpiringPointsResponse {
+	target := "/users/" + userID + "/points/expiring"
+	if days != "" {
+		target += "?days=" + days
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.SetPathValue("userId", userID)
+	rec := httptest.NewRecorder()
+	controller.GetUserExpiringPoints(rec, req)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+
+	var resp models.GetUserExpiringPointsResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return &resp
+}
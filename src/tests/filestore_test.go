@@ -0,0 +1,169 @@
+/**
+filestore_test.go
+
+Tests that the file store recovers everything it acknowledged, including after the process is killed mid-write
+*/
+
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Set when this test binary is re-run as the process that gets killed
+const crashDirEnv = "FILESTORE_CRASH_DIR"
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store := mustOpenFileStore(t, dir, 0)
+	assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: "a", Points: 10}))
+	_, err := store.IncrementReceiptCount("TestUser1")
+	assert.NoError(t, err)
+
+	// Reopening without closing replays the log
+	reopened := mustOpenFileStore(t, dir, 0)
+	record, err := reopened.GetReceipt("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), record.Points)
+
+	n, err := reopened.ReceiptCount("TestUser1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	_, err = reopened.GetReceipt("b")
+	assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+
+	// Closing snapshots the state
+	assert.NoError(t, reopened.Close())
+	reopened = mustOpenFileStore(t, dir, 0)
+	_, err = reopened.GetReceipt("a")
+	assert.NoError(t, err)
+	reopened.Close()
+}
+
+func TestFileStoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	store := mustOpenFileStore(t, dir, 2)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: fmt.Sprint(i), Points: int64(i)}))
+	}
+	assert.FileExists(t, filepath.Join(dir, "snapshot.json"))
+
+	reopened := mustOpenFileStore(t, dir, 2)
+	for i := 0; i < 5; i++ {
+		record, err := reopened.GetReceipt(fmt.Sprint(i))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), record.Points)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	store := mustOpenFileStore(t, dir, 0)
+	assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: "a", Points: 10}))
+
+	// Simulate a crash part way through writing the next entry
+	f, err := os.OpenFile(filepath.Join(dir, "receipts.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.Write([]byte(`{"seq":2,"op":"saveReceipt","receipt":{"id":"b","poi`))
+	f.Close()
+
+	reopened := mustOpenFileStore(t, dir, 0)
+	_, err = reopened.GetReceipt("a")
+	assert.NoError(t, err)
+	_, err = reopened.GetReceipt("b")
+	assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+
+	// New entries are appended after the discarded one
+	assert.NoError(t, reopened.SaveReceipt(&models.ReceiptRecord{ID: "c", Points: 30}))
+	reopened = mustOpenFileStore(t, dir, 0)
+	_, err = reopened.GetReceipt("c")
+	assert.NoError(t, err)
+}
+
+func TestFileStoreCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	// Kill a writer several times at arbitrary points, including mid-snapshot
+	acked := []string{}
+	for round := 0; round < 5; round++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestFileStoreCrashHelper$")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", crashDirEnv, dir), fmt.Sprintf("FILESTORE_CRASH_ROUND=%v", round))
+		stdout, err := cmd.StdoutPipe()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, cmd.Start()) {
+			t.FailNow()
+		}
+
+		scanner := bufio.NewScanner(stdout)
+		n := 0
+		for n < 100+round*37 && scanner.Scan() {
+			id, ok := strings.CutPrefix(scanner.Text(), "ack ")
+			if ok {
+				acked = append(acked, id)
+				n++
+			}
+		}
+
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+
+	store := mustOpenFileStore(t, dir, 0)
+	for _, id := range acked {
+		_, err := store.GetReceipt(id)
+		assert.NoError(t, err, "acknowledged receipt %v was lost", id)
+	}
+}
+
+// Not a real test, this is the process killed by `TestFileStoreCrashRecovery`
+// Writes receipts forever, printing each ID once the store has acknowledged it
+func TestFileStoreCrashHelper(t *testing.T) {
+	dir := os.Getenv(crashDirEnv)
+	if dir == "" {
+		t.Skip("only runs as a subprocess of TestFileStoreCrashRecovery")
+	}
+
+	store, err := controller.OpenFileStore(dir, 50)
+	if err != nil {
+		fmt.Printf("failed to open store: %v\n", err)
+		os.Exit(1)
+	}
+
+	round := os.Getenv("FILESTORE_CRASH_ROUND")
+	for i := 0; ; i++ {
+		id := fmt.Sprintf("%v-%v", round, i)
+		err := store.SaveReceipt(&models.ReceiptRecord{ID: id, Points: int64(i)})
+		if err != nil {
+			fmt.Printf("failed to save receipt: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("ack %v\n", id)
+	}
+}
+
+// Helper function to open a file store or fail the test
+func mustOpenFileStore(t *testing.T, dir string, snapshotEvery int) *controller.FileStore {
+	store, err := controller.OpenFileStore(dir, snapshotEvery)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return store
+}
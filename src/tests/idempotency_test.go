@@ -0,0 +1,134 @@
+/**
+idempotency_test.go
+
+Makes HTTP calls to the ProcessReceipt endpoint to test that retries with an Idempotency-Key are replayed
+Assumes that the server is running on 'http://localhost:3000'
+*/
+
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessReceiptWithIdempotencyKey(t *testing.T) {
+
+	key := uuid.New().String()
+	receipt := uniqueReceipt(targetReceipt)
+	receipt.UserID = "IdempotentUser-" + uuid.New().String()
+
+	resp, err := processReceiptWithKey(&receipt, key)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	first, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	// The retry gets the same response, instead of being rejected as a duplicate
+	resp, err = processReceiptWithKey(&receipt, key)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	second, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, string(first), string(second))
+
+	// Reusing the key for a different receipt is an error
+	other := uniqueReceipt(targetReceipt)
+	resp, err = processReceiptWithKey(&other, key)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, "idempotency-key-reused", decodeProblem(t, resp).Type)
+}
+
+func TestProcessInvalidReceiptWithIdempotencyKey(t *testing.T) {
+
+	key := uuid.New().String()
+	receipt := models.Receipt{Retailer: "Target"}
+
+	// Errors are replayed too
+	for i := 0; i < 2; i++ {
+		resp, err := processReceiptWithKey(&receipt, key)
+		if err != nil {
+			t.Errorf("Failed to make HTTP request: %v", err)
+		}
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, i == 1, resp.Header.Get("Idempotent-Replayed") == "true")
+	}
+}
+
+func TestProcessReceiptWithIdempotencyKeyConcurrently(t *testing.T) {
+	const nRequests = 20
+
+	key := uuid.New().String()
+	receipt := uniqueReceipt(cornerMarketReceipt)
+	receipt.UserID = "IdempotentUser-" + uuid.New().String()
+
+	// Every retry, even one made while the first request is in flight, gets the first receipt's ID
+	var wg sync.WaitGroup
+	ids := make(chan string, nRequests)
+	for i := 0; i < nRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := processReceiptWithKey(&receipt, key)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var respInfo models.ProcessReceiptResponse
+			err = json.NewDecoder(resp.Body).Decode(&respInfo)
+			if assert.NoError(t, err) {
+				ids <- respInfo.Id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{}
+	for id := range ids {
+		seen[id] = true
+	}
+	assert.Len(t, seen, 1)
+}
+
+// Helper function to make a call to ProcessReceipt with an Idempotency-Key header
+func processReceiptWithKey(receipt *models.Receipt, key string) (*http.Response, error) {
+	buf, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	url := ServerEndpoint + controller.ProcessReceiptPath
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Idempotency-Key", key)
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
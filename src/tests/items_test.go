@@ -0,0 +1,140 @@
+/**
+items_test.go
+
+Tests item quantities, unit prices, barcodes and discount lines
+*/
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Same items as `cornerMarketReceipt`, written as a single line of 4 along with a coupon
+var quantityReceipt = models.Receipt{
+	Retailer:     "M&M Corner Market",
+	Total:        models.MustParseMoney("8.00"),
+	PurchaseDate: "2022-03-20",
+	PurchaseTime: "14:33",
+	Items: []models.Item{
+		{
+			ShortDescription: "Gatorade",
+			Price:            models.MustParseMoney("9.00"),
+			Quantity:         quantity(4),
+			UnitPrice:        money("2.25"),
+			SKU:              "GAT-32-BLUE",
+			UPC:              "036000291452",
+		},
+		{ShortDescription: "Coupon", Price: models.MustParseMoney("-1.00"), Discount: true},
+	},
+}
+
+// Helper function to take the address of a quantity
+func quantity(n int64) *int64 {
+	return &n
+}
+
+// Helper function to take the address of an amount
+func money(s string) *models.Money {
+	m := models.MustParseMoney(s)
+	return &m
+}
+
+func TestItemQuantities(t *testing.T) {
+	assert.NoError(t, quantityReceipt.ValidateProperties())
+	assert.NoError(t, models.DefaultRuleSet().CheckReceipt(&quantityReceipt, time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, int64(4), quantityReceipt.ItemCount())
+
+	// Scored like the same 4 items on separate lines, with the coupon only changing the total
+	rules := models.NewRuleSet(&models.ItemPairsRule{PointsPerPair: 5}, &models.DescriptionLengthRule{LengthMultiple: 3, PriceMultiplier: 0.2})
+	assert.Equal(t, int64(10), rules.Score(&quantityReceipt))
+	assert.Equal(t, rules.Score(&cornerMarketReceipt), rules.Score(&quantityReceipt))
+
+	// Each line counts once without a quantity
+	receipt := quantityReceipt
+	receipt.Items = []models.Item{quantityReceipt.Items[0], quantityReceipt.Items[1]}
+	receipt.Items[0].Quantity = nil
+	receipt.Items[0].UnitPrice = nil
+	assert.Equal(t, int64(1), receipt.ItemCount())
+}
+
+func TestItemQuantityLimit(t *testing.T) {
+	// A free item can't be bought in bulk to farm points for pairs
+	receipt := targetReceipt
+	receipt.Total = models.MustParseMoney("0.00")
+	receipt.Items = []models.Item{{ShortDescription: "Free sample", Price: models.MustParseMoney("0.00"), Quantity: quantity(1_000_000)}}
+
+	var errs models.ValidationErrors
+	if assert.ErrorAs(t, receipt.ValidateProperties(), &errs) {
+		assert.Equal(t, "items[0].quantity", errs[0].Field)
+		assert.Equal(t, models.ValidationOutOfRange, errs[0].Code)
+	}
+
+	receipt.Items[0].Quantity = quantity(models.MaxItemQuantity)
+	assert.NoError(t, receipt.ValidateProperties())
+	assert.Equal(t, int64(models.MaxItemQuantity/2*5), (&models.ItemPairsRule{PointsPerPair: 5}).Apply(&receipt)[0].Points)
+}
+
+func TestValidateItemLines(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		modify func(item *models.Item)
+		field  string
+		code   string
+	}{
+		{"zero quantity", func(item *models.Item) { item.Quantity = quantity(0) }, "items[0].quantity", models.ValidationOutOfRange},
+		{"too many units", func(item *models.Item) { item.Quantity = quantity(models.MaxItemQuantity + 1) }, "items[0].quantity", models.ValidationOutOfRange},
+		{"wrong line total", func(item *models.Item) { item.UnitPrice = money("2.50") }, "items[0].price", models.ValidationInconsistent},
+		{"negative unit price", func(item *models.Item) { item.UnitPrice = money("-2.25") }, "items[0].unitPrice", models.ValidationOutOfRange},
+		{"bad check digit", func(item *models.Item) { item.UPC = "036000291453" }, "items[0].upc", models.ValidationInvalidFormat},
+		{"bad sku", func(item *models.Item) { item.SKU = "-GAT 32" }, "items[0].sku", models.ValidationInvalidFormat},
+		{"negative price", func(item *models.Item) { item.Price = models.MustParseMoney("-9.00") }, "items[0].price", models.ValidationOutOfRange},
+		{"positive discount", func(item *models.Item) { item.Discount = true }, "items[0].price", models.ValidationOutOfRange},
+	} {
+		receipt := quantityReceipt
+		receipt.Items = []models.Item{quantityReceipt.Items[0], quantityReceipt.Items[1]}
+		c.modify(&receipt.Items[0])
+
+		var errs models.ValidationErrors
+		if assert.ErrorAs(t, receipt.ValidateProperties(), &errs, c.name) {
+			assert.Equal(t, c.field, errs[0].Field, c.name)
+			assert.Equal(t, c.code, errs[0].Code, c.name)
+		}
+	}
+
+	// EAN-13 barcodes are accepted too
+	item := quantityReceipt.Items[0]
+	item.UPC = "4006381333931"
+	assert.NoError(t, item.ValidateProperties())
+}
+
+func TestFingerprintItemLines(t *testing.T) {
+	receipt := quantityReceipt
+	receipt.Items = []models.Item{quantityReceipt.Items[0], quantityReceipt.Items[1]}
+	receipt.Items[0].SKU = "GAT-32-RED"
+	assert.NotEqual(t, quantityReceipt.Fingerprint(), receipt.Fingerprint())
+}
+
+func TestStoreItemLines(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        quantityReceipt,
+			Points:         10,
+			Breakdown:      []models.RuleResult{},
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC),
+		}
+		assert.NoError(t, store.SaveReceipt(record))
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, record.Receipt, loaded.Receipt)
+		}
+	})
+}
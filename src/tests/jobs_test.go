@@ -0,0 +1,183 @@
+/**
+jobs_test.go
+
+Tests processing receipts in the background and polling their jobs
+*/
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Store that holds up looking for duplicates until it's released, so jobs can be kept on the queue
+type blockingStore struct {
+	controller.Store
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) FindReceiptByFingerprint(fingerprint string) (string, error) {
+	select {
+	case s.entered <- struct{}{}:
+	case <-s.release:
+	}
+	<-s.release
+	return s.Store.FindReceiptByFingerprint(fingerprint)
+}
+
+// Helper function to ask for a receipt to be processed in the background without going through the server
+func processReceiptAsyncInProcess(t *testing.T, receipt *models.Receipt) *httptest.ResponseRecorder {
+	buf, err := json.Marshal(receipt)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(string(buf)))
+	req.Header.Set("Prefer", "respond-async")
+	rec := httptest.NewRecorder()
+	controller.ProcessReceipt(rec, req)
+
+	return rec
+}
+
+// Helper function to get a job without going through the server
+func getJobInProcess(t *testing.T, id string) (int, *models.Job) {
+	req := httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	controller.GetJob(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+
+	var job models.Job
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+	return rec.Code, &job
+}
+
+// Helper function to poll a job until it's no longer pending
+func waitForJob(t *testing.T, id string) *models.Job {
+	var job *models.Job
+	assert.Eventually(t, func() bool {
+		_, job = getJobInProcess(t, id)
+		return job != nil && job.Status != models.JobStatusPending
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return job
+}
+
+func TestProcessReceiptAsync(t *testing.T) {
+	// Without workers running the preference is ignored
+	receipt := uniqueReceipt(targetReceipt)
+	rec := processReceiptAsyncInProcess(t, &receipt)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	if !assert.NoError(t, controller.StartJobWorkers(10, 2, time.Hour)) {
+		return
+	}
+	defer controller.DrainJobs(context.Background())
+	assert.Error(t, controller.StartJobWorkers(10, 2, time.Hour))
+
+	// The user's first receipt also earns a bonus
+	receipt = uniqueReceipt(targetReceipt)
+	receipt.UserID = "JobUser-" + uuid.New().String()
+	rec = processReceiptAsyncInProcess(t, &receipt)
+	if !assert.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	var queued models.Job
+	if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued)) {
+		return
+	}
+	assert.Equal(t, models.JobStatusPending, queued.Status)
+	assert.Equal(t, "/jobs/"+queued.ID, rec.Header().Get("Location"))
+	assert.Equal(t, "respond-async", rec.Header().Get("Preference-Applied"))
+
+	job := waitForJob(t, queued.ID)
+	if assert.NotNil(t, job) && assert.Equal(t, models.JobStatusDone, job.Status) {
+		assert.NotNil(t, job.CompletedAt)
+		assert.Equal(t, int64(1028), getPointsInProcess(t, job.ReceiptID).Points)
+	}
+
+	// Invalid receipts are only found to be invalid by the job
+	receipt = uniqueReceipt(restaurantReceipt)
+	receipt.Tip = money("6.00")
+	rec = processReceiptAsyncInProcess(t, &receipt)
+	if assert.Equal(t, http.StatusAccepted, rec.Code) && assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued)) {
+		job = waitForJob(t, queued.ID)
+		if assert.NotNil(t, job) && assert.Equal(t, models.JobStatusFailed, job.Status) {
+			assert.Empty(t, job.ReceiptID)
+			assert.Equal(t, controller.ErrorTypeInvalidReceipt, job.Error.Type)
+			assert.Equal(t, models.ValidationTotalPartsMismatch, job.Error.Errors[0].Code)
+		}
+	}
+
+	// Malformed receipts are still rejected straight away
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(`{"retailer": `))
+	req.Header.Set("Prefer", "wait=10, respond-async")
+	rec = httptest.NewRecorder()
+	controller.ProcessReceipt(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	code, _ := getJobInProcess(t, "not-a-job")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestProcessReceiptAsyncQueueFull(t *testing.T) {
+	store := &blockingStore{Store: controller.ActiveStore(), entered: make(chan struct{}), release: make(chan struct{})}
+	controller.SetStore(store)
+	defer controller.SetStore(store.Store)
+
+	if !assert.NoError(t, controller.StartJobWorkers(1, 1, time.Hour)) {
+		return
+	}
+
+	// The worker holds the first receipt and the second fills the queue
+	first := uniqueReceipt(targetReceipt)
+	rec := processReceiptAsyncInProcess(t, &first)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	<-store.entered
+
+	second := uniqueReceipt(targetReceipt)
+	rec = processReceiptAsyncInProcess(t, &second)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	var queued models.Job
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued))
+
+	third := uniqueReceipt(targetReceipt)
+	rec = processReceiptAsyncInProcess(t, &third)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), controller.ErrorTypeQueueFull)
+
+	// Draining gives up when the context is done, but the queued jobs still finish
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, controller.DrainJobs(ctx), context.DeadlineExceeded)
+
+	close(store.release)
+	assert.NoError(t, controller.DrainJobs(context.Background()))
+
+	_, job := getJobInProcess(t, queued.ID)
+	if assert.NotNil(t, job) {
+		assert.Equal(t, models.JobStatusDone, job.Status)
+	}
+
+	// Once drained, receipts are processed straight away again
+	rec = processReceiptAsyncInProcess(t, &third)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
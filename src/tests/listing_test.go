@@ -0,0 +1,171 @@
+/**
+listing_test.go
+
+Tests listing receipts with filters and cursor pagination
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to list the IDs of the receipts in a store matching the filter
+func listReceiptIDs(t *testing.T, store controller.Store, filter models.ReceiptFilter, after models.ReceiptPosition, limit int) []string {
+	records, err := store.ListReceipts(filter, after, limit)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+func TestStoreListReceipts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		for _, c := range []struct {
+			id          string
+			userID      string
+			receipt     models.Receipt
+			points      int64
+			processedAt time.Time
+		}{
+			{"d", "alice", targetReceipt, 28, processedAt.Add(time.Hour)},
+			{"b", "bob", cornerMarketReceipt, 109, processedAt},
+			{"a", "alice", cornerMarketReceipt, 109, processedAt},
+			{"c", "alice", targetReceipt, 1028, processedAt.Add(time.Minute)},
+		} {
+			receipt := c.receipt
+			receipt.UserID = c.userID
+			record := &models.ReceiptRecord{
+				ID:             c.id,
+				Receipt:        receipt,
+				Points:         c.points,
+				Breakdown:      []models.RuleResult{},
+				RuleSetVersion: models.DefaultRuleSetVersion,
+				ProcessedAt:    c.processedAt,
+			}
+			if !assert.NoError(t, store.SaveReceipt(record)) {
+				return
+			}
+		}
+
+		// Ordered by when they were processed, then by ID
+		all := models.ReceiptFilter{}
+		assert.Equal(t, []string{"a", "b", "c", "d"}, listReceiptIDs(t, store, all, models.ReceiptPosition{}, 10))
+		assert.Equal(t, []string{"a", "b"}, listReceiptIDs(t, store, all, models.ReceiptPosition{}, 2))
+		assert.Equal(t, []string{"b", "c"}, listReceiptIDs(t, store, all, models.ReceiptPosition{ProcessedAt: processedAt, ID: "a"}, 2))
+		assert.Empty(t, listReceiptIDs(t, store, all, models.ReceiptPosition{ProcessedAt: processedAt.Add(time.Hour), ID: "d"}, 2))
+
+		// Listed receipts are loaded in full, items included
+		records, err := store.ListReceipts(all, models.ReceiptPosition{}, 10)
+		if assert.NoError(t, err) {
+			for _, record := range records {
+				loaded, err := store.GetReceipt(record.ID)
+				if assert.NoError(t, err) {
+					assert.Equal(t, loaded, record)
+				}
+			}
+		}
+
+		minPoints, maxPoints := int64(100), int64(200)
+		from, to := processedAt.Add(time.Second), processedAt.Add(time.Hour)
+		for _, c := range []struct {
+			filter models.ReceiptFilter
+			ids    []string
+		}{
+			{models.ReceiptFilter{UserID: "alice"}, []string{"a", "c", "d"}},
+			{models.ReceiptFilter{Retailer: "corner MARKET"}, []string{"a", "b"}},
+			{models.ReceiptFilter{Retailer: "%"}, []string{}},
+			{models.ReceiptFilter{PurchaseDateFrom: "2022-01-02"}, []string{"a", "b"}},
+			{models.ReceiptFilter{PurchaseDateTo: "2022-01-01"}, []string{"c", "d"}},
+			{models.ReceiptFilter{MinPoints: &minPoints}, []string{"a", "b", "c"}},
+			{models.ReceiptFilter{MinPoints: &minPoints, MaxPoints: &maxPoints}, []string{"a", "b"}},
+			{models.ReceiptFilter{ProcessedFrom: &from, ProcessedTo: &to}, []string{"c"}},
+			{models.ReceiptFilter{UserID: "alice", Retailer: "target", MaxPoints: &maxPoints}, []string{"d"}},
+		} {
+			assert.Equal(t, c.ids, listReceiptIDs(t, store, c.filter, models.ReceiptPosition{}, 10), c.filter)
+		}
+	})
+}
+
+// Helper function to list receipts without going through the server
+func listReceiptsInProcess(t *testing.T, query url.Values) (int, *models.ListReceiptsResponse) {
+	req := httptest.NewRequest(http.MethodGet, controller.ListReceiptsPath+"?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	controller.ListReceipts(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+
+	var resp models.ListReceiptsResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return rec.Code, &resp
+}
+
+func TestListReceipts(t *testing.T) {
+	userID := "ListUser-" + uuid.New().String()
+	ids := []string{}
+	for _, receipt := range []models.Receipt{targetReceipt, cornerMarketReceipt, targetReceipt} {
+		receipt = uniqueReceipt(receipt)
+		receipt.UserID = userID
+		ids = append(ids, processReceiptInProcess(t, &receipt))
+	}
+
+	// Page through the user's receipts two at a time
+	code, page := listReceiptsInProcess(t, url.Values{"userId": {userID}, "limit": {"2"}})
+	if !assert.Equal(t, http.StatusOK, code) || !assert.Len(t, page.Receipts, 2) {
+		return
+	}
+	assert.Equal(t, ids[:2], []string{page.Receipts[0].ID, page.Receipts[1].ID})
+	assert.Equal(t, userID, page.Receipts[0].UserID)
+	assert.NotEmpty(t, page.NextCursor)
+
+	code, page = listReceiptsInProcess(t, url.Values{"userId": {userID}, "limit": {"2"}, "cursor": {page.NextCursor}})
+	if assert.Equal(t, http.StatusOK, code) && assert.Len(t, page.Receipts, 1) {
+		assert.Equal(t, ids[2], page.Receipts[0].ID)
+		assert.Empty(t, page.NextCursor)
+	}
+
+	// The first receipt earns a bonus, so it's the only one over 1000 points
+	code, page = listReceiptsInProcess(t, url.Values{"userId": {userID}, "minPoints": {"1000"}})
+	if assert.Equal(t, http.StatusOK, code) && assert.Len(t, page.Receipts, 1) {
+		assert.Equal(t, ids[0], page.Receipts[0].ID)
+	}
+
+	code, page = listReceiptsInProcess(t, url.Values{"userId": {userID}, "retailer": {"m&m"}})
+	if assert.Equal(t, http.StatusOK, code) && assert.Len(t, page.Receipts, 1) {
+		assert.Equal(t, ids[1], page.Receipts[0].ID)
+	}
+
+	code, page = listReceiptsInProcess(t, url.Values{"userId": {"ListUser-" + uuid.New().String()}})
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.Empty(t, page.Receipts)
+	}
+
+	for _, query := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"501"}},
+		{"cursor": {"not a cursor"}},
+		{"purchaseDateFrom": {"01/01/2022"}},
+		{"minPoints": {"many"}},
+		{"processedTo": {"2024-12-01"}},
+	} {
+		code, _ = listReceiptsInProcess(t, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
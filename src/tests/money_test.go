@@ -0,0 +1,124 @@
+/**
+money_test.go
+
+Tests that dollar amounts are parsed, encoded and scored exactly
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMoney(t *testing.T) {
+	m, err := models.ParseMoney("1234.05")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(123405), m.MinorUnits())
+	assert.Equal(t, "1234.05", m.String())
+
+	m, err = models.ParseMoney("1500")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, m.Exponent())
+	assert.Equal(t, "1500", m.String())
+
+	for _, s := range []string{"", "+1.00", "--1.00", "1.", ".50", "1.00001", "1e3", " 1.00", "99999999999999999999.00"} {
+		_, err = models.ParseMoney(s)
+		assert.Error(t, err, s)
+	}
+
+	assert.Equal(t, "-0.05", models.MoneyFromCents(-5).String())
+	assert.Equal(t, -1, models.MustParseMoney("-0.50").Sign())
+	assert.Equal(t, "7.50", moneyString(t)(models.MustParseMoney("2.50").Mul(3)))
+	assert.Equal(t, 1, models.MustParseMoney("6.49").Cmp(models.MustParseMoney("6.48")))
+	assert.Equal(t, "7.74", moneyString(t)(models.MustParseMoney("6.49").Add(models.MustParseMoney("1.25"))))
+	assert.Equal(t, "5.24", moneyString(t)(models.MustParseMoney("6.49").Sub(models.MustParseMoney("1.25"))))
+	assert.Equal(t, "7.990", moneyString(t)(models.MustParseMoney("6.49").Add(models.MustParseMoney("1.500"))))
+	assert.True(t, models.MustParseMoney("9.00").IsMultipleOf(models.MustParseMoney("0.25")))
+	assert.False(t, models.MustParseMoney("9.10").IsMultipleOf(models.MustParseMoney("0.25")))
+}
+
+// Helper function to format the result of money arithmetic that must not fail
+func moneyString(t *testing.T) func(models.Money, error) string {
+	return func(m models.Money, err error) string {
+		assert.NoError(t, err)
+		return m.String()
+	}
+}
+
+func TestMoneyOverflow(t *testing.T) {
+	// At most 15 significant digits, not counting leading zeros
+	_, err := models.ParseMoney("999999999999999")
+	assert.NoError(t, err)
+	_, err = models.ParseMoney("0009999999999999.999")
+	assert.Error(t, err)
+	_, err = models.ParseMoney("92233720368547758.07")
+	assert.Error(t, err)
+
+	largest := models.NewMoney(math.MaxInt64, 2)
+	_, err = largest.Add(models.MustParseMoney("0.01"))
+	assert.ErrorIs(t, err, models.ErrMoneyOverflow)
+	_, err = models.NewMoney(math.MinInt64, 2).Sub(models.MustParseMoney("0.01"))
+	assert.ErrorIs(t, err, models.ErrMoneyOverflow)
+	_, err = models.MustParseMoney("9223372036854.77").Mul(1_000_000)
+	assert.ErrorIs(t, err, models.ErrMoneyOverflow)
+	assert.Equal(t, "-92233720368547758.08", models.NewMoney(math.MinInt64, 2).String())
+
+	// Amounts are compared exactly even when aligning their decimal places would overflow
+	assert.Equal(t, 1, largest.Cmp(models.MustParseMoney("0.0001")))
+	assert.False(t, largest.IsMultipleOf(models.MustParseMoney("0.0003")))
+
+	// Item prices too large to add up can't match the total
+	receipt := targetReceipt
+	receipt.Items = []models.Item{{ShortDescription: "A", Price: largest}, {ShortDescription: "B", Price: largest}}
+	assert.NotEmpty(t, (&models.ItemsTotalValidator{Tolerance: models.MoneyFromCents(0)}).Check(&receipt, time.Time{}))
+}
+
+func TestMoneyMulCeil(t *testing.T) {
+	// 5.00 * 0.2 is 1.0000000000000002 with floats, which would round up to 2
+	assert.Equal(t, int64(1), models.MustParseMoney("5.00").MulCeil(0.2))
+	assert.Equal(t, int64(3), models.MustParseMoney("12.25").MulCeil(0.2))
+	assert.Equal(t, int64(1), models.MustParseMoney("0.01").MulCeil(0.2))
+	assert.Equal(t, int64(0), models.MustParseMoney("0.00").MulCeil(0.2))
+	assert.Equal(t, int64(7), models.MustParseMoney("0.70").MulCeil(10))
+}
+
+func TestDescriptionLengthRuleIsExact(t *testing.T) {
+	receipt := targetReceipt
+	receipt.Items = []models.Item{{ShortDescription: "Pizza Pie", Price: models.MustParseMoney("5.00")}}
+
+	results := (&models.DescriptionLengthRule{LengthMultiple: 3, PriceMultiplier: 0.2}).Apply(&receipt)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, int64(1), results[0].Points)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var item models.Item
+	assert.NoError(t, json.Unmarshal([]byte(`{"shortDescription": "Gatorade", "price": "2.25"}`), &item))
+	assert.Equal(t, models.MustParseMoney("2.25"), item.Price)
+
+	b, err := json.Marshal(item)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"shortDescription": "Gatorade", "price": "2.25"}`, string(b))
+
+	// Missing and invalid amounts are left for validation to report
+	assert.NoError(t, json.Unmarshal([]byte(`{"price": "2.2.2"}`), &item))
+	assert.True(t, item.Price.IsSet())
+	assert.False(t, item.Price.IsValid())
+
+	item = models.Item{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"price": null}`), &item))
+	assert.False(t, item.Price.IsSet())
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"price": 2.25}`), &item))
+	var errs models.ValidationErrors
+	if assert.ErrorAs(t, item.ValidateProperties(), &errs) {
+		assert.Equal(t, models.ValidationInvalidType, errs[1].Code)
+	}
+}
@@ -0,0 +1,133 @@
+/**
+reload_test.go
+
+Tests swapping the active rules while receipts are being scored
+Runs the controller in-process, so it doesn't depend on the server
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadRules(t *testing.T) {
+	defer controller.SetRuleSet(models.DefaultRuleSet())
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	writeFile(t, path, `{"version": "v1", "rules": [{"name": "oddDay"}]}`)
+
+	rules, err := controller.LoadRulesFile(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "v1", rules.Version)
+
+	// Receipts record the rules they were scored with
+	receipt := uniqueReceipt(cornerMarketReceipt)
+	id := processReceiptInProcess(t, &receipt)
+	assert.Equal(t, "v1", getPointsInProcess(t, id).RuleSetVersion)
+
+	// An invalid file keeps the current rules
+	writeFile(t, path, `{"version": "v2", "rules": [{"name": "notARule"}]}`)
+	_, err = controller.ReloadRules()
+	assert.Error(t, err)
+	assert.Equal(t, "v1", controller.ActiveRuleSet().Version)
+
+	req := httptest.NewRequest(http.MethodPost, controller.ReloadRulesPath, nil)
+	rec := httptest.NewRecorder()
+	controller.ReloadRulesHandler(rec, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), controller.ErrorTypeInvalidRules)
+	assert.NotContains(t, rec.Body.String(), path)
+	assert.NotContains(t, rec.Body.String(), "notARule")
+	assert.Equal(t, "v1", controller.ActiveRuleSet().Version)
+
+	// Reusing a version for different rules is rejected
+	writeFile(t, path, `{"version": "v1", "rules": [{"name": "roundDollar"}]}`)
+	_, err = controller.ReloadRules()
+	assert.Error(t, err)
+	assert.Equal(t, "v1", controller.ActiveRuleSet().Version)
+
+	writeFile(t, path, `{"version": "v2", "rules": [{"name": "roundDollar"}]}`)
+	req = httptest.NewRequest(http.MethodPost, controller.ReloadRulesPath, nil)
+	rec = httptest.NewRecorder()
+	controller.ReloadRulesHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var respInfo models.ReloadRulesResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &respInfo)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", respInfo.Version)
+	assert.Equal(t, []string{models.RoundDollarRuleName}, respInfo.Rules)
+
+	// Earlier receipts keep the version they were scored with
+	assert.Equal(t, "v1", getPointsInProcess(t, id).RuleSetVersion)
+	receipt = uniqueReceipt(cornerMarketReceipt)
+	id = processReceiptInProcess(t, &receipt)
+	assert.Equal(t, "v2", getPointsInProcess(t, id).RuleSetVersion)
+
+	v1, ok := controller.LookupRuleSet("v1")
+	assert.True(t, ok)
+	assert.Equal(t, []string{models.OddDayRuleName}, v1.RuleNames())
+}
+
+// Helper function to overwrite a file during a test
+func writeFile(t *testing.T, path string, contents string) {
+	err := os.WriteFile(path, []byte(contents), 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+}
+
+// Helper function to process a receipt without going through the server
+func processReceiptInProcess(t *testing.T, receipt *models.Receipt) string {
+	buf, err := json.Marshal(receipt)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(string(buf)))
+	rec := httptest.NewRecorder()
+	controller.ProcessReceipt(rec, req)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+
+	var respInfo models.ProcessReceiptResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &respInfo)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return respInfo.Id
+}
+
+// Helper function to get the points of a receipt without going through the server
+func getPointsInProcess(t *testing.T, id string) *models.GetPointsResponse {
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id+"/points", nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	controller.GetPoints(rec, req)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		t.FailNow()
+	}
+
+	var respInfo models.GetPointsResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &respInfo)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return &respInfo
+}
@@ -0,0 +1,296 @@
+/**
+rescore_test.go
+
+Tests rescoring processed receipts with a different rule set
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to build a rule set with only the odd day rule, under a version no other test uses
+func oddDayRuleSet(t *testing.T) *models.RuleSet {
+	rule, err := models.NewRule(models.OddDayRuleName)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	rules := models.NewRuleSet(rule)
+	rules.Version = "rescore-" + uuid.New().String()
+	return rules
+}
+
+func TestRuleSetRescore(t *testing.T) {
+	record := &models.ReceiptRecord{
+		ID:      "a",
+		Receipt: targetReceipt,
+		Points:  1028,
+		Breakdown: []models.RuleResult{
+			{Rule: models.RetailerAlphanumericRuleName, Points: 28},
+			{Rule: models.ReceiptBonusName, Points: 1000},
+		},
+		RuleSetVersion: models.DefaultRuleSetVersion,
+	}
+
+	// The bonus is kept, and the original record is left as it was
+	rules := oddDayRuleSet(t)
+	rescored := rules.Rescore(record)
+	assert.Equal(t, int64(1006), rescored.Points)
+	assert.Equal(t, rules.Version, rescored.RuleSetVersion)
+	if assert.Len(t, rescored.Breakdown, 2) {
+		assert.Equal(t, models.OddDayRuleName, rescored.Breakdown[0].Rule)
+		assert.Equal(t, models.ReceiptBonusName, rescored.Breakdown[1].Rule)
+	}
+	assert.Equal(t, int64(1028), record.Points)
+	assert.Equal(t, models.DefaultRuleSetVersion, record.RuleSetVersion)
+}
+
+func TestStoreRescoreReceipt(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		expiresAt := processedAt.AddDate(1, 0, 0)
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        cornerMarketReceipt,
+			Points:         109,
+			Breakdown:      []models.RuleResult{},
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    processedAt,
+			PointsExpireAt: &expiresAt,
+		}
+		record.Receipt.UserID = "TestUser1"
+		assert.NoError(t, store.SaveReceipt(record))
+
+		rescoredAt := processedAt.Add(time.Hour)
+		rescored := *record
+		rescored.Points = 150
+		rescored.Breakdown = []models.RuleResult{{Rule: models.RoundDollarRuleName, Points: 150}}
+		rescored.RuleSetVersion = "v2"
+		entry, err := store.RescoreReceipt(&rescored, rescoredAt)
+		if assert.NoError(t, err) && assert.NotNil(t, entry) {
+			assert.Equal(t, models.LedgerEntryRescore, entry.Kind)
+			assert.Equal(t, int64(41), entry.Amount)
+			assert.Equal(t, int64(150), entry.Balance)
+			assert.Equal(t, "a", entry.ReceiptID)
+			assert.Equal(t, &expiresAt, entry.ExpiresAt)
+		}
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(150), loaded.Points)
+			assert.Equal(t, "v2", loaded.RuleSetVersion)
+			assert.Equal(t, rescored.Breakdown, loaded.Breakdown)
+		}
+
+		// Debits don't expire, and an unchanged score adds no entry
+		rescored.Points = 100
+		rescored.RuleSetVersion = "v3"
+		entry, err = store.RescoreReceipt(&rescored, rescoredAt)
+		if assert.NoError(t, err) && assert.NotNil(t, entry) {
+			assert.Equal(t, int64(-50), entry.Amount)
+			assert.Nil(t, entry.ExpiresAt)
+		}
+
+		entry, err = store.RescoreReceipt(&rescored, rescoredAt)
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100), balance)
+
+		// Voiding takes back the rescored points
+		_, debit, err := store.VoidReceipt("a", "Returned", rescoredAt)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), debit.Balance)
+
+		_, err = store.RescoreReceipt(&rescored, rescoredAt)
+		assert.ErrorIs(t, err, controller.ErrReceiptVoided)
+		rescored.ID = "b"
+		_, err = store.RescoreReceipt(&rescored, rescoredAt)
+		assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+	})
+}
+
+func TestStoreRescoreReceiptAfterExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		expiresAt := processedAt.AddDate(1, 0, 0)
+		for _, id := range []string{"a", "b"} {
+			record := &models.ReceiptRecord{ID: id, Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+			record.Receipt.UserID = "TestUser1"
+			record.PointsExpireAt = &expiresAt
+			assert.NoError(t, store.SaveReceipt(record))
+		}
+
+		// The redemption spends most of the first receipt's points, so only the rest is taken back
+		_, _, err := store.Redeem(models.LedgerEntry{UserID: "TestUser1", Kind: models.LedgerEntryRedemption, Amount: -100})
+		assert.NoError(t, err)
+
+		rescored, err := store.GetReceipt("a")
+		if !assert.NoError(t, err) {
+			return
+		}
+		lower := *rescored
+		lower.Points = 50
+		lower.RuleSetVersion = "v2"
+		entry, err := store.RescoreReceipt(&lower, processedAt.Add(time.Hour))
+		if assert.NoError(t, err) && assert.NotNil(t, entry) {
+			assert.Equal(t, int64(-9), entry.Amount)
+			assert.Equal(t, int64(109), entry.Balance)
+		}
+
+		entry, err = store.ExpirePoints("TestUser1", expiresAt)
+		assert.NoError(t, err)
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, int64(-109), entry.Amount)
+		}
+
+		// Expired points were already debited, so rescoring lower takes nothing back
+		rescored, err = store.GetReceipt("b")
+		if !assert.NoError(t, err) {
+			return
+		}
+		lower = *rescored
+		lower.Points = 50
+		lower.RuleSetVersion = "v2"
+		entry, err = store.RescoreReceipt(&lower, expiresAt.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		loaded, err := store.GetReceipt("b")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(50), loaded.Points)
+		}
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), balance)
+	})
+}
+
+// Helper function to rescore receipts without going through the server
+func rescoreReceiptsInProcess(t *testing.T, body string) (int, *models.RescoreReport) {
+	req := httptest.NewRequest(http.MethodPost, controller.RescoreReceiptsPath, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	controller.RescoreReceiptsHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+
+	var report models.RescoreReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, &report
+}
+
+func TestRescoreReceipts(t *testing.T) {
+	userID := "RescoreUser-" + uuid.New().String()
+	ids := []string{}
+	for _, receipt := range []models.Receipt{targetReceipt, cornerMarketReceipt, targetReceipt} {
+		receipt = uniqueReceipt(receipt)
+		receipt.UserID = userID
+		ids = append(ids, processReceiptInProcess(t, &receipt))
+	}
+
+	rec := voidReceiptInProcess(ids[2], `{"reason": "Returned"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Register the rules without leaving them active
+	rules := oddDayRuleSet(t)
+	assert.NoError(t, controller.SetRuleSet(rules))
+	assert.NoError(t, controller.SetRuleSet(models.DefaultRuleSet()))
+
+	// The first two receipts earned bonuses of 1000 and 500, which are kept
+	body := `{"ruleSetVersion": "` + rules.Version + `", "userId": "` + userID + `"}`
+	code, report := rescoreReceiptsInProcess(t, body)
+	if !assert.Equal(t, http.StatusOK, code) {
+		return
+	}
+	assert.False(t, report.Applied)
+	assert.Equal(t, 2, report.Examined)
+	assert.Equal(t, 2, report.Changed)
+	assert.Equal(t, 1, report.SkippedVoided)
+	assert.Equal(t, int64(-131), report.Delta)
+	assert.Equal(t, []models.ReceiptRescore{
+		{ID: ids[0], UserID: userID, OldRuleSetVersion: models.DefaultRuleSetVersion, OldPoints: 1028, NewPoints: 1006, Delta: -22},
+		{ID: ids[1], UserID: userID, OldRuleSetVersion: models.DefaultRuleSetVersion, OldPoints: 609, NewPoints: 500, Delta: -109},
+	}, report.Receipts)
+	assert.Equal(t, []models.UserRescore{
+		{UserID: userID, Receipts: 2, OldPoints: 1637, NewPoints: 1506, Delta: -131},
+	}, report.Users)
+	assert.Equal(t, int64(1028), getPointsInProcess(t, ids[0]).Points)
+
+	// Applying has to be allowed first
+	code, _ = rescoreReceiptsInProcess(t, strings.Replace(body, "}", `, "apply": true}`, 1))
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, int64(1028), getPointsInProcess(t, ids[0]).Points)
+
+	controller.SetRescoreApplyAllowed(true)
+	defer controller.SetRescoreApplyAllowed(false)
+
+	code, report = rescoreReceiptsInProcess(t, strings.Replace(body, "}", `, "apply": true}`, 1))
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.True(t, report.Applied)
+		assert.Equal(t, int64(-131), report.Delta)
+	}
+
+	points := getPointsInProcess(t, ids[0])
+	assert.Equal(t, int64(1006), points.Points)
+	assert.Equal(t, rules.Version, points.RuleSetVersion)
+
+	balance, err := controller.ActiveStore().Balance(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1506), balance)
+
+	// Applying again changes nothing
+	code, report = rescoreReceiptsInProcess(t, strings.Replace(body, "}", `, "apply": true}`, 1))
+	if assert.Equal(t, http.StatusOK, code) {
+		assert.Equal(t, 0, report.Changed)
+		assert.Empty(t, report.Users)
+	}
+
+	balance, err = controller.ActiveStore().Balance(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1506), balance)
+
+	for _, body := range []string{`{"ruleSetVersion": "not-a-version"}`, `{"apply": `} {
+		code, _ = rescoreReceiptsInProcess(t, body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+}
+
+func TestRescoreReceiptsUnsupportedCurrency(t *testing.T) {
+	currencyRules, err := models.ParseRuleSet([]byte(currencyRulesConfig), models.RuleConfigFormatJSON)
+	if !assert.NoError(t, err) || !assert.NoError(t, controller.SetRuleSet(currencyRules)) {
+		return
+	}
+
+	receipt := uniqueReceipt(cornerMarketReceiptCAD)
+	receipt.UserID = "RescoreUser-" + uuid.New().String()
+	id := processReceiptInProcess(t, &receipt)
+	assert.NoError(t, controller.SetRuleSet(models.DefaultRuleSet()))
+
+	// The odd day rules have no rate for Canadian dollars, so the receipt can't be scored with them
+	report, err := controller.RescoreReceipts(oddDayRuleSet(t), models.ReceiptFilter{UserID: receipt.UserID}, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, report.Examined)
+		assert.Equal(t, 1, report.SkippedUnconvertible)
+		assert.Empty(t, report.Users)
+	}
+
+	points := getPointsInProcess(t, id)
+	assert.Equal(t, currencyRules.Version, points.RuleSetVersion)
+	assert.Equal(t, int64(1109), points.Points)
+}
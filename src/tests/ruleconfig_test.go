@@ -0,0 +1,113 @@
+/**
+ruleconfig_test.go
+
+Tests loading and validating rules files
+*/
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadExampleRuleSet(t *testing.T) {
+	rules, err := models.LoadRuleSet("../../rules.example.yaml")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// The example file describes the built-in rules, and also opts in to the validators that are off by default
+	defaults := models.DefaultRuleSet()
+	assert.Equal(t, defaults.BonusTiers, rules.BonusTiers)
+	assert.Equal(t, defaults.Score(&targetReceipt), rules.Score(&targetReceipt))
+	assert.Equal(t, defaults.Score(&cornerMarketReceipt), rules.Score(&cornerMarketReceipt))
+	assert.Equal(t, []string{models.TotalPartsValidatorName}, validatorNames(defaults))
+	assert.Equal(t, []string{models.ItemsTotalValidatorName, models.TotalPartsValidatorName, models.FutureDateValidatorName},
+		validatorNames(rules))
+}
+
+// Helper function to load the example rules file, which turns on every validator that's off by default
+func exampleRuleSet(t *testing.T) *models.RuleSet {
+	rules, err := models.LoadRuleSet("../../rules.example.yaml")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return rules
+}
+
+// Helper function to list the names of the validators a rule set runs, in order
+func validatorNames(rules *models.RuleSet) []string {
+	names := []string{}
+	for _, validator := range rules.Validators {
+		names = append(names, validator.Name())
+	}
+
+	return names
+}
+
+func TestParseRuleSetJSON(t *testing.T) {
+	config := `{
+		"bonusTiers": [100],
+		"rules": [
+			{"name": "roundDollar", "params": {"points": 75}},
+			{"name": "oddDay"}
+		]
+	}`
+
+	rules, err := models.ParseRuleSet([]byte(config), models.RuleConfigFormatJSON)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Len(t, rules.Rules, 2)
+	assert.Equal(t, int64(100), rules.Bonus(0))
+	assert.Equal(t, int64(0), rules.Bonus(1))
+	assert.Equal(t, int64(75), rules.Score(&cornerMarketReceipt))
+	assert.Equal(t, int64(6), rules.Score(&targetReceipt))
+}
+
+func TestParseRuleSetYAML(t *testing.T) {
+	config := `
+bonusTiers: []
+rules:
+  - name: afternoon
+    params:
+      start: "13:00"
+`
+
+	rules, err := models.ParseRuleSet([]byte(config), models.RuleConfigFormatYAML)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, int64(0), rules.Bonus(0))
+	assert.Equal(t, int64(10), rules.Score(&targetReceipt))
+}
+
+func TestParseInvalidRuleSets(t *testing.T) {
+	configs := map[string]string{
+		"no rules":         `{"rules": []}`,
+		"unknown field":    `{"rules": [{"name": "oddDay"}], "extra": true}`,
+		"unknown rule":     `{"rules": [{"name": "notARule"}]}`,
+		"duplicate rule":   `{"rules": [{"name": "oddDay"}, {"name": "oddDay"}]}`,
+		"unknown param":    `{"rules": [{"name": "oddDay", "params": {"pointz": 6}}]}`,
+		"wrong param type": `{"rules": [{"name": "oddDay", "params": {"points": "six"}}]}`,
+		"negative points":  `{"rules": [{"name": "oddDay", "params": {"points": -6}}]}`,
+		"negative bonus":   `{"bonusTiers": [-1], "rules": [{"name": "oddDay"}]}`,
+		"bad window":       `{"rules": [{"name": "afternoon", "params": {"start": "16:00", "end": "14:00"}}]}`,
+		"zero multiple":    `{"rules": [{"name": "descriptionLength", "params": {"lengthMultiple": 0}}]}`,
+		"trailing data":    `{"rules": [{"name": "oddDay"}]} {}`,
+	}
+
+	for name, config := range configs {
+		_, err := models.ParseRuleSet([]byte(config), models.RuleConfigFormatJSON)
+		assert.Error(t, err, name)
+	}
+
+	_, err := models.ParseRuleSet([]byte("rules:\n  - name: oddDay\n    extra: 1\n"), models.RuleConfigFormatYAML)
+	assert.Error(t, err)
+}
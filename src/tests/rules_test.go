@@ -0,0 +1,142 @@
+/**
+rules_test.go
+
+Tests each scoring rule in isolation along with the default rule set
+*/
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Receipt from the examples in the original challenge, worth 28 points without a bonus
+var targetReceipt = models.Receipt{
+	Retailer:     "Target",
+	Total:        models.MoneyFromString("35.35"),
+	PurchaseDate: "2022-01-01",
+	PurchaseTime: "13:01",
+	Items: []models.Item{
+		{ShortDescription: "Mountain Dew 12PK", Price: models.MoneyFromString("6.49")},
+		{ShortDescription: "Emils Cheese Pizza", Price: models.MoneyFromString("12.25")},
+		{ShortDescription: "Knorr Creamy Chicken", Price: models.MoneyFromString("1.26")},
+		{ShortDescription: "Doritos Nacho Cheese", Price: models.MoneyFromString("3.35")},
+		{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: models.MoneyFromString("12.00")},
+	},
+}
+
+// Receipt from the examples in the original challenge, worth 109 points without a bonus
+var cornerMarketReceipt = models.Receipt{
+	Retailer:     "M&M Corner Market",
+	Total:        models.MoneyFromString("9.00"),
+	PurchaseDate: "2022-03-20",
+	PurchaseTime: "14:33",
+	Items: []models.Item{
+		{ShortDescription: "Gatorade", Price: models.MoneyFromString("2.25")},
+		{ShortDescription: "Gatorade", Price: models.MoneyFromString("2.25")},
+		{ShortDescription: "Gatorade", Price: models.MoneyFromString("2.25")},
+		{ShortDescription: "Gatorade", Price: models.MoneyFromString("2.25")},
+	},
+}
+
+// Helper function to sum the points of a rule's results
+func sumPoints(results []models.RuleResult) int64 {
+	total := int64(0)
+	for _, result := range results {
+		total += result.Points
+	}
+	return total
+}
+
+// Helper function to construct a registered rule with its default parameters
+func mustNewRule(t *testing.T, name string) models.Rule {
+	rule, err := models.NewRule(name)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, name, rule.Name())
+	return rule
+}
+
+func TestRetailerAlphanumericRule(t *testing.T) {
+	rule := mustNewRule(t, models.RetailerAlphanumericRuleName)
+
+	assert.Equal(t, int64(6), sumPoints(rule.Apply(&targetReceipt)))
+	assert.Equal(t, int64(14), sumPoints(rule.Apply(&cornerMarketReceipt)))
+}
+
+func TestRoundDollarRule(t *testing.T) {
+	rule := mustNewRule(t, models.RoundDollarRuleName)
+
+	assert.Empty(t, rule.Apply(&targetReceipt))
+	assert.Equal(t, int64(50), sumPoints(rule.Apply(&cornerMarketReceipt)))
+}
+
+func TestQuarterMultipleRule(t *testing.T) {
+	rule := mustNewRule(t, models.QuarterMultipleRuleName)
+
+	assert.Empty(t, rule.Apply(&targetReceipt))
+	assert.Equal(t, int64(25), sumPoints(rule.Apply(&cornerMarketReceipt)))
+}
+
+func TestItemPairsRule(t *testing.T) {
+	rule := mustNewRule(t, models.ItemPairsRuleName)
+
+	assert.Equal(t, int64(10), sumPoints(rule.Apply(&targetReceipt)))
+	assert.Equal(t, int64(10), sumPoints(rule.Apply(&cornerMarketReceipt)))
+}
+
+func TestDescriptionLengthRule(t *testing.T) {
+	rule := mustNewRule(t, models.DescriptionLengthRuleName)
+
+	results := rule.Apply(&targetReceipt)
+	assert.Len(t, results, 2)
+	assert.Equal(t, int64(6), sumPoints(results))
+	assert.Empty(t, rule.Apply(&cornerMarketReceipt))
+}
+
+func TestOddDayRule(t *testing.T) {
+	rule := mustNewRule(t, models.OddDayRuleName)
+
+	assert.Equal(t, int64(6), sumPoints(rule.Apply(&targetReceipt)))
+	assert.Empty(t, rule.Apply(&cornerMarketReceipt))
+}
+
+func TestAfternoonRule(t *testing.T) {
+	rule := mustNewRule(t, models.AfternoonRuleName)
+
+	assert.Empty(t, rule.Apply(&targetReceipt))
+	assert.Equal(t, int64(10), sumPoints(rule.Apply(&cornerMarketReceipt)))
+
+	// The window is exclusive on both ends
+	receipt := cornerMarketReceipt
+	receipt.PurchaseTime = "14:00"
+	assert.Empty(t, rule.Apply(&receipt))
+	receipt.PurchaseTime = "16:00"
+	assert.Empty(t, rule.Apply(&receipt))
+	receipt.PurchaseTime = "17:59"
+	assert.Empty(t, rule.Apply(&receipt))
+}
+
+func TestNewRuleWithUnknownName(t *testing.T) {
+	_, err := models.NewRule("notARule")
+	assert.Error(t, err)
+}
+
+func TestDefaultRuleSet(t *testing.T) {
+	rules := models.DefaultRuleSet()
+
+	assert.Equal(t, int64(28), rules.Score(&targetReceipt))
+	assert.Equal(t, int64(109), rules.Score(&cornerMarketReceipt))
+	assert.Equal(t, sumPoints(rules.Evaluate(&targetReceipt)), rules.Score(&targetReceipt))
+}
+
+func TestCalculatePointsMatchesVerbose(t *testing.T) {
+	for _, receipt := range []models.Receipt{targetReceipt, cornerMarketReceipt} {
+		assert.Equal(t, receipt.CalculatePoints(0), receipt.CalculatePointsVerbose(0))
+		assert.Equal(t, receipt.CalculatePoints(500), receipt.CalculatePointsVerbose(500))
+	}
+}
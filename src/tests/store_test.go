@@ -0,0 +1,297 @@
+/**
+store_test.go
+
+Tests that every store implementation behaves the same, along with store-specific behavior
+*/
+
+package tests
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to run a test against a fresh instance of every store implementation
+func forEachStore(t *testing.T, test func(t *testing.T, store controller.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, controller.NewMemoryStore())
+	})
+
+	t.Run("file", func(t *testing.T) {
+		store := mustOpenFileStore(t, t.TempDir(), 10)
+		defer store.Close()
+		test(t, store)
+	})
+
+	t.Run("sql", func(t *testing.T) {
+		store := mustOpenSQLStore(t, filepath.Join(t.TempDir(), "receipts.db"))
+		defer store.Close()
+		test(t, store)
+	})
+}
+
+func TestStoreSaveAndGetReceipt(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        targetReceipt,
+			Points:         28,
+			Breakdown:      models.DefaultRuleSet().Evaluate(&targetReceipt),
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    time.Date(2024, 12, 1, 15, 4, 5, 6, time.UTC),
+		}
+		assert.NoError(t, store.SaveReceipt(record))
+
+		loaded, err := store.GetReceipt("a")
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, record, loaded)
+
+		_, err = store.GetReceipt("b")
+		assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+
+		err = store.SaveReceipt(record)
+		assert.ErrorIs(t, err, controller.ErrReceiptExists)
+	})
+}
+
+func TestStoreLedger(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		_, err := store.Balance("TestUser1")
+		assert.ErrorIs(t, err, controller.ErrUserNotFound)
+		_, err = store.ListLedger("TestUser1", 0, 10)
+		assert.ErrorIs(t, err, controller.ErrUserNotFound)
+
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		first := &models.ReceiptRecord{
+			ID:      "a",
+			Receipt: targetReceipt,
+			Points:  1028,
+			Breakdown: []models.RuleResult{
+				{Rule: models.RetailerAlphanumericRuleName, Points: 28},
+				{Rule: models.ReceiptBonusName, Points: 1000},
+			},
+			ProcessedAt: processedAt,
+		}
+		first.Receipt.UserID = "TestUser1"
+		second := &models.ReceiptRecord{ID: "b", Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+		second.Receipt.UserID = "TestUser1"
+
+		assert.NoError(t, store.SaveReceipt(first))
+		assert.NoError(t, store.SaveReceipt(second))
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1137), balance)
+
+		entries, err := store.ListLedger("TestUser1", 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []models.LedgerEntry{
+			{Seq: 1, UserID: "TestUser1", Kind: models.LedgerEntryReceipt, Amount: 28, Balance: 28, ReceiptID: "a", CreatedAt: processedAt},
+			{Seq: 2, UserID: "TestUser1", Kind: models.LedgerEntryBonus, Amount: 1000, Balance: 1028, ReceiptID: "a", CreatedAt: processedAt},
+			{Seq: 3, UserID: "TestUser1", Kind: models.LedgerEntryReceipt, Amount: 109, Balance: 1137, ReceiptID: "b", CreatedAt: processedAt},
+		}, entries)
+
+		entries, err = store.ListLedger("TestUser1", 1, 1)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, int64(2), entries[0].Seq)
+		}
+
+		entries, err = store.ListLedger("TestUser1", 3, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+}
+
+func TestStoreRedeem(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		record := &models.ReceiptRecord{ID: "a", Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+		record.Receipt.UserID = "TestUser1"
+		assert.NoError(t, store.SaveReceipt(record))
+
+		redemption := models.LedgerEntry{
+			UserID:         "TestUser1",
+			Kind:           models.LedgerEntryRedemption,
+			Amount:         -100,
+			Description:    "Gift card",
+			CreatedAt:      processedAt.Add(time.Hour),
+			IdempotencyKey: "key-1",
+		}
+		entry, replayed, err := store.Redeem(redemption)
+		assert.NoError(t, err)
+		assert.False(t, replayed)
+		assert.Equal(t, int64(2), entry.Seq)
+		assert.Equal(t, int64(9), entry.Balance)
+
+		// Retrying with the same key doesn't debit again
+		again, replayed, err := store.Redeem(redemption)
+		assert.NoError(t, err)
+		assert.True(t, replayed)
+		assert.Equal(t, entry, again)
+
+		// Reusing the key for a different redemption is rejected
+		different := redemption
+		different.Amount = -5
+		_, _, err = store.Redeem(different)
+		assert.ErrorIs(t, err, controller.ErrIdempotencyKeyReused)
+
+		// Overdrafts are rejected without touching the ledger
+		overdraft := redemption
+		overdraft.IdempotencyKey = ""
+		overdraft.Amount = -10
+		_, _, err = store.Redeem(overdraft)
+		var insufficient *controller.InsufficientBalanceError
+		if assert.ErrorAs(t, err, &insufficient) {
+			assert.Equal(t, int64(9), insufficient.Balance)
+			assert.Equal(t, int64(10), insufficient.Requested)
+		}
+
+		_, _, err = store.Redeem(models.LedgerEntry{UserID: "TestUser2", Kind: models.LedgerEntryRedemption, Amount: -1})
+		assert.ErrorAs(t, err, &insufficient)
+
+		entries, err := store.ListLedger("TestUser1", 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []models.LedgerEntry{
+			{Seq: 1, UserID: "TestUser1", Kind: models.LedgerEntryReceipt, Amount: 109, Balance: 109, ReceiptID: "a", CreatedAt: processedAt},
+			entry,
+		}, entries)
+	})
+}
+
+func TestStoreRedeemConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		record := &models.ReceiptRecord{ID: "a", Receipt: cornerMarketReceipt, Points: 109}
+		record.Receipt.UserID = "TestUser1"
+		assert.NoError(t, store.SaveReceipt(record))
+
+		// Only 10 of these can succeed
+		var wg sync.WaitGroup
+		succeeded := make(chan bool, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := store.Redeem(models.LedgerEntry{UserID: "TestUser1", Kind: models.LedgerEntryRedemption, Amount: -10})
+				succeeded <- err == nil
+			}()
+		}
+		wg.Wait()
+		close(succeeded)
+
+		n := 0
+		for ok := range succeeded {
+			if ok {
+				n++
+			}
+		}
+		assert.Equal(t, 10, n)
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(9), balance)
+	})
+}
+
+func TestStoreReceiptCount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		n, err := store.ReceiptCount("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+
+		for i := int64(0); i < 2; i++ {
+			n, err = store.IncrementReceiptCount("TestUser1")
+			assert.NoError(t, err)
+			assert.Equal(t, i, n)
+		}
+
+		n, err = store.ReceiptCount("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		n, err = store.ReceiptCount("TestUser2")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), n)
+	})
+}
+
+func TestStoreIncrementReceiptCountConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		const nWorkers = 200
+
+		var wg sync.WaitGroup
+		counts := make(chan int64, nWorkers)
+		for i := 0; i < nWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				n, err := store.IncrementReceiptCount("TestUser1")
+				assert.NoError(t, err)
+				counts <- n
+			}()
+		}
+		wg.Wait()
+		close(counts)
+
+		// Every caller saw a distinct count
+		seen := map[int64]bool{}
+		for n := range counts {
+			assert.False(t, seen[n], "count %v was observed twice", n)
+			seen[n] = true
+		}
+		assert.Len(t, seen, nWorkers)
+
+		n, err := store.ReceiptCount("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(nWorkers), n)
+	})
+}
+
+func TestSQLStoreIsRelational(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipts.db")
+
+	store := mustOpenSQLStore(t, path)
+	assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: "a", Receipt: targetReceipt, Points: 28}))
+	assert.NoError(t, store.SaveReceipt(&models.ReceiptRecord{ID: "b", Receipt: cornerMarketReceipt, Points: 109}))
+	assert.NoError(t, store.Close())
+
+	// Reopening doesn't re-apply migrations
+	store = mustOpenSQLStore(t, path)
+	_, err := store.GetReceipt("b")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	db, err := sql.Open("sqlite", path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer db.Close()
+
+	var nItems int
+	err = db.QueryRow(`SELECT COUNT(*) FROM items JOIN receipts ON receipts.id = items.receipt_id WHERE retailer = ?`, "Target").Scan(&nItems)
+	assert.NoError(t, err)
+	assert.Equal(t, len(targetReceipt.Items), nItems)
+
+	var nMigrations int
+	err = db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&nMigrations)
+	assert.NoError(t, err)
+	assert.Positive(t, nMigrations)
+}
+
+// Helper function to open a sql store or fail the test
+func mustOpenSQLStore(t *testing.T, path string) *controller.SQLStore {
+	store, err := controller.OpenSQLStore(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return store
+}
@@ -0,0 +1,128 @@
+/**
+timezone_test.go
+
+Tests receipts from stores in other time zones
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTimeZone(t *testing.T) {
+	for _, name := range []string{"America/Chicago", "UTC", "-05:00", "+05:30", "+14:00", "-12:00"} {
+		_, err := models.LoadTimeZone(name)
+		assert.NoError(t, err, name)
+	}
+
+	for _, name := range []string{"", "Local", "Mars/Olympus_Mons", "+15:00", "-12:30", "+05:60", "05:00"} {
+		_, err := models.LoadTimeZone(name)
+		assert.Error(t, err, name)
+	}
+
+	receipt := targetReceipt
+	receipt.TimeZone = "Mars/Olympus_Mons"
+	var errs models.ValidationErrors
+	if assert.ErrorAs(t, receipt.ValidateProperties(), &errs) {
+		assert.Equal(t, "timeZone", errs[0].Field)
+		assert.Equal(t, models.ValidationInvalidFormat, errs[0].Code)
+	}
+}
+
+func TestPurchasedAt(t *testing.T) {
+	assert.Nil(t, targetReceipt.PurchasedAt())
+
+	receipt := targetReceipt
+	receipt.TimeZone = "America/Chicago"
+	assert.NoError(t, receipt.ValidateProperties())
+	assert.Equal(t, time.Date(2022, 1, 1, 19, 1, 0, 0, time.UTC), *receipt.PurchasedAt())
+
+	receipt.TimeZone = "+05:30"
+	assert.Equal(t, time.Date(2022, 1, 1, 7, 31, 0, 0, time.UTC), *receipt.PurchasedAt())
+
+	// 02:30 doesn't exist on the day daylight saving time starts, so it's moved forward an hour
+	receipt.TimeZone = "America/Chicago"
+	receipt.PurchaseDate = "2022-03-13"
+	receipt.PurchaseTime = "02:30"
+	assert.Equal(t, "03:30", receipt.LocalPurchaseTime().Format(models.TimeFormat))
+	assert.Equal(t, time.Date(2022, 3, 13, 8, 30, 0, 0, time.UTC), *receipt.PurchasedAt())
+}
+
+func TestTimeRulesUseLocalTime(t *testing.T) {
+	rules := models.NewRuleSet(&models.AfternoonRule{Points: 10, Start: "14:00", End: "16:00"}, &models.OddDayRule{Points: 6})
+
+	// 15:30 on the 1st in Tokyo is 06:30 UTC, but the rules only see the store's local time
+	receipt := targetReceipt
+	receipt.PurchaseTime = "15:30"
+	receipt.TimeZone = "Asia/Tokyo"
+	assert.Equal(t, int64(16), rules.Score(&receipt))
+
+	receipt.TimeZone = ""
+	assert.Equal(t, int64(16), rules.Score(&receipt))
+}
+
+func TestValidatorsWithTimeZone(t *testing.T) {
+	rules := exampleRuleSet(t)
+
+	// Purchased at 13:01 on the 1st at UTC-5, which is 18:01 UTC
+	receipt := targetReceipt
+	receipt.TimeZone = "-05:00"
+	assertCheckCodes(t, rules, &receipt, time.Date(2022, 1, 1, 18, 0, 0, 0, time.UTC), models.ValidationFutureDate)
+	assert.NoError(t, rules.CheckReceipt(&receipt, time.Date(2022, 1, 1, 18, 2, 0, 0, time.UTC)))
+
+	// Without a time zone it's only in the future if it is in every time zone
+	assert.NoError(t, rules.CheckReceipt(&targetReceipt, time.Date(2022, 1, 1, 18, 0, 0, 0, time.UTC)))
+
+	maxAge := &models.MaxAgeValidator{Days: 1}
+	now := time.Date(2022, 1, 2, 18, 2, 0, 0, time.UTC)
+	assert.Len(t, maxAge.Check(&receipt, now), 1)
+	assert.Empty(t, maxAge.Check(&targetReceipt, now))
+}
+
+func TestStoreReceiptTimeZone(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		receipt := targetReceipt
+		receipt.TimeZone = "America/Chicago"
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        receipt,
+			Points:         28,
+			Breakdown:      []models.RuleResult{},
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC),
+			PurchasedAt:    receipt.PurchasedAt(),
+		}
+		assert.NoError(t, store.SaveReceipt(record))
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, record, loaded)
+		}
+	})
+}
+
+func TestProcessReceiptWithTimeZone(t *testing.T) {
+	receipt := uniqueReceipt(targetReceipt)
+	receipt.TimeZone = "America/Chicago"
+	id := processReceiptInProcess(t, &receipt)
+
+	req := httptest.NewRequest(http.MethodGet, "/receipts/"+id, nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	controller.GetReceipt(rec, req)
+
+	var respInfo models.GetReceiptResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &respInfo)) && assert.NotNil(t, respInfo.PurchasedAt) {
+		assert.Equal(t, "America/Chicago", respInfo.TimeZone)
+		assert.Equal(t, *receipt.PurchasedAt(), *respInfo.PurchasedAt)
+	}
+}
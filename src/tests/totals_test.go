@@ -0,0 +1,157 @@
+/**
+totals_test.go
+
+Tests receipts with a subtotal, tax and tip, and scoring them on the subtotal
+*/
+
+package tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// Same items as `targetReceipt`, with 35.35 as the subtotal before 2.90 of tax and a 5.00 tip
+var restaurantReceipt = func() models.Receipt {
+	receipt := targetReceipt
+	receipt.Total = models.MustParseMoney("43.25")
+	receipt.Subtotal = money("35.35")
+	receipt.Tax = money("2.90")
+	receipt.Tip = money("5.00")
+	return receipt
+}()
+
+func TestValidateTotalParts(t *testing.T) {
+	assert.NoError(t, restaurantReceipt.ValidateProperties())
+
+	for _, c := range []struct {
+		name   string
+		modify func(receipt *models.Receipt)
+		field  string
+		code   string
+	}{
+		{"tax without subtotal", func(r *models.Receipt) { r.Subtotal = nil }, "subtotal", models.ValidationRequired},
+		{"negative tax", func(r *models.Receipt) { r.Tax = money("-2.90") }, "tax", models.ValidationOutOfRange},
+		{"tip with three decimals", func(r *models.Receipt) { r.Tip = money("5.000") }, "tip", models.ValidationInvalidFormat},
+		{"unparsable subtotal", func(r *models.Receipt) {
+			subtotal := models.MoneyFromString("35,35")
+			r.Subtotal = &subtotal
+		}, "subtotal", models.ValidationInvalidFormat},
+	} {
+		receipt := restaurantReceipt
+		c.modify(&receipt)
+
+		var errs models.ValidationErrors
+		if assert.ErrorAs(t, receipt.ValidateProperties(), &errs, c.name) {
+			assert.Equal(t, c.field, errs[0].Field, c.name)
+			assert.Equal(t, c.code, errs[0].Code, c.name)
+		}
+	}
+
+	// Only the subtotal is fine
+	receipt := targetReceipt
+	receipt.Subtotal = money("35.35")
+	assert.NoError(t, receipt.ValidateProperties())
+}
+
+func TestTotalPartsValidator(t *testing.T) {
+	rules := models.DefaultRuleSet()
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, rules.CheckReceipt(&restaurantReceipt, now))
+
+	// Off by a cent is within the default tolerance
+	receipt := restaurantReceipt
+	receipt.Total = models.MustParseMoney("43.26")
+	assert.NoError(t, rules.CheckReceipt(&receipt, now))
+
+	receipt.Total = models.MustParseMoney("43.27")
+	assertCheckCodes(t, rules, &receipt, now, models.ValidationTotalPartsMismatch)
+
+	// Item prices are compared with the subtotal rather than the total
+	receipt = restaurantReceipt
+	receipt.Subtotal = money("35.36")
+	receipt.Tip = money("4.99")
+	assertCheckCodes(t, exampleRuleSet(t), &receipt, now, models.ValidationItemsTotalMismatch)
+
+	rules, err := models.ParseRuleSet([]byte(`{
+		"rules": [{"name": "oddDay"}],
+		"validators": [{"name": "totalParts", "params": {"tolerance": "0.05"}}]
+	}`), models.RuleConfigFormatJSON)
+	if assert.NoError(t, err) {
+		receipt = restaurantReceipt
+		receipt.Total = models.MustParseMoney("43.30")
+		assert.NoError(t, rules.CheckReceipt(&receipt, now))
+	}
+
+	_, err = models.ParseRuleSet([]byte(`{
+		"rules": [{"name": "oddDay"}],
+		"validators": [{"name": "totalParts", "params": {"tolerance": "-0.01"}}]
+	}`), models.RuleConfigFormatJSON)
+	assert.Error(t, err)
+}
+
+func TestScoreOnSubtotal(t *testing.T) {
+	onTotal := models.NewRuleSet(&models.RoundDollarRule{Points: 50, Amount: models.ScoreOnTotal},
+		&models.QuarterMultipleRule{Points: 25, Amount: models.ScoreOnTotal})
+	onSubtotal := models.NewRuleSet(&models.RoundDollarRule{Points: 50, Amount: models.ScoreOnSubtotal},
+		&models.QuarterMultipleRule{Points: 25, Amount: models.ScoreOnSubtotal})
+
+	// 43.25 is a multiple of 0.25 but 35.35 isn't
+	assert.Equal(t, int64(25), onTotal.Score(&restaurantReceipt))
+	assert.Equal(t, int64(0), onSubtotal.Score(&restaurantReceipt))
+
+	// Receipts without a subtotal are scored on the total either way
+	receipt := cornerMarketReceipt
+	assert.Equal(t, int64(75), onSubtotal.Score(&receipt))
+	receipt.Subtotal = money("8.10")
+	receipt.Tax = money("0.90")
+	assert.Equal(t, int64(0), onSubtotal.Score(&receipt))
+
+	_, err := models.ParseRuleSet([]byte(`{"rules": [{"name": "roundDollar", "params": {"amount": "net"}}]}`),
+		models.RuleConfigFormatJSON)
+	assert.Error(t, err)
+}
+
+func TestFingerprintTotalParts(t *testing.T) {
+	receipt := restaurantReceipt
+	receipt.Tip = money("5.01")
+	assert.NotEqual(t, restaurantReceipt.Fingerprint(), receipt.Fingerprint())
+	assert.NotEqual(t, targetReceipt.Fingerprint(), restaurantReceipt.Fingerprint())
+}
+
+func TestProcessReceiptWithWrongTotalParts(t *testing.T) {
+	payload := uniqueReceipt(restaurantReceipt)
+	payload.Tip = money("6.00")
+
+	resp, err := processReceipt(&payload)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertInvalidFields(t, resp, "total")
+}
+
+func TestStoreTotalParts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		record := &models.ReceiptRecord{
+			ID:             "a",
+			Receipt:        restaurantReceipt,
+			Points:         28,
+			Breakdown:      []models.RuleResult{},
+			RuleSetVersion: models.DefaultRuleSetVersion,
+			ProcessedAt:    time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC),
+		}
+		assert.NoError(t, store.SaveReceipt(record))
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, record.Receipt, loaded.Receipt)
+		}
+	})
+}
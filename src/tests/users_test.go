@@ -0,0 +1,247 @@
+/**
+users_test.go
+
+Makes HTTP calls to the user endpoints to test querying balances and ledgers, and redeeming points
+Assumes that the server is running on 'http://localhost:3000'
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPointsOfNonexistantUser(t *testing.T) {
+
+	resp, err := getUserPoints(uuid.New().String())
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	problem := decodeProblem(t, resp)
+	assert.Equal(t, "user-not-found", problem.Type)
+	assert.Equal(t, "No user found for that ID.", problem.Detail)
+}
+
+func TestGetUserPointsAndLedger(t *testing.T) {
+
+	userID := "LedgerUser-" + uuid.New().String()
+	for _, receipt := range []models.Receipt{targetReceipt, cornerMarketReceipt} {
+		receipt = uniqueReceipt(receipt)
+		receipt.UserID = userID
+		resp, err := processReceipt(&receipt)
+		if err != nil {
+			t.Errorf("Failed to make HTTP request: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// 28 + 1000 bonus, then 109 + 500 bonus
+	resp, err := getUserPoints(userID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var points models.GetUserPointsResponse
+	err = json.NewDecoder(resp.Body).Decode(&points)
+	assert.NoError(t, err)
+	assert.Equal(t, userID, points.UserID)
+	assert.Equal(t, int64(1637), points.Balance)
+
+	// Page through the ledger two entries at a time
+	entries := []models.LedgerEntry{}
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		resp, err := getUserLedger(userID, 2, cursor)
+		if err != nil {
+			t.Errorf("Failed to make HTTP request: %v", err)
+		}
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var ledger models.GetUserLedgerResponse
+		err = json.NewDecoder(resp.Body).Decode(&ledger)
+		assert.NoError(t, err)
+
+		entries = append(entries, ledger.Entries...)
+		cursor = ledger.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+
+	assert.Empty(t, cursor)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, []string{models.LedgerEntryReceipt, models.LedgerEntryBonus, models.LedgerEntryReceipt, models.LedgerEntryBonus},
+			[]string{entries[0].Kind, entries[1].Kind, entries[2].Kind, entries[3].Kind})
+		assert.Equal(t, []int64{28, 1000, 109, 500},
+			[]int64{entries[0].Amount, entries[1].Amount, entries[2].Amount, entries[3].Amount})
+		assert.Equal(t, points.Balance, entries[3].Balance)
+	}
+}
+
+func TestGetUserLedgerWithInvalidCursor(t *testing.T) {
+
+	resp, err := getUserLedger("TestUser1", 10, "NOT a cursor")
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid-request", decodeProblem(t, resp).Type)
+}
+
+func TestCreateRedemption(t *testing.T) {
+
+	userID := "RedeemUser-" + uuid.New().String()
+	receipt := uniqueReceipt(cornerMarketReceipt)
+	receipt.UserID = userID
+	resp, err := processReceipt(&receipt)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 109 + 1000 bonus
+	key := uuid.New().String()
+	resp, err = createRedemption(userID, key, `{"points": 1000, "description": "Gift card"}`)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var entry models.LedgerEntry
+	err = json.NewDecoder(resp.Body).Decode(&entry)
+	assert.NoError(t, err)
+	assert.Equal(t, models.LedgerEntryRedemption, entry.Kind)
+	assert.Equal(t, int64(-1000), entry.Amount)
+	assert.Equal(t, int64(109), entry.Balance)
+	assert.Equal(t, "Gift card", entry.Description)
+
+	// A retry is answered with the original debit
+	resp, err = createRedemption(userID, key, `{"points": 1000, "description": "Gift card"}`)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	var replayed models.LedgerEntry
+	err = json.NewDecoder(resp.Body).Decode(&replayed)
+	assert.NoError(t, err)
+	assert.Equal(t, entry.Seq, replayed.Seq)
+
+	resp, err = createRedemption(userID, key, `{"points": 5}`)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, "idempotency-key-reused", decodeProblem(t, resp).Type)
+
+	// Only 109 points are left
+	resp, err = createRedemption(userID, "", `{"points": 110}`)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	problem := decodeProblem(t, resp)
+	assert.Equal(t, "insufficient-balance", problem.Type)
+	if assert.NotNil(t, problem.Balance) && assert.NotNil(t, problem.Requested) {
+		assert.Equal(t, int64(109), *problem.Balance)
+		assert.Equal(t, int64(110), *problem.Requested)
+	}
+
+	resp, err = getUserPoints(userID)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	var points models.GetUserPointsResponse
+	err = json.NewDecoder(resp.Body).Decode(&points)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(109), points.Balance)
+}
+
+func TestCreateInvalidRedemption(t *testing.T) {
+
+	for _, body := range []string{`{"points": 0}`, `{"points": -5}`, `{"points": "ten"}`, `not json`} {
+		resp, err := createRedemption("TestUser1", "", body)
+		if err != nil {
+			t.Errorf("Failed to make HTTP request: %v", err)
+		}
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+		assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "invalid-request", decodeProblem(t, resp).Type)
+	}
+}
+
+// Helper function to abstract logic of making call to GetUserPoints
+func getUserPoints(userID string) (*http.Response, error) {
+	url := ServerEndpoint + "/users/" + url.PathEscape(userID) + "/points"
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
+
+// Helper function to abstract logic of making call to GetUserLedger
+func getUserLedger(userID string, limit int, cursor string) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("limit", fmt.Sprint(limit))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	url := ServerEndpoint + "/users/" + url.PathEscape(userID) + "/ledger?" + query.Encode()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
+
+// Helper function to abstract logic of making call to CreateRedemption
+func createRedemption(userID string, idempotencyKey string, body string) (*http.Response, error) {
+	url := ServerEndpoint + "/users/" + url.PathEscape(userID) + "/redemptions"
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	client := http.Client{}
+
+	return client.Do(req)
+}
+
+// Helper function to decode a structured error response
+func decodeProblem(t *testing.T, resp *http.Response) models.ErrorResponse {
+	var problem models.ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&problem)
+	assert.NoError(t, err)
+	return problem
+}
@@ -0,0 +1,224 @@
+/**
+validation_test.go
+
+Tests that invalid receipts are rejected with every invalid field listed
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePropertiesListsEveryField(t *testing.T) {
+	receipt := models.Receipt{
+		Retailer:     "Target!",
+		PurchaseDate: "2022-13-01",
+		PurchaseTime: "13:01",
+		Items: []models.Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: models.MoneyFromString("6.49")},
+			{ShortDescription: "", Price: models.MoneyFromString("six")},
+		},
+	}
+
+	err := receipt.ValidateProperties()
+	var errs models.ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) {
+		return
+	}
+
+	assert.Equal(t, models.ValidationErrors{
+		{Field: "retailer", Code: models.ValidationInvalidFormat, Message: errs[0].Message},
+		{Field: "total", Code: models.ValidationRequired, Message: "total is required"},
+		{Field: "purchaseDate", Code: models.ValidationInvalidDate, Message: "purchaseDate is not a date that exists"},
+		{Field: "items[1].shortDescription", Code: models.ValidationRequired, Message: "items[1].shortDescription is required"},
+		{Field: "items[1].price", Code: models.ValidationInvalidFormat, Message: errs[4].Message},
+	}, errs)
+
+	assert.NoError(t, targetReceipt.ValidateProperties())
+}
+
+func TestValidatePropertiesDates(t *testing.T) {
+	for date, code := range map[string]string{
+		"2022-02-30": models.ValidationInvalidDate,
+		"2024-02-29": "",
+		"2022-2-3":   models.ValidationInvalidFormat,
+	} {
+		receipt := targetReceipt
+		receipt.PurchaseDate = date
+
+		var errs models.ValidationErrors
+		if errors.As(receipt.ValidateProperties(), &errs) {
+			assert.Equal(t, code, errs[0].Code, date)
+		} else {
+			assert.Empty(t, code, date)
+		}
+	}
+}
+
+func TestDefaultValidators(t *testing.T) {
+	// Items add up to 35.35, but a total that includes tax is accepted unless `itemsTotal` is turned on
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	receipt := targetReceipt
+	receipt.Total = models.MoneyFromString("35.36")
+	assert.NoError(t, models.DefaultRuleSet().CheckReceipt(&receipt, now))
+	assert.NoError(t, models.DefaultRuleSet().CheckReceipt(&targetReceipt, time.Date(2021, 12, 31, 23, 0, 0, 0, time.UTC)))
+
+	rules := exampleRuleSet(t)
+	assert.NoError(t, rules.CheckReceipt(&targetReceipt, now))
+	assertCheckCodes(t, rules, &receipt, now, models.ValidationItemsTotalMismatch)
+
+	// Purchased at 13:01 on the 1st, which is still in the future 14 hours behind
+	assertCheckCodes(t, rules, &targetReceipt, time.Date(2021, 12, 31, 23, 0, 0, 0, time.UTC), models.ValidationFutureDate)
+	assert.NoError(t, rules.CheckReceipt(&targetReceipt, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)))
+}
+
+func TestConfiguredValidators(t *testing.T) {
+	rules, err := models.ParseRuleSet([]byte(`{
+		"rules": [{"name": "oddDay"}],
+		"validators": [
+			{"name": "itemsTotal", "params": {"tolerance": "0.05"}},
+			{"name": "maxAge", "params": {"days": 30}},
+			{"name": "maxItemCount", "params": {"max": 4}}
+		]
+	}`), models.RuleConfigFormatJSON)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	receipt := targetReceipt
+	receipt.Total = models.MoneyFromString("35.40")
+	assertCheckCodes(t, rules, &receipt, time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC), models.ValidationTooManyItems)
+	assertCheckCodes(t, rules, &cornerMarketReceipt, time.Date(2022, 4, 21, 0, 0, 0, 0, time.UTC), models.ValidationTooOld)
+
+	receipt.Total = models.MoneyFromString("35.41")
+	assertCheckCodes(t, rules, &receipt, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		models.ValidationItemsTotalMismatch, models.ValidationTooOld, models.ValidationTooManyItems)
+
+	// An empty list disables every validator
+	rules, err = models.ParseRuleSet([]byte(`{"rules": [{"name": "oddDay"}], "validators": []}`), models.RuleConfigFormatJSON)
+	if assert.NoError(t, err) {
+		assert.NoError(t, rules.CheckReceipt(&receipt, time.Time{}))
+	}
+
+	for _, config := range []string{
+		`{"rules": [{"name": "oddDay"}], "validators": [{"name": "notAValidator"}]}`,
+		`{"rules": [{"name": "oddDay"}], "validators": [{"name": "maxAge", "params": {"days": 0}}]}`,
+		`{"rules": [{"name": "oddDay"}], "validators": [{"name": "itemsTotal", "params": {"tolerance": "-0.05"}}]}`,
+		`{"rules": [{"name": "oddDay"}], "validators": [{"name": "futureDate"}, {"name": "futureDate"}]}`,
+	} {
+		_, err = models.ParseRuleSet([]byte(config), models.RuleConfigFormatJSON)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestProcessReceiptWithTaxInTotal(t *testing.T) {
+
+	// Item prices don't have to add up to the total unless `itemsTotal` is turned on
+	payload := uniqueReceipt(targetReceipt)
+	payload.Total = models.MoneyFromString("36.35")
+
+	resp, err := processReceipt(&payload)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProcessReceiptWithWrongTotal(t *testing.T) {
+	defer controller.SetRuleSet(models.DefaultRuleSet())
+
+	rules := exampleRuleSet(t)
+	if !assert.NoError(t, controller.SetRuleSet(rules)) {
+		return
+	}
+
+	payload := uniqueReceipt(targetReceipt)
+	payload.Total = models.MoneyFromString("36.35")
+	buf, err := json.Marshal(payload)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(string(buf)))
+	rec := httptest.NewRecorder()
+	controller.ProcessReceipt(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assertInvalidFields(t, rec.Result(), "total")
+}
+
+func TestProcessReceiptWithManyInvalidFields(t *testing.T) {
+
+	payload := &models.Receipt{
+		Retailer:     "Target",
+		Total:        models.MoneyFromString("35"),
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "25:00",
+	}
+
+	resp, err := processReceipt(payload)
+	if err != nil {
+		t.Errorf("Failed to make HTTP request: %v", err)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assertInvalidFields(t, resp, "total", "purchaseTime", "items")
+}
+
+func TestProcessMalformedReceipt(t *testing.T) {
+	for body, fields := range map[string][]string{
+		`{"retailer": ["Target"]}`: {"retailer"},
+		`{"retailer": `:            {""},
+
+		// Amounts of the wrong type are reported along with every other invalid field
+		`{"retailer": "Target", "total": 6.49, "purchaseDate": "2022-01-01", "purchaseTime": "13:01",
+			"items": [{"shortDescription": "Pizza", "price": 6.49}]}`: {"total", "items[0].price"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		controller.ProcessReceipt(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assertInvalidFields(t, rec.Result(), fields...)
+	}
+}
+
+// Helper function to check the codes of the errors a rule set's validators find with a receipt
+func assertCheckCodes(t *testing.T, rules *models.RuleSet, receipt *models.Receipt, now time.Time, codes ...string) {
+	var errs models.ValidationErrors
+	if !assert.ErrorAs(t, rules.CheckReceipt(receipt, now), &errs) {
+		return
+	}
+
+	actual := []string{}
+	for _, err := range errs {
+		actual = append(actual, err.Code)
+	}
+	assert.Equal(t, codes, actual)
+}
+
+func TestLegacyErrors(t *testing.T) {
+	controller.SetLegacyErrors(true)
+	defer controller.SetLegacyErrors(false)
+
+	req := httptest.NewRequest(http.MethodPost, controller.ProcessReceiptPath, strings.NewReader(`{"retailer": "Target"}`))
+	rec := httptest.NewRecorder()
+	controller.ProcessReceipt(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	b, err := io.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "The receipt is invalid.", string(b))
+}
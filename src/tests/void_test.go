@@ -0,0 +1,215 @@
+/**
+void_test.go
+
+Tests voiding processed receipts
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/igor-barinov/fetch-receipt-processor/src/controller"
+	"github.com/igor-barinov/fetch-receipt-processor/src/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreVoidReceipt(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		record := &models.ReceiptRecord{ID: "a", Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+		record.Receipt.UserID = "TestUser1"
+		assert.NoError(t, store.SaveReceipt(record))
+		_, err := store.IncrementReceiptCount("TestUser1")
+		assert.NoError(t, err)
+
+		voidedAt := processedAt.Add(time.Hour)
+		voided, debit, err := store.VoidReceipt("a", "Returned", voidedAt)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, &voidedAt, voided.VoidedAt)
+		assert.Equal(t, "Returned", voided.VoidReason)
+		assert.Equal(t, int64(109), voided.Points)
+		assert.Equal(t, models.LedgerEntryVoid, debit.Kind)
+		assert.Equal(t, int64(-109), debit.Amount)
+		assert.Equal(t, int64(0), debit.Balance)
+		assert.Equal(t, "a", debit.ReceiptID)
+
+		loaded, err := store.GetReceipt("a")
+		if assert.NoError(t, err) {
+			assert.Equal(t, &voidedAt, loaded.VoidedAt)
+			assert.Equal(t, "Returned", loaded.VoidReason)
+		}
+
+		count, err := store.ReceiptCount("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), count)
+
+		_, _, err = store.VoidReceipt("a", "Returned again", voidedAt)
+		assert.ErrorIs(t, err, controller.ErrReceiptVoided)
+		_, _, err = store.VoidReceipt("b", "Returned", voidedAt)
+		assert.ErrorIs(t, err, controller.ErrReceiptNotFound)
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), balance)
+	})
+}
+
+func TestStoreVoidReceiptNotExpired(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		expiresAt := processedAt.AddDate(1, 0, 0)
+		for _, id := range []string{"a", "b"} {
+			record := &models.ReceiptRecord{ID: id, Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+			record.Receipt.UserID = "TestUser1"
+			record.PointsExpireAt = &expiresAt
+			assert.NoError(t, store.SaveReceipt(record))
+		}
+
+		_, _, err := store.VoidReceipt("a", "Returned", processedAt.Add(time.Hour))
+		assert.NoError(t, err)
+
+		// The voided receipt's points were already debited, so only the other receipt's points expire
+		entry, err := store.ExpirePoints("TestUser1", expiresAt)
+		assert.NoError(t, err)
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, int64(-109), entry.Amount)
+			assert.Equal(t, int64(0), entry.Balance)
+		}
+	})
+}
+
+func TestStoreVoidReceiptAfterExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store controller.Store) {
+		processedAt := time.Date(2024, 12, 1, 15, 4, 5, 0, time.UTC)
+		expiresAt := processedAt.AddDate(1, 0, 0)
+		for _, id := range []string{"a", "b", "c"} {
+			record := &models.ReceiptRecord{ID: id, Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+			record.Receipt.UserID = "TestUser1"
+			record.PointsExpireAt = &expiresAt
+			assert.NoError(t, store.SaveReceipt(record))
+		}
+
+		// The redemption spends part of the first receipt's points, so only the rest is taken back
+		_, _, err := store.Redeem(models.LedgerEntry{UserID: "TestUser1", Kind: models.LedgerEntryRedemption, Amount: -50})
+		assert.NoError(t, err)
+		_, debit, err := store.VoidReceipt("a", "Returned", processedAt.Add(time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(-59), debit.Amount)
+			assert.Equal(t, int64(218), debit.Balance)
+		}
+
+		entry, err := store.ExpirePoints("TestUser1", expiresAt)
+		assert.NoError(t, err)
+		if assert.NotNil(t, entry) {
+			assert.Equal(t, int64(-218), entry.Amount)
+			assert.Equal(t, int64(0), entry.Balance)
+		}
+
+		// Expired points were already debited, so voiding takes nothing back
+		_, debit, err = store.VoidReceipt("b", "Returned", expiresAt.Add(time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), debit.Amount)
+			assert.Equal(t, int64(0), debit.Balance)
+		}
+
+		// Points that expired but weren't debited yet are taken back by the void instead of expiring later
+		record := &models.ReceiptRecord{ID: "d", Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: processedAt}
+		record.Receipt.UserID = "TestUser1"
+		record.PointsExpireAt = &expiresAt
+		assert.NoError(t, store.SaveReceipt(record))
+		_, debit, err = store.VoidReceipt("d", "Returned", expiresAt.Add(time.Hour))
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(-109), debit.Amount)
+		}
+
+		entry, err = store.ExpirePoints("TestUser1", expiresAt.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+
+		balance, err := store.Balance("TestUser1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), balance)
+	})
+}
+
+func TestFileStoreVoidReceiptReplay(t *testing.T) {
+	dir := t.TempDir()
+	store := mustOpenFileStore(t, dir, 0)
+	record := &models.ReceiptRecord{ID: "a", Receipt: cornerMarketReceipt, Points: 109, ProcessedAt: time.Now().UTC()}
+	assert.NoError(t, store.SaveReceipt(record))
+	_, _, err := store.VoidReceipt("a", "Returned", time.Now().UTC())
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	reopened := mustOpenFileStore(t, dir, 0)
+	defer reopened.Close()
+
+	loaded, err := reopened.GetReceipt("a")
+	if assert.NoError(t, err) {
+		assert.NotNil(t, loaded.VoidedAt)
+		assert.Equal(t, "Returned", loaded.VoidReason)
+	}
+
+	balance, err := reopened.Balance("")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+// Helper function to void a receipt without going through the server
+func voidReceiptInProcess(id string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/receipts/"+id+"/void", strings.NewReader(body))
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	controller.VoidReceipt(rec, req)
+
+	return rec
+}
+
+func TestVoidReceipt(t *testing.T) {
+	// The user's first receipt also earns a bonus
+	receipt := uniqueReceipt(targetReceipt)
+	receipt.UserID = "VoidUser-" + uuid.New().String()
+	id := processReceiptInProcess(t, &receipt)
+
+	for _, body := range []string{`{}`, `{"reason": "  "}`, `{"reason": "` + strings.Repeat("a", 501) + `"}`, `{"reason": `} {
+		rec := voidReceiptInProcess(id, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+		assert.Contains(t, rec.Body.String(), controller.ErrorTypeInvalidRequest, body)
+	}
+
+	rec := voidReceiptInProcess(id, `{"reason": "Returned to store"}`)
+	if !assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String()) {
+		return
+	}
+
+	var resp models.VoidReceiptResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp)) {
+		assert.Equal(t, id, resp.ID)
+		assert.Equal(t, "Returned to store", resp.VoidReason)
+		assert.Equal(t, int64(-1028), resp.Debit.Amount)
+		assert.Equal(t, int64(0), resp.Debit.Balance)
+	}
+
+	// The receipt keeps its points for audit, but reports that it was voided
+	points := getPointsInProcess(t, id)
+	assert.Equal(t, int64(1028), points.Points)
+	assert.True(t, points.Voided)
+	assert.NotNil(t, points.VoidedAt)
+	assert.Equal(t, "Returned to store", points.VoidReason)
+
+	rec = voidReceiptInProcess(id, `{"reason": "Returned to store"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), controller.ErrorTypeReceiptVoided)
+
+	rec = voidReceiptInProcess(uuid.New().String(), `{"reason": "Returned to store"}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}